@@ -1,5 +1,97 @@
 package main
 
-import "os/exec"
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
 
 var execCommand = exec.Command
+
+// overlayGoCommands lists the go subcommands that accept -overlay.
+var overlayGoCommands = map[string]bool{
+	"build": true, "install": true, "list": true, "run": true, "test": true, "vet": true,
+}
+
+// runExec implements `inco exec [--] CMD [args]`: it generates the overlay
+// of the current directory and runs CMD with it. A go subcommand that
+// accepts -overlay gets the flag, merged like runGo does; any other
+// command gets it in $GOFLAGS, which the go commands it runs pick up.
+func runExec(args []string) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	// @inco: len(args) > 0, -panic("exec: no command given; use inco exec -- CMD [args]")
+	root := genRoot(".")
+	runGen(root, genOptions{local: localModules(nil)}, nil)
+
+	name, cmdArgs := args[0], args[1:]
+	env := os.Environ()
+	var overlay string
+	var merged bool
+	if isGoCommand(name) && len(cmdArgs) > 0 && overlayGoCommands[cmdArgs[0]] {
+		userOverlay, rest := splitOverlayFlag(cmdArgs[0], cmdArgs[1:])
+		if userOverlay == "" {
+			userOverlay, _ = splitGoflagsOverlay()
+		}
+		overlay, merged = goOverlay(root, userOverlay)
+		if overlay != "" {
+			rest = append([]string{"-overlay=" + overlay}, rest...)
+		}
+		cmdArgs = append([]string{cmdArgs[0]}, rest...)
+	} else {
+		userOverlay, goflags := splitGoflagsOverlay()
+		overlay, merged = goOverlay(root, userOverlay)
+		if overlay != "" {
+			env = append(env, "GOFLAGS="+goflagsWithOverlay(goflags, overlay))
+		}
+	}
+
+	cmd := execCommand(name, cmdArgs...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	code := exitCode(cmd.Run())
+	if merged {
+		os.Remove(overlay)
+	}
+	os.Exit(code)
+}
+
+// runEnv implements `inco env [dir]`: it generates the overlay and prints
+// a shell line that exports $GOFLAGS with it, for
+//
+//	eval "$(inco env)"
+//
+// The line names overlay.json itself, so it stays valid as later runs
+// regenerate the overlay. An -overlay of another tool in $GOFLAGS cannot
+// be merged into a file that changes, and is an error.
+func runEnv(dir string) {
+	root := genRoot(dir)
+	runGen(root, genOptions{local: localModules(nil)}, nil)
+	overlay := filepath.Join(root, ".inco_cache", "overlay.json")
+	userOverlay, goflags := splitGoflagsOverlay()
+	_ = userOverlay // @inco: userOverlay == "" || sameFile(userOverlay, overlay), -panic(fmt.Sprintf("env: GOFLAGS already has -overlay=%s; use inco exec, which merges it", userOverlay))
+	fmt.Printf("export GOFLAGS=%s\n", shellQuote(goflagsWithOverlay(goflags, overlay)))
+}
+
+// isGoCommand reports whether the program name refers to the go command.
+func isGoCommand(name string) bool {
+	return strings.TrimSuffix(filepath.Base(name), ".exe") == "go"
+}
+
+// goflagsWithOverlay appends -overlay=overlay to the $GOFLAGS value
+// goflags. Entries of $GOFLAGS are separated by spaces, so the path cannot
+// contain one.
+func goflagsWithOverlay(goflags, overlay string) string {
+	// @inco: !strings.ContainsAny(overlay, " \t\n"), -panic(fmt.Sprintf("overlay path %q contains spaces and cannot go into GOFLAGS", overlay))
+	return strings.TrimSpace(goflags + " -overlay=" + overlay)
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	inco "github.com/imnive-design/inco-go/internal/inco"
 )
@@ -12,21 +19,67 @@ import (
 const usage = `inco — invisible constraints, invincible code.
 
 Usage:
-  inco gen [dir]           Scan source files and generate overlay
+  inco gen [-v] [--trimpath] [--local-modules] [--keep-going] [dir]
+                           Scan source files and generate overlay
+  inco watch [-v] [--trimpath] [--local-modules] [--keep-going] [--interval=DUR] [dir]
+                           Regenerate the overlay as sources change
+  inco serve               Run a daemon that keeps generation state in memory
   inco build [args]        Run gen + go build -overlay
   inco test [args]         Run gen + go test -overlay
   inco run [args]          Run gen + go run -overlay
-  inco audit [dir]         Contract coverage report
-  inco release [--dry-run] [dir]       Copy guards into source tree
+  inco exec [--] CMD [args]
+                           Run gen + CMD with the overlay (go vet, linters, ...)
+  inco env [dir]           Run gen + print an export line for GOFLAGS
+  inco toolexec TOOL [args]
+                           Wrap a go tool: go build -toolexec="inco toolexec"
+  inco audit [dir]         Contract coverage report and directive IDs
+  inco release [--dry-run] [dir]
+                           Copy guards into source tree
   inco release clean [dir] Remove released files and restore originals
   inco clean [dir]         Remove .inco_cache
+  inco clean --cache [--max-age=DUR] [--max-size=BYTES]
+                           Trim the shared cache (default 120h, 1073741824)
+  inco version             Print the engine version
 
 If [dir] is omitted, the current directory is used.
+--trimpath (or -trimpath passed to build/test/run) writes module-relative
+paths into //line directives; release always does.
+Inside a go.work workspace, gen, watch, build, test, run and clean operate
+on the workspace root, so every module shares one overlay.
+--local-modules (or INCOLOCAL=on for build/test/run) also generates the
+modules that local replace directives and go.work point to outside the
+root, so their directives are enforced in this project's builds.
+-v prints every file that is regenerated, skipped or fails, and why.
+--keep-going writes the overlay for every file that could be generated
+even when others fail; every problem is printed and gen exits non-zero.
+An -overlay given to build/test/run, or in GOFLAGS, is merged with the
+inco overlay; a file that both replace is an error. exec passes the
+overlay as -overlay to go subcommands that accept it and in GOFLAGS to
+any other command; eval "$(inco env)" exports it for later go commands.
+toolexec needs no overlay: it hands the compiler the shadows of the files
+it compiles. Linked or copied as inco-toolexec, the binary behaves as
+inco toolexec, for go build -toolexec=inco-toolexec.
+
+Environment:
+  INCOCACHE   Shared shadow cache across checkouts: "on" uses the per-user
+              cache directory, an absolute path uses that directory, and
+              unset or "off" keeps shadows in each project's .inco_cache.
+  INCOCOVER   Coverage profiles written by inco test are moved onto the
+              sources; "guards" counts injected guards as statements at
+              their directives, unset or "source" leaves them out.
+  INCOLOCAL   "on" behaves as --local-modules for every command.
+  INCOSOCKET  Socket of the inco serve daemon (default: per-user cache
+              directory); "off" never contacts the daemon. gen, build,
+              test and run use a running daemon and fall back otherwise.
 `
 
 func main() {
 	defer guardPanic()
 
+	if strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe") == toolexecName {
+		runToolexec(os.Args[1:])
+		return
+	}
 	if len(os.Args) < 2 {
 		fmt.Print(usage)
 		os.Exit(0)
@@ -34,45 +87,58 @@ func main() {
 
 	switch os.Args[1] {
 	case "gen":
-		runGen(getDir(2))
-	case "build":
-		runGen(".")
-		runGo("build", ".", os.Args[2:])
-	case "test":
-		runGen(".")
-		runGo("test", ".", os.Args[2:])
-	case "run":
-		runGen(".")
-		runGo("run", ".", os.Args[2:])
+		runGen(genRoot(firstNonFlag(2)), genOptions{
+			trimpath:  hasFlag(os.Args[2:], "--trimpath"),
+			local:     localModules(os.Args[2:]),
+			keepGoing: hasFlag(os.Args[2:], "--keep-going"),
+			verbose:   hasFlag(os.Args[2:], "-v"),
+		}, nil)
+	case "watch":
+		runWatch(genRoot(firstNonFlag(2)), os.Args[2:])
+	case "serve":
+		runServe()
+	case "build", "test", "run":
+		// Any module of a go.work workspace shares the workspace's overlay.
+		// Only the packages being built, and their dependencies, are
+		// generated.
+		root := genRoot(".")
+		opts := genOptions{
+			trimpath:   hasFlag(os.Args[2:], "-trimpath"),
+			local:      localModules(nil),
+			buildFlags: buildFlags(os.Args[1], os.Args[2:]),
+		}
+		runGen(root, opts, packagePatterns(os.Args[1], os.Args[2:]))
+		runGo(os.Args[1], root, os.Args[2:])
+	case "exec":
+		runExec(os.Args[2:])
+	case "env":
+		runEnv(getDir(2))
+	case "toolexec":
+		runToolexec(os.Args[2:])
 	case "audit":
 		runAudit(getDir(2)).PrintReport(os.Stdout)
 	case "release":
 		if len(os.Args) > 2 && os.Args[2] == "clean" {
 			runReleaseClean(getDir(3))
 		} else {
-			dryRun := false
-			dirIdx := 2
-			for i := 2; i < len(os.Args); i++ {
-				if os.Args[i] == "--dry-run" {
-					dryRun = true
-				}
-			}
-			// Find the first non-flag argument as dir.
-			for i := 2; i < len(os.Args); i++ {
-				if !strings.HasPrefix(os.Args[i], "-") {
-					dirIdx = i
-					break
-				}
-			}
-			dir := getDir(dirIdx)
-			runGen(dir)
+			dryRun := hasFlag(os.Args[2:], "--dry-run")
+			dir := firstNonFlag(2)
+			// Released files are committed: always use module-relative
+			// //line paths so that every machine produces the same bytes.
+			runGen(dir, genOptions{trimpath: true}, nil)
 			runRelease(dir, dryRun)
 		}
 	case "clean":
-		dir := getDir(2)
+		if hasFlag(os.Args[2:], "--cache") {
+			runTrimCache(os.Args[2:])
+			return
+		}
+		dir := genRoot(getDir(2))
 		err := os.RemoveAll(filepath.Join(dir, ".inco_cache"))
 		_ = err // @inco: err == nil, -panic(err)
 		fmt.Println("inco: cache cleaned")
+	case "version":
+		fmt.Println("inco", inco.EngineVersion())
 	default:
 		fmt.Fprintf(os.Stderr, "inco: unknown command %q\n", os.Args[1])
 		fmt.Print(usage)
@@ -94,13 +160,346 @@ func getDir(argIdx int) string {
 	return "."
 }
 
-func runGen(dir string) {
+// shadowGrace is how long shadows dropped from the overlay survive, so
+// that concurrent go commands started from the previous overlay can finish.
+const shadowGrace = 10 * time.Minute
+
+// firstNonFlag returns the first argument from os.Args[from:] that does
+// not start with "-", or "." when there is none.
+func firstNonFlag(from int) string {
+	for i := from; i < len(os.Args); i++ {
+		if !strings.HasPrefix(os.Args[i], "-") {
+			return os.Args[i]
+		}
+	}
+	return "."
+}
+
+// hasFlag reports whether args contains flag, either bare or as flag=value.
+// Scanning stops at -args or --: what follows is passed to the program or
+// test binary, not to inco or the go command.
+func hasFlag(args []string, flag string) bool {
+	for _, a := range args {
+		// @inco: a != "-args" && a != "--", -return(false)
+		if a == flag || strings.HasPrefix(a, flag+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// genOptions are the engine settings chosen on the command line.
+type genOptions struct {
+	trimpath   bool     // Engine.Trimpath
+	local      bool     // Engine.LocalModules
+	keepGoing  bool     // Engine.KeepGoing
+	verbose    bool     // print file events
+	buildFlags []string // see Engine.RunPackages
+}
+
+// runGen generates the overlay for dir. With patterns, generation is
+// limited to those packages (relative to the current directory) and their
+// dependencies.
+func runGen(dir string, opts genOptions, patterns []string) {
 	absDir, err := filepath.Abs(dir)
 	_ = err // @inco: err == nil, -panic(err)
-	err = inco.NewEngine(absDir).Run()
+	cwd, err := os.Getwd()
+	_ = err // @inco: err == nil, -panic(err)
+	if genViaDaemon(absDir, opts, cwd, patterns) {
+		return
+	}
+	e := inco.NewEngine(absDir)
+	e.Trimpath = opts.trimpath
+	e.LocalModules = opts.local
+	e.KeepGoing = opts.keepGoing
+	if opts.verbose {
+		e.Events = printEvent
+	}
+	// Another inco build/test may still be compiling from the previous
+	// overlay; keep the shadows it references around for a while.
+	e.ShadowGrace = shadowGrace
+	e.SharedCache = sharedCacheDir()
+	err = e.RunPackages(cwd, opts.buildFlags, patterns)
+	exitOnError(e.Diagnostics, err)
+}
+
+// printEvent prints the -v line for ev. Cached files are not mentioned.
+func printEvent(ev inco.Event) {
+	switch ev.Kind {
+	case inco.EventStart:
+		fmt.Fprintf(os.Stderr, "inco: checking %d file(s)\n", ev.Total)
+	case inco.EventRegenerated, inco.EventSkipped:
+		ids := ""
+		if len(ev.Directives) > 0 {
+			ids = " [" + strings.Join(ev.Directives, " ") + "]"
+		}
+		fmt.Fprintf(os.Stderr, "inco: %s %s (%s)%s\n", ev.Kind, ev.Path, ev.Reason, ids)
+	case inco.EventError:
+		fmt.Fprintf(os.Stderr, "inco: failed %s\n", ev.Path)
+	}
+}
+
+// exitOnError prints diagnostics to stderr and ends the process when err
+// is set: with status 1 after a *DiagnosticsError, whose problems have
+// just been printed, and through guardPanic otherwise.
+func exitOnError(diags []inco.Diagnostic, err error) {
+	for _, d := range diags {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	var de *inco.DiagnosticsError
+	if errors.As(err, &de) {
+		os.Exit(1)
+	}
 	_ = err // @inco: err == nil, -panic(err)
 }
 
+// goValueFlags lists the go build and go test flags that take their value
+// as a separate argument, so that the value is not mistaken for a package.
+var goValueFlags = map[string]bool{
+	"-C": true, "-asmflags": true, "-buildmode": true, "-compiler": true,
+	"-coverpkg": true, "-covermode": true, "-exec": true, "-gccgoflags": true,
+	"-gcflags": true, "-installsuffix": true, "-ldflags": true, "-mod": true,
+	"-modfile": true, "-o": true, "-overlay": true, "-p": true, "-pgo": true,
+	"-pkgdir": true, "-tags": true, "-toolexec": true,
+	// go test
+	"-bench": true, "-benchtime": true, "-blockprofile": true,
+	"-blockprofilerate": true, "-count": true, "-coverprofile": true,
+	"-cpu": true, "-cpuprofile": true, "-fuzz": true, "-fuzzminimizetime": true,
+	"-fuzztime": true, "-list": true, "-memprofile": true,
+	"-memprofilerate": true, "-mutexprofile": true, "-mutexprofilefraction": true,
+	"-outputdir": true, "-parallel": true, "-run": true, "-shuffle": true,
+	"-skip": true, "-timeout": true, "-trace": true, "-vet": true,
+}
+
+// packagePatterns extracts the package patterns from the arguments of
+// go build, test or run. For run only the first one names the program;
+// later arguments belong to it, as do those after -args for test.
+func packagePatterns(subcmd string, args []string) []string {
+	var patterns []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		// @inco: a != "-args" && a != "--", -break
+		if strings.HasPrefix(a, "-") {
+			name := strings.TrimPrefix(a, "-")
+			name = "-" + strings.TrimPrefix(name, "-") // --flag is -flag
+			if !strings.Contains(name, "=") && goValueFlags[name] {
+				i++
+			}
+			continue
+		}
+		patterns = append(patterns, a)
+		// @inco: subcmd != "run", -break
+	}
+	return patterns
+}
+
+// goListFlags are the go build flags that change which files and packages
+// a build uses, and so which packages must be generated for it.
+var goListFlags = map[string]bool{
+	"-tags": true, "-mod": true, "-modfile": true,
+	"-race": true, "-msan": true, "-asan": true,
+}
+
+// buildFlags returns the flags in goListFlags among the go flags in args,
+// which end where packagePatterns says, each as a single argument.
+func buildFlags(subcmd string, args []string) []string {
+	return selectFlags(subcmd, args, goListFlags)
+}
+
+// coverFlags are the go flags that turn on coverage instrumentation.
+var coverFlags = map[string]bool{
+	"-cover": true, "-covermode": true, "-coverpkg": true, "-coverprofile": true,
+}
+
+// selectFlags returns the flags named in names among the go flags in args,
+// which end where packagePatterns says, each as a single argument. A
+// -test. prefix is dropped, as the go command does.
+func selectFlags(subcmd string, args []string, names map[string]bool) []string {
+	var flags []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		// @inco: a != "-args" && a != "--", -break
+		if !strings.HasPrefix(a, "-") {
+			// @inco: subcmd != "run", -break
+			continue
+		}
+		name, value, hasValue := strings.Cut(a, "=")
+		flag := "-" + strings.TrimPrefix(strings.TrimLeft(name, "-"), "test.")
+		if !hasValue && goValueFlags[flag] && i+1 < len(args) {
+			i++
+			value, hasValue = args[i], true
+		}
+		// @inco: names[flag], -continue
+		if hasValue {
+			flag += "=" + value
+		}
+		flags = append(flags, flag)
+	}
+	return flags
+}
+
+// genViaDaemon asks a running `inco serve` to generate absDir's overlay.
+// It reports false when no compatible daemon is reachable, in which case
+// the caller generates in process.
+func genViaDaemon(absDir string, opts genOptions, cwd string, patterns []string) bool {
+	socket := socketPath()
+	_ = socket // @inco: socket != "", -return(false)
+	resp, err := inco.RequestGenerate(socket, inco.DaemonRequest{
+		Root:         absDir,
+		Dir:          cwd,
+		Patterns:     patterns,
+		BuildFlags:   opts.buildFlags,
+		Trimpath:     opts.trimpath,
+		LocalModules: opts.local,
+		KeepGoing:    opts.keepGoing,
+		Events:       opts.verbose,
+		ShadowGrace:  shadowGrace,
+		SharedCache:  sharedCacheDir(),
+	})
+	_ = err // @inco: !errors.Is(err, inco.ErrNoDaemon), -return(false)
+	for _, ev := range resp.Events {
+		printEvent(ev)
+	}
+	fmt.Fprint(os.Stderr, resp.Output)
+	exitOnError(resp.Diagnostics, err)
+	return true
+}
+
+// socketPath resolves $INCOSOCKET to the daemon socket, or "" when the
+// daemon is disabled.
+func socketPath() string {
+	env := os.Getenv("INCOSOCKET")
+	switch env {
+	case "off":
+		return ""
+	case "":
+		path, err := inco.DefaultSocketPath()
+		_ = err // @inco: err == nil, -return("")
+		return path
+	}
+	return env
+}
+
+// runServe implements `inco serve`: it answers generation requests on the
+// daemon socket until interrupted.
+func runServe() {
+	socket := socketPath()
+	// @inco: socket != "", -panic("inco serve: INCOSOCKET is off")
+	l, err := inco.Listen(socket)
+	_ = err // @inco: err == nil, -panic(err)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		l.Close()
+	}()
+	fmt.Printf("inco: serving on %s (Ctrl-C to stop)\n", socket)
+	err = inco.NewServer().Serve(l)
+	_ = err // @inco: err == nil, -panic(err)
+}
+
+// genRoot returns the absolute directory to generate from for dir: the
+// directory of the governing go.work, or dir itself outside a workspace.
+func genRoot(dir string) string {
+	absDir, err := filepath.Abs(dir)
+	_ = err // @inco: err == nil, -panic(err)
+	return inco.WorkspaceRoot(absDir)
+}
+
+// runWatch implements `inco watch`: it keeps the overlay current until
+// interrupted, so that editors and go commands always see fresh shadows.
+func runWatch(dir string, args []string) {
+	absDir, err := filepath.Abs(dir)
+	_ = err // @inco: err == nil, -panic(err)
+	interval, err := time.ParseDuration(flagValue(args, "--interval", "500ms"))
+	_ = err // @inco: err == nil && interval > 0, -panic(fmt.Sprintf("--interval: invalid duration %q", flagValue(args, "--interval", "")))
+
+	e := inco.NewEngine(absDir)
+	e.Trimpath = hasFlag(args, "--trimpath")
+	e.LocalModules = localModules(args)
+	e.KeepGoing = hasFlag(args, "--keep-going")
+	if hasFlag(args, "-v") {
+		e.Events = printEvent
+	}
+	e.ShadowGrace = shadowGrace
+	e.SharedCache = sharedCacheDir()
+	w := inco.NewWatcher(e)
+	w.Interval = interval
+	w.OnRun = func(changed []string, err error) {
+		for _, d := range e.Diagnostics {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		var de *inco.DiagnosticsError
+		if err != nil && !errors.As(err, &de) {
+			fmt.Fprintf(os.Stderr, "inco: %v\n", err)
+		}
+	}
+
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		close(stop)
+	}()
+	fmt.Printf("inco: watching %s (Ctrl-C to stop)\n", absDir)
+	err = w.Watch(stop)
+	_ = err // @inco: err == nil, -panic(err)
+}
+
+// sharedCacheDir resolves $INCOCACHE to the shared cache directory, or ""
+// when the shared cache is disabled.
+func sharedCacheDir() string {
+	env := os.Getenv("INCOCACHE")
+	switch env {
+	case "", "off":
+		return ""
+	case "on":
+		dir, err := inco.DefaultSharedCacheDir()
+		_ = err // @inco: err == nil, -panic(err)
+		return dir
+	}
+	// @inco: filepath.IsAbs(env), -panic(fmt.Sprintf("INCOCACHE must be \"on\", \"off\" or an absolute path, got %q", env))
+	return env
+}
+
+// localModules reports whether local replace targets and workspace
+// modules outside the root are generated too: --local-modules in args, or
+// $INCOLOCAL set to "on".
+func localModules(args []string) bool {
+	return hasFlag(args, "--local-modules") || os.Getenv("INCOLOCAL") == "on"
+}
+
+// flagValue returns the value of a --name=value argument, or def. Like
+// hasFlag, it stops at -args or --.
+func flagValue(args []string, name, def string) string {
+	for _, a := range args {
+		// @inco: a != "-args" && a != "--", -return(def)
+		if v, ok := strings.CutPrefix(a, name+"="); ok {
+			return v
+		}
+	}
+	return def
+}
+
+// runTrimCache implements `inco clean --cache`.
+func runTrimCache(args []string) {
+	dir := sharedCacheDir()
+	if dir == "" {
+		d, err := inco.DefaultSharedCacheDir()
+		_ = err // @inco: err == nil, -panic(err)
+		dir = d
+	}
+	maxAge, err := time.ParseDuration(flagValue(args, "--max-age", "120h"))
+	_ = err // @inco: err == nil, -panic(fmt.Sprintf("--max-age: %v", err))
+	maxSize, err := strconv.ParseInt(flagValue(args, "--max-size", "1073741824"), 10, 64)
+	_ = err // @inco: err == nil, -panic(fmt.Sprintf("--max-size: %v", err))
+	r, err := inco.TrimSharedCache(dir, maxAge, maxSize)
+	_ = err // @inco: err == nil, -panic(err)
+	fmt.Printf("inco: trimmed %s: removed %d shadow(s) (%d bytes), kept %d (%d bytes)\n",
+		dir, r.Removed, r.Freed, r.Kept, r.Size)
+}
+
 func runAudit(dir string) *inco.AuditResult {
 	absDir, err := filepath.Abs(dir)
 	_ = err // @inco: err == nil, -panic(err)
@@ -112,35 +511,249 @@ func runAudit(dir string) *inco.AuditResult {
 func runRelease(dir string, dryRun bool) {
 	absDir, err := filepath.Abs(dir)
 	_ = err // @inco: err == nil, -panic(err)
-	err = inco.Release(absDir, dryRun)
+	err = inco.Release(absDir, dryRun, os.Stderr)
 	_ = err // @inco: err == nil, -panic(err)
 }
 
 func runReleaseClean(dir string) {
 	absDir, err := filepath.Abs(dir)
 	_ = err // @inco: err == nil, -panic(err)
-	err = inco.ReleaseClean(absDir)
+	err = inco.ReleaseClean(absDir, os.Stderr)
 	_ = err // @inco: err == nil, -panic(err)
 }
 
+// runGo runs the go subcommand with the inco overlay of dir. An -overlay
+// already given in args or $GOFLAGS is merged into it, since the go
+// command honours only one.
 func runGo(subcmd, dir string, extraArgs []string) {
+	userOverlay, extraArgs := splitOverlayFlag(subcmd, extraArgs)
+	if userOverlay == "" {
+		userOverlay, _ = splitGoflagsOverlay()
+	}
+	overlay, merged := goOverlay(dir, userOverlay)
+	args := extraArgs
+	if overlay != "" {
+		args = append([]string{fmt.Sprintf("-overlay=%s", overlay)}, extraArgs...)
+	}
+	if overlay != "" && wantsCover(subcmd, extraArgs) {
+		args = append([]string{coverToolexec(subcmd, extraArgs, overlay)}, args...)
+	}
+	code := execGo(subcmd, args, outputMapper(dir))
+	if merged {
+		os.Remove(overlay)
+	}
+	if profile := goFlagValue(subcmd, extraArgs, "coverprofile"); profile != "" {
+		if outdir := goFlagValue(subcmd, extraArgs, "outputdir"); outdir != "" && !filepath.IsAbs(profile) {
+			profile = filepath.Join(outdir, profile)
+		}
+		remapCoverProfile(dir, profile)
+	}
+	os.Exit(code)
+}
+
+// wantsCover reports whether the go flags in args or $GOFLAGS turn on
+// coverage instrumentation.
+func wantsCover(subcmd string, args []string) bool {
+	goflags := strings.Fields(os.Getenv("GOFLAGS"))
+	return len(selectFlags(subcmd, args, coverFlags)) > 0 || len(selectFlags("build", goflags, coverFlags)) > 0
+}
+
+// coverToolexec returns the -toolexec flag that has the cover tool
+// instrument the shadows of overlay rather than the original files, which
+// the go command would hand it, leaving out the guards. It cannot be
+// combined with a -toolexec of the user's.
+func coverToolexec(subcmd string, args []string, overlay string) string {
+	toolexec := map[string]bool{"-toolexec": true}
+	goflags := strings.Fields(os.Getenv("GOFLAGS"))
+	user := append(selectFlags(subcmd, args, toolexec), selectFlags("build", goflags, toolexec)...)
+	_ = user // @inco: len(user) == 0, -panic("coverage needs inco's own -toolexec to keep the guards in instrumented files; drop " + user[0] + " or use go build -toolexec=\"inco toolexec\" alone")
+	exe, err := os.Executable()
+	_ = err // @inco: err == nil, -panic(err)
+	return fmt.Sprintf("-toolexec=%s toolexec -overlay=%s", quoteToolexecArg(exe), quoteToolexecArg(overlay))
+}
+
+// quoteToolexecArg quotes s for the go command's -toolexec flag, which is
+// split at spaces outside quotes.
+func quoteToolexecArg(s string) string {
+	// @inco: strings.ContainsAny(s, " \t"), -return(s)
+	// @inco: !strings.Contains(s, `"`), -return("'" + s + "'")
+	return `"` + s + `"`
+}
+
+// goFlagValue returns the value of the go flag -name (or -test.name) in
+// args, given as -name=value or -name value, or "" when it is not set.
+// Like splitOverlayFlag, it stops where the go flags end.
+func goFlagValue(subcmd string, args []string, name string) string {
+	var value string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		// @inco: a != "-args" && a != "--", -return(value)
+		// @inco: strings.HasPrefix(a, "-") || subcmd != "run", -return(value)
+		flag, v, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		flag = strings.TrimPrefix(flag, "test.")
+		if !hasValue && i+1 < len(args) && (flag == name || goValueFlags["-"+flag]) {
+			i++
+			v = args[i]
+		}
+		if flag == name {
+			value = v
+		}
+	}
+	return value
+}
+
+// remapCoverProfile rewrites the coverage profile at path, written by go
+// test under the inco overlay of dir, onto the original sources.
+// $INCOCOVER selects whether injected guards count as statements.
+func remapCoverProfile(dir, path string) {
+	data, err := os.ReadFile(path)
+	_ = err // @inco: err == nil, -return
+	cwd, err := os.Getwd()
+	_ = err // @inco: err == nil, -panic(err)
+	ov, err := inco.LoadOverlay(filepath.Join(dir, ".inco_cache", "overlay.json"), cwd)
+	_ = err // @inco: err == nil, -return
+	var opts inco.CoverOptions
+	switch env := os.Getenv("INCOCOVER"); env {
+	case "", "source":
+	case "guards":
+		opts.Guards = true
+	default:
+		panic(fmt.Sprintf("INCOCOVER must be \"source\" or \"guards\", got %q", env))
+	}
+	var buf bytes.Buffer
+	err = inco.RemapCoverProfile(bytes.NewReader(data), &buf, ov, opts)
+	_ = err // @inco: err == nil, -panic(err)
+	err = os.WriteFile(path, buf.Bytes(), 0o644)
+	_ = err // @inco: err == nil, -panic(err)
+}
+
+// goOverlay returns the overlay file to hand the go command for dir, or ""
+// when dir has none. With userOverlay set, that is a merge of both, and
+// merged reports that the caller must remove it once the command is done.
+func goOverlay(dir, userOverlay string) (overlay string, merged bool) {
 	overlayPath := filepath.Join(dir, ".inco_cache", "overlay.json")
 	if _, err := os.Stat(overlayPath); os.IsNotExist(err) {
-		execGo(subcmd, extraArgs)
-		return
+		return userOverlay, false
 	}
 	absOverlay, err := filepath.Abs(overlayPath)
 	_ = err // @inco: err == nil, -panic(err)
-	args := append([]string{fmt.Sprintf("-overlay=%s", absOverlay)}, extraArgs...)
-	execGo(subcmd, args)
+	// @inco: userOverlay != "" && !sameFile(userOverlay, absOverlay), -return(absOverlay, false)
+	return mergeUserOverlay(absOverlay, userOverlay), true
+}
+
+// sameFile reports whether paths a and b name the same file, so that the
+// inco overlay, exported through inco env, is not merged with itself.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	_ = err // @inco: err == nil, -return(false)
+	bi, err := os.Stat(b)
+	_ = err // @inco: err == nil, -return(false)
+	return os.SameFile(ai, bi)
+}
+
+// splitOverlayFlag removes every -overlay flag from the go flags in args,
+// which end where packagePatterns says, and returns the value of the last
+// one (the one the go command would use), or "" when there is none.
+func splitOverlayFlag(subcmd string, args []string) (string, []string) {
+	var path string
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		// @inco: a != "-args" && a != "--", -return(path, append(rest, args[i:]...))
+		name, value, hasValue := strings.Cut(a, "=")
+		if name == "-overlay" || name == "--overlay" {
+			if !hasValue && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			path = value
+			continue
+		}
+		rest = append(rest, a)
+		if strings.HasPrefix(a, "-") {
+			flag := "-" + strings.TrimLeft(name, "-")
+			if !hasValue && goValueFlags[flag] && i+1 < len(args) {
+				i++
+				rest = append(rest, args[i])
+			}
+			continue
+		}
+		// @inco: subcmd != "run", -return(path, append(rest, args[i+1:]...))
+	}
+	return path, rest
+}
+
+// splitGoflagsOverlay returns the value of the -overlay flag in $GOFLAGS,
+// or "", and $GOFLAGS without it. A command-line -overlay overrides the
+// one in $GOFLAGS, so runGo leaves the variable as it is.
+func splitGoflagsOverlay() (path, goflags string) {
+	var rest []string
+	for _, f := range strings.Fields(os.Getenv("GOFLAGS")) {
+		name, value, _ := strings.Cut(f, "=")
+		if name == "-overlay" || name == "--overlay" {
+			path = value
+			continue
+		}
+		rest = append(rest, f)
+	}
+	return path, strings.Join(rest, " ")
+}
+
+// mergeUserOverlay merges the user's overlay file into the inco overlay
+// and returns the path of the result, a temporary file in .inco_cache
+// that the caller removes. Files replaced by both are printed as errors
+// and end the process.
+func mergeUserOverlay(incoPath, userPath string) string {
+	cwd, err := os.Getwd()
+	_ = err // @inco: err == nil, -panic(err)
+	if !filepath.IsAbs(userPath) {
+		userPath = filepath.Join(cwd, userPath)
+	}
+	ov, err := inco.LoadOverlay(incoPath, cwd)
+	_ = err // @inco: err == nil, -panic(err)
+	user, err := inco.LoadOverlay(userPath, cwd)
+	_ = err // @inco: err == nil, -panic(err)
+	merged, diags := inco.MergeOverlays(ov, user, userPath)
+	if len(diags) > 0 {
+		exitOnError(diags, &inco.DiagnosticsError{Diagnostics: diags})
+	}
+	data, err := json.MarshalIndent(merged, "", "  ")
+	_ = err // @inco: err == nil, -panic(err)
+	f, err := os.CreateTemp(filepath.Dir(incoPath), "overlay-merged-*.json")
+	_ = err // @inco: err == nil, -panic(err)
+	_, err = f.Write(data)
+	cerr := f.Close()
+	_ = err  // @inco: err == nil, -panic(err)
+	_ = cerr // @inco: cerr == nil, -panic(cerr)
+	return f.Name()
 }
 
-func execGo(subcmd string, args []string) {
+// outputMapper returns the mapper for the output of go commands run from
+// the current directory with the inco overlay of dir, or nil when dir has
+// no overlay.
+func outputMapper(dir string) *inco.OutputMapper {
+	cwd, err := os.Getwd()
+	_ = err // @inco: err == nil, -return(nil)
+	ov, err := inco.LoadOverlay(filepath.Join(dir, ".inco_cache", "overlay.json"), cwd)
+	_ = err // @inco: err == nil, -return(nil)
+	return inco.NewOutputMapper(ov, cwd)
+}
+
+// execGo runs the go subcommand with the standard streams and returns its
+// exit status. With a mapper, stderr goes through it, so that compiler
+// and vet messages point at sources rather than shadows.
+func execGo(subcmd string, args []string, mapper *inco.OutputMapper) int {
 	cmd := execCommand("go", append([]string{subcmd}, args...)...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
+	if mapper != nil {
+		stderr := mapper.Writer(os.Stderr)
+		defer stderr.Close()
+		cmd.Stderr = stderr
+	}
 	if err := cmd.Run(); err != nil {
-		os.Exit(1)
+		return 1
 	}
+	return 0
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	inco "github.com/imnive-design/inco-go/internal/inco"
+)
+
+// toolexecName is the program name under which inco behaves as
+// `inco toolexec`, for go build -toolexec=inco-toolexec.
+const toolexecName = "inco-toolexec"
+
+// runToolexec implements `inco toolexec`, which go build -toolexec runs in
+// front of every tool: args are the tool's path and arguments. Only the
+// compiler is affected; its .go inputs with directives are replaced by
+// their shadows for the duration of the compile. With a leading
+// -overlay=FILE, as inco test adds for coverage, only the cover tool is.
+func runToolexec(args []string) {
+	// @inco: len(args) > 0, -panic("toolexec: no tool given; use go build -toolexec=\"inco toolexec\"")
+	if overlay, ok := strings.CutPrefix(args[0], "-overlay="); ok {
+		os.Exit(runCoverTool(overlay, args[1:]))
+	}
+	tool := strings.TrimSuffix(filepath.Base(args[0]), ".exe")
+	if tool != "compile" {
+		os.Exit(runTool(args[0], args[1:]))
+	}
+	if hasFlag(args[1:], "-V") {
+		os.Exit(printToolID(tool, args))
+	}
+
+	tmpDir, err := os.MkdirTemp("", "inco-toolexec-")
+	_ = err // @inco: err == nil, -panic(err)
+	toolArgs, diags, err := inco.RewriteCompileArgs(args[1:], tmpDir)
+	for _, d := range diags {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	code := 1
+	if err == nil {
+		code = runTool(args[0], toolArgs)
+	} else if !errors.As(err, new(*inco.DiagnosticsError)) {
+		fmt.Fprintf(os.Stderr, "inco: %v\n", err)
+	}
+	os.RemoveAll(tmpDir)
+	os.Exit(code)
+}
+
+// runCoverTool runs a tool for a build with the overlay file overlayPath
+// and returns its exit status. The cover tool instruments the shadows of
+// the files the overlay replaces; every other tool runs as given.
+func runCoverTool(overlayPath string, args []string) int {
+	// @inco: len(args) > 0, -panic("toolexec: no tool given")
+	tool := strings.TrimSuffix(filepath.Base(args[0]), ".exe")
+	_ = tool // @inco: tool == "cover", -return(runTool(args[0], args[1:]))
+	// The ID covers inco, so that cover results from builds without
+	// guards are not reused.
+	// @inco: !hasFlag(args[1:], "-V"), -return(printToolID(tool, args))
+	ov, err := inco.LoadOverlay(overlayPath, filepath.Dir(overlayPath))
+	_ = err // @inco: err == nil, -panic(err)
+	tmpDir, err := os.MkdirTemp("", "inco-cover-")
+	_ = err // @inco: err == nil, -panic(err)
+	defer os.RemoveAll(tmpDir)
+	toolArgs, finish, err := inco.RewriteCoverArgs(args[1:], ov, tmpDir)
+	_ = err // @inco: err == nil, -panic(err)
+	code := runTool(args[0], toolArgs)
+	_ = code // @inco: code == 0, -return(code)
+	err = finish()
+	_ = err // @inco: err == nil, -panic(err)
+	return 0
+}
+
+// printToolID answers the go command's -V=full query with an ID that
+// also covers the inco binary, so that its build cache keys change with
+// it, and returns the exit status.
+func printToolID(tool string, args []string) int {
+	cmd := execCommand(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	_ = err // @inco: err == nil, -return(exitCode(err))
+	line, err := inco.ToolID(tool, out)
+	_ = err // @inco: err == nil, -panic(err)
+	fmt.Println(line)
+	return 0
+}
+
+// runTool runs a tool with the standard streams and returns its exit
+// status.
+func runTool(path string, args []string) int {
+	cmd := execCommand(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return exitCode(cmd.Run())
+}
+
+// exitCode returns the exit status a failed command reported, 0 for nil.
+// Failing to start the command at all is a panic.
+func exitCode(err error) int {
+	// @inco: err != nil, -return(0)
+	var ee *exec.ExitError
+	// @inco: errors.As(err, &ee), -panic(err)
+	return ee.ExitCode()
+}
@@ -0,0 +1,647 @@
+// Package inco is the public API of the Inco engine, for build tools that
+// want to generate overlays or guarded sources without running the inco
+// binary.
+//
+// Directive:
+//
+//	// @inco: <expr>
+//	// @inco: <expr>, -panic("msg")
+//	// @inco: <expr>, -return(x, y)
+//	// @inco: <expr>, -continue
+//	// @inco: <expr>, -break
+//	// @inco: <expr>, -log(args...)
+//	// @inco: <expr>[, -action], id=<name>
+//
+// Engine generates a whole tree into .inco_cache/overlay.json, for use
+// with `go build -overlay`; GenerateSource expands a single file in
+// memory. Audit reports directive coverage and Release bakes the guards
+// into the source tree.
+//
+// The identifiers below are the supported surface: they keep their
+// meaning across releases, while everything under internal/ may change.
+package inco
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"io/fs"
+	"maps"
+	"time"
+
+	"github.com/imnive-design/inco-go/internal/inco"
+)
+
+// ---------------------------------------------------------------------------
+// Directives
+// ---------------------------------------------------------------------------
+
+// Directive is the parsed form of a single @inco: comment.
+type Directive struct {
+	Expr       string     // the Go boolean expression
+	Action     ActionKind // ActionPanic when no action is written
+	ActionArgs []string   // e.g. -return(0, err) → ["0", "err"]
+	ID         string     // explicit id= value; empty when none is written
+}
+
+// ActionKind identifies the response to a directive violation.
+type ActionKind int
+
+const (
+	ActionPanic    ActionKind = iota // -panic, the default
+	ActionReturn                     // -return
+	ActionContinue                   // -continue
+	ActionBreak                      // -break
+	ActionLog                        // -log
+)
+
+var actionKinds = map[inco.ActionKind]ActionKind{
+	inco.ActionPanic:    ActionPanic,
+	inco.ActionReturn:   ActionReturn,
+	inco.ActionContinue: ActionContinue,
+	inco.ActionBreak:    ActionBreak,
+	inco.ActionLog:      ActionLog,
+}
+
+var actionNames = map[ActionKind]string{
+	ActionPanic:    "panic",
+	ActionReturn:   "return",
+	ActionContinue: "continue",
+	ActionBreak:    "break",
+	ActionLog:      "log",
+}
+
+func (k ActionKind) String() string {
+	if s, ok := actionNames[k]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// ParseDirective parses a comment such as "// @inco: x > 0, -return(err)".
+// It returns nil if the comment is not a directive.
+func ParseDirective(comment string) *Directive {
+	d := inco.ParseDirective(comment)
+	if d == nil {
+		return nil
+	}
+	return &Directive{
+		Expr:       d.Expr,
+		Action:     actionKinds[d.Action],
+		ActionArgs: d.ActionArgs,
+		ID:         d.ID,
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Generation
+// ---------------------------------------------------------------------------
+
+// Overlay is the JSON structure consumed by `go build -overlay`.
+type Overlay struct {
+	Replace map[string]string `json:"Replace"` // source path → shadow path
+}
+
+// SourceMap is the content of .inco_cache/sourcemap.json: how the lines of
+// each shadow relate to its source.
+type SourceMap struct {
+	Shadows map[string]ShadowMap `json:"shadows"` // by absolute shadow path
+}
+
+// ShadowMap is the line mapping of one shadow. Its ranges are in shadow
+// line order; lines that no range covers were written by the generator.
+type ShadowMap struct {
+	Source string      `json:"source"` // absolute path of the source file
+	Ranges []LineRange `json:"ranges"`
+}
+
+// LineRange maps the shadow lines Start to End, inclusive. Lines copied
+// from the source map to consecutive source lines from SourceLine on; the
+// lines of an injected guard, which has a Directive, all map to the
+// directive's line.
+type LineRange struct {
+	Start      int           `json:"start"`
+	End        int           `json:"end"`
+	SourceLine int           `json:"source_line"`
+	Directive  *DirectiveRef `json:"directive,omitempty"`
+}
+
+// DirectiveRef identifies the directive an injected guard came from.
+type DirectiveRef struct {
+	ID     string `json:"id"`     // stable ID, as listed by `inco audit`
+	Line   int    `json:"line"`   // 1-based line of the directive comment in the source
+	Column int    `json:"column"` // 1-based column of the comment
+	Expr   string `json:"expr"`
+	Action string `json:"action"` // panic, return, continue, break or log
+}
+
+// GenerateOptions configures GenerateSource.
+type GenerateOptions struct {
+	// FS holds the file's package. The other files in the directory of
+	// filename that build.Default matches are read from it, so that names
+	// they declare are not mistaken for packages. Nil means src is
+	// considered on its own.
+	FS fs.FS
+
+	// Files, if not nil, lists the package's other files in FS, exactly as
+	// they are compiled, in place of the directory's files.
+	Files []string
+
+	// LinePath is the file name written into //line directives (and so
+	// reported by the compiler and in stack traces); empty means filename.
+	LinePath string
+
+	// Imports maps package names to the import paths that directives may
+	// use without importing them; "" marks a name that must not be
+	// guessed. Nil means the standard library, listed once per process
+	// with `go list std`.
+	Imports map[string]string
+
+	// PackagePath is the import path of the file's package, from which
+	// the IDs of its directives are derived; empty means the package name.
+	PackagePath string
+}
+
+// ErrCacheLocked is returned by Engine.Run when another process holds the
+// .inco_cache lock for longer than Engine.LockTimeout.
+var ErrCacheLocked = inco.ErrCacheLocked
+
+// Engine generates the overlay of a source tree into .inco_cache. Its
+// fields are read at the start of every run; an engine keeps what it
+// learned about the tree between runs, so reusing one is cheaper than
+// creating a new one each time.
+type Engine struct {
+	Root string // directory whose Go files are generated
+
+	// Trimpath writes module-relative paths into //line directives instead
+	// of absolute ones, matching `go build -trimpath`.
+	Trimpath bool
+
+	// KeepGoing commits the overlay for every file that succeeded even when
+	// others failed; the run still returns a *DiagnosticsError.
+	KeepGoing bool
+
+	// SharedCache, when set, is a per-user directory (see
+	// DefaultSharedCacheDir) holding shadows shared by every checkout and
+	// worktree; the overlay points into it.
+	SharedCache string
+
+	// LocalModules also generates the files of modules outside Root that
+	// the build uses from disk: local replace targets and go.work modules.
+	LocalModules bool
+
+	// LockTimeout bounds how long a run waits for another process to
+	// release the .inco_cache lock before failing with ErrCacheLocked.
+	LockTimeout time.Duration
+
+	// Log receives progress messages; nil means os.Stderr and io.Discard
+	// silences them.
+	Log io.Writer
+
+	// Events, if set, receives the progress of each run file by file. It is
+	// called from worker goroutines, one call at a time.
+	Events func(Event)
+
+	e *inco.Engine
+}
+
+// NewEngine creates an engine rooted at the given directory.
+func NewEngine(root string) *Engine {
+	e := inco.NewEngine(root)
+	return &Engine{Root: root, LockTimeout: e.LockTimeout, e: e}
+}
+
+// Run scans all Go source files under Root, expands their directives and
+// writes the overlay and shadow files into .inco_cache. Files that cannot
+// be generated are reported in a *DiagnosticsError.
+func (e *Engine) Run() error {
+	return e.RunContext(context.Background())
+}
+
+// RunContext is Run with cancellation. When ctx is done, the run stops,
+// leaves the previous overlay in place and returns ctx.Err().
+func (e *Engine) RunContext(ctx context.Context) error {
+	return publicError(e.engine().RunContext(ctx))
+}
+
+// RunFiles is Run for callers that already know which files changed, such
+// as a file watcher: only those files are regenerated, unless the engine
+// version or configuration changed, which falls back to a full Run.
+func (e *Engine) RunFiles(changed []string) error {
+	return publicError(e.engine().RunFiles(changed))
+}
+
+// RunPackages is Run restricted to the packages matching patterns,
+// interpreted relative to dir as by `go build`, and to their dependencies
+// inside Root. buildFlags are the build's flags that select files and
+// packages, such as -tags and -mod.
+func (e *Engine) RunPackages(dir string, buildFlags, patterns []string) error {
+	return publicError(e.engine().RunPackages(dir, buildFlags, patterns))
+}
+
+// Overlay returns the overlay written by the last successful run.
+func (e *Engine) Overlay() Overlay {
+	return Overlay{Replace: maps.Clone(e.engine().Overlay.Replace)}
+}
+
+// Diagnostics returns every problem found by the last run, ordered by
+// position, warnings included.
+func (e *Engine) Diagnostics() []Diagnostic {
+	return diagnostics(e.engine().Diagnostics)
+}
+
+// engine returns the internal engine, configured from e's fields. It is
+// replaced when Root changes, since nothing it caches carries over.
+func (e *Engine) engine() *inco.Engine {
+	if e.e == nil || e.e.Root != e.Root {
+		e.e = inco.NewEngine(e.Root)
+	}
+	e.e.Trimpath = e.Trimpath
+	e.e.KeepGoing = e.KeepGoing
+	e.e.SharedCache = e.SharedCache
+	e.e.LocalModules = e.LocalModules
+	e.e.LockTimeout = e.LockTimeout
+	e.e.Log = e.Log
+	e.e.Events = nil
+	if events := e.Events; events != nil {
+		e.e.Events = func(ev inco.Event) {
+			events(Event{
+				Kind:        eventKinds[ev.Kind],
+				Path:        ev.Path,
+				Reason:      ev.Reason,
+				Total:       ev.Total,
+				Diagnostics: diagnostics(ev.Diagnostics),
+				Directives:  ev.Directives,
+			})
+		}
+	}
+	return e.e
+}
+
+// Watcher keeps an engine's overlay up to date while sources change.
+type Watcher struct {
+	Engine   *Engine
+	Interval time.Duration // how often the tree is polled
+	Debounce time.Duration // quiet period before a batch of changes is regenerated
+
+	// OnRun, if set, is called after every regeneration with the files
+	// that triggered it (nil for a full run) and the run's error.
+	OnRun func(changed []string, err error)
+}
+
+// NewWatcher creates a Watcher for e with default timings.
+func NewWatcher(e *Engine) *Watcher {
+	w := inco.NewWatcher(nil)
+	return &Watcher{Engine: e, Interval: w.Interval, Debounce: w.Debounce}
+}
+
+// Watch runs a full generation, then regenerates changed files until stop
+// is closed. The engine's fields are read once, when Watch starts.
+// Generation errors are reported through OnRun and do not end the watch.
+func (w *Watcher) Watch(stop <-chan struct{}) error {
+	if w.Engine == nil {
+		return errors.New("Watch: nil engine")
+	}
+	iw := inco.NewWatcher(w.Engine.engine())
+	iw.Interval = w.Interval
+	iw.Debounce = w.Debounce
+	if onRun := w.OnRun; onRun != nil {
+		iw.OnRun = func(changed []string, err error) { onRun(changed, publicError(err)) }
+	}
+	return iw.Watch(stop)
+}
+
+// GenerateSource returns the shadow of one Go source file: src with its
+// directives expanded and missing imports added. It writes nothing and
+// reads nothing but opts.FS, except that a nil opts.Imports lists the
+// standard library with `go list std` once per process; see
+// GenerateOptions.
+func GenerateSource(filename string, src []byte, opts GenerateOptions) ([]byte, []Diagnostic, error) {
+	shadow, diags, err := inco.GenerateSource(filename, src, inco.GenerateOptions(opts))
+	return shadow, diagnostics(diags), publicError(err)
+}
+
+// DefaultSharedCacheDir returns the default Engine.SharedCache location,
+// "inco" under os.UserCacheDir().
+func DefaultSharedCacheDir() (string, error) {
+	return inco.DefaultSharedCacheDir()
+}
+
+// EngineVersion identifies the generator; shadows written by another
+// version are regenerated.
+func EngineVersion() string {
+	return inco.EngineVersion()
+}
+
+// ---------------------------------------------------------------------------
+// Diagnostics and events
+// ---------------------------------------------------------------------------
+
+// Severity classifies a Diagnostic.
+type Severity int
+
+const (
+	SeverityError   Severity = iota // the file was left out of the overlay
+	SeverityWarning                 // the file was generated, but may not be what was meant
+)
+
+var severities = map[inco.Severity]Severity{
+	inco.SeverityError:   SeverityError,
+	inco.SeverityWarning: SeverityWarning,
+}
+
+var severityNames = map[Severity]string{
+	SeverityError:   "error",
+	SeverityWarning: "warning",
+}
+
+func (s Severity) String() string {
+	if n, ok := severityNames[s]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// MarshalText encodes s by name, so that diagnostics read well as JSON.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a name written by MarshalText.
+func (s *Severity) UnmarshalText(text []byte) error {
+	for k, n := range severityNames {
+		if n == string(text) {
+			*s = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown severity %q", text)
+}
+
+// Diagnostic is one problem found while generating.
+type Diagnostic struct {
+	Pos       token.Position // Line and Column are 0 when the problem concerns the whole file
+	Severity  Severity
+	Code      string // one of the Diag* constants
+	Message   string
+	Directive string `json:",omitempty"` // ID of the directive the problem concerns, if one does
+}
+
+// String formats d as "file:line:col: severity: message [code]", with the
+// message labeled "in @inco: directive [id]: " when d concerns one.
+func (d Diagnostic) String() string {
+	msg := d.Message
+	if d.Directive != "" {
+		msg = "in @inco: directive [" + d.Directive + "]: " + msg
+	}
+	return fmt.Sprintf("%s: %s: %s [%s]", d.Pos, d.Severity, msg, d.Code)
+}
+
+// DiagnosticsError is returned by a run that hit at least one error
+// diagnostic. Without Engine.KeepGoing no overlay was written; with it,
+// the overlay covers every file that succeeded.
+type DiagnosticsError struct {
+	Diagnostics []Diagnostic // every diagnostic of the run, warnings included
+}
+
+func (e *DiagnosticsError) Error() string {
+	var errs []string
+	for _, d := range e.Diagnostics {
+		if d.Severity == SeverityError {
+			errs = append(errs, d.String())
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return "inco: no errors"
+	case 1:
+		return errs[0]
+	}
+	return fmt.Sprintf("%s (and %d more errors)", errs[0], len(errs)-1)
+}
+
+// Diagnostic codes.
+const (
+	DiagRead        = inco.DiagRead
+	DiagParse       = inco.DiagParse
+	DiagWrite       = inco.DiagWrite
+	DiagInternal    = inco.DiagInternal
+	DiagAmbiguous   = inco.DiagAmbiguous
+	DiagNoImport    = inco.DiagNoImport
+	DiagOverlay     = inco.DiagOverlay
+	DiagDuplicateID = inco.DiagDuplicateID
+)
+
+// EventKind identifies what an Event reports.
+type EventKind int
+
+const (
+	EventStart       EventKind = iota // a run is about to look at Total files
+	EventCached                       // the file's previous shadow (or lack of one) was reused
+	EventRegenerated                  // a new shadow was written
+	EventSkipped                      // the file was read but stays out of the overlay
+	EventError                        // the file failed; see Diagnostics
+)
+
+var eventKinds = map[inco.EventKind]EventKind{
+	inco.EventStart:       EventStart,
+	inco.EventCached:      EventCached,
+	inco.EventRegenerated: EventRegenerated,
+	inco.EventSkipped:     EventSkipped,
+	inco.EventError:       EventError,
+}
+
+var eventNames = map[EventKind]string{
+	EventStart:       "start",
+	EventCached:      "cached",
+	EventRegenerated: "regenerated",
+	EventSkipped:     "skipped",
+	EventError:       "error",
+}
+
+func (k EventKind) String() string {
+	if n, ok := eventNames[k]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// MarshalText encodes k by name.
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes a name written by MarshalText.
+func (k *EventKind) UnmarshalText(text []byte) error {
+	for v, n := range eventNames {
+		if n == string(text) {
+			*k = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event kind %q", text)
+}
+
+// Reasons given in Event.Reason.
+const (
+	ReasonUnchanged      = inco.ReasonUnchanged
+	ReasonNew            = inco.ReasonNew
+	ReasonChanged        = inco.ReasonChanged
+	ReasonShadowMissing  = inco.ReasonShadowMissing
+	ReasonPackageChanged = inco.ReasonPackageChanged
+	ReasonVersion        = inco.ReasonVersion
+	ReasonConfig         = inco.ReasonConfig
+	ReasonSharedCache    = inco.ReasonSharedCache
+	ReasonNoDirectives   = inco.ReasonNoDirectives
+	ReasonDoesNotParse   = inco.ReasonDoesNotParse
+)
+
+// Event reports the progress of a run to Engine.Events.
+type Event struct {
+	Kind        EventKind
+	Path        string       // source file; empty for EventStart
+	Reason      string       // one of the Reason* constants; empty for EventStart and EventError
+	Total       int          // EventStart only: number of files the run looks at
+	Diagnostics []Diagnostic `json:",omitempty"` // problems found in the file
+	Directives  []string     `json:",omitempty"` // EventRegenerated only: IDs of the directives guarded in the new shadow, in source order
+}
+
+// diagnostics converts the internal engine's diagnostics.
+func diagnostics(ds []inco.Diagnostic) []Diagnostic {
+	if ds == nil {
+		return nil
+	}
+	out := make([]Diagnostic, len(ds))
+	for i, d := range ds {
+		out[i] = Diagnostic{
+			Pos:       d.Pos,
+			Severity:  severities[d.Severity],
+			Code:      d.Code,
+			Message:   d.Message,
+			Directive: d.Directive,
+		}
+	}
+	return out
+}
+
+// publicError replaces an internal *DiagnosticsError in err by the
+// public one; other errors are returned as they are.
+func publicError(err error) error {
+	var de *inco.DiagnosticsError
+	if errors.As(err, &de) {
+		return &DiagnosticsError{Diagnostics: diagnostics(de.Diagnostics)}
+	}
+	return err
+}
+
+// ---------------------------------------------------------------------------
+// Audit and release
+// ---------------------------------------------------------------------------
+
+// AuditResult is the directive coverage report of a tree.
+type AuditResult struct {
+	Files           []FileAudit
+	IgnoredPaths    []string // files and directories skipped by .incoignore
+	TotalFiles      int
+	TotalFuncs      int
+	GuardedFuncs    int // functions with at least one @inco: directive
+	TotalIfs        int
+	TotalRequires   int
+	TotalDirectives int
+}
+
+// FileAudit is the part of an AuditResult for one file.
+type FileAudit struct {
+	Path         string           // absolute path
+	RelPath      string           // relative to the audited root
+	Funcs        []FuncAudit      // declared functions
+	Directives   []DirectiveAudit // in source order
+	IfCount      int              // native if statements
+	RequireCount int              // @inco: directives
+}
+
+// FuncAudit is the part of a FileAudit for one function.
+type FuncAudit struct {
+	Name         string // function name, or "func literal" for closures
+	Line         int    // 1-based line of the declaration
+	RequireCount int    // @inco: directives in the function
+}
+
+// DirectiveAudit is the part of a FileAudit for one directive.
+type DirectiveAudit struct {
+	ID   string // stable ID, as in DirectiveRef.ID
+	Line int    // 1-based line of the comment
+	Func string // enclosing function, as in FuncAudit.Name; empty outside any
+	Expr string
+}
+
+// PrintReport writes a human-readable form of r to w, as `inco audit`
+// prints it.
+func (r *AuditResult) PrintReport(w io.Writer) {
+	ir := &inco.AuditResult{
+		IgnoredPaths:    r.IgnoredPaths,
+		TotalFiles:      r.TotalFiles,
+		TotalFuncs:      r.TotalFuncs,
+		GuardedFuncs:    r.GuardedFuncs,
+		TotalIfs:        r.TotalIfs,
+		TotalRequires:   r.TotalRequires,
+		TotalDirectives: r.TotalDirectives,
+	}
+	for _, f := range r.Files {
+		fa := inco.FileAudit{Path: f.Path, RelPath: f.RelPath, IfCount: f.IfCount, RequireCount: f.RequireCount}
+		for _, fn := range f.Funcs {
+			fa.Funcs = append(fa.Funcs, inco.FuncAudit(fn))
+		}
+		for _, d := range f.Directives {
+			fa.Directives = append(fa.Directives, inco.DirectiveAudit(d))
+		}
+		ir.Files = append(ir.Files, fa)
+	}
+	ir.PrintReport(w)
+}
+
+// Audit scans all Go source files under root and summarises @inco:
+// coverage and directive-vs-if ratios.
+func Audit(root string) (*AuditResult, error) {
+	ir, err := inco.Audit(root)
+	if err != nil {
+		return nil, err
+	}
+	r := &AuditResult{
+		IgnoredPaths:    ir.IgnoredPaths,
+		TotalFiles:      ir.TotalFiles,
+		TotalFuncs:      ir.TotalFuncs,
+		GuardedFuncs:    ir.GuardedFuncs,
+		TotalIfs:        ir.TotalIfs,
+		TotalRequires:   ir.TotalRequires,
+		TotalDirectives: ir.TotalDirectives,
+	}
+	for _, f := range ir.Files {
+		fa := FileAudit{Path: f.Path, RelPath: f.RelPath, IfCount: f.IfCount, RequireCount: f.RequireCount}
+		for _, fn := range f.Funcs {
+			fa.Funcs = append(fa.Funcs, FuncAudit(fn))
+		}
+		for _, d := range f.Directives {
+			fa.Directives = append(fa.Directives, DirectiveAudit(d))
+		}
+		r.Files = append(r.Files, fa)
+	}
+	return r, nil
+}
+
+// Release writes the guarded shadow of every .inco.go file in root's
+// overlay next to it as a plain .go file and renames the original to
+// .inco. Run an Engine with Trimpath first. With dryRun, nothing is
+// changed and only the files are listed. Progress goes to log, as for
+// Engine.Log: nil means os.Stderr and io.Discard silences it.
+func Release(root string, dryRun bool, log io.Writer) error {
+	return inco.Release(root, dryRun, log)
+}
+
+// ReleaseClean undoes Release: it removes the released files and restores
+// the originals. Progress goes to log, as for Release.
+func ReleaseClean(root string, log io.Writer) error {
+	return inco.ReleaseClean(root, log)
+}
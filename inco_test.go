@@ -0,0 +1,181 @@
+package inco_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	inco "github.com/imnive-design/inco-go"
+)
+
+func TestGenerateSource(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/app.go": {Data: []byte("package app\n\ntype User struct{ Name string }\n")},
+	}
+	src := []byte("package app\n\nfunc Greet(u *User) string {\n\t// @inco: u != nil && u.Name != \"\"\n\treturn \"hi \" + u.Name\n}\n")
+	shadow, diags, err := inco.GenerateSource("app/greet.inco.go", src, inco.GenerateOptions{FS: fsys})
+	if err != nil || len(diags) != 0 {
+		t.Fatalf("GenerateSource: %v, %v", err, diags)
+	}
+	if !strings.Contains(string(shadow), `if !(u != nil && u.Name != "")`) {
+		t.Errorf("guard not injected:\n%s", shadow)
+	}
+}
+
+// Errors come back as the public *DiagnosticsError.
+func TestGenerateSource_SyntaxError(t *testing.T) {
+	_, diags, err := inco.GenerateSource("p/p.go", []byte("package p\n\nfunc F( {\n\t// @inco: true\n}\n"), inco.GenerateOptions{})
+	var de *inco.DiagnosticsError
+	if !errors.As(err, &de) {
+		t.Fatalf("expected a *inco.DiagnosticsError, got %v", err)
+	}
+	if len(diags) != 1 || diags[0].Severity != inco.SeverityError || diags[0].Code != inco.DiagParse || diags[0].Pos.Line != 3 {
+		t.Errorf("unexpected diagnostics %v", diags)
+	}
+	if len(de.Diagnostics) != 1 || de.Error() != diags[0].String() {
+		t.Errorf("Error() = %q, diagnostics %v", de.Error(), de.Diagnostics)
+	}
+}
+
+func TestParseDirective(t *testing.T) {
+	d := inco.ParseDirective("// @inco: err == nil, -return(err)")
+	if d == nil || d.Expr != "err == nil" || d.Action != inco.ActionReturn {
+		t.Errorf("ParseDirective = %+v", d)
+	}
+}
+
+// The directive forms listed in the package documentation.
+func TestParseDirective_DocumentedForms(t *testing.T) {
+	tests := []struct {
+		comment string
+		action  inco.ActionKind
+	}{
+		{"// @inco: x > 0", inco.ActionPanic},
+		{`// @inco: x > 0, -panic("msg")`, inco.ActionPanic},
+		{"// @inco: x > 0, -return(x, nil)", inco.ActionReturn},
+		{"// @inco: x > 0, -continue", inco.ActionContinue},
+		{"// @inco: x > 0, -break", inco.ActionBreak},
+		{`// @inco: x > 0, -log("bad x", x)`, inco.ActionLog},
+		{"// @inco: x > 0, -continue, id=positive-x", inco.ActionContinue},
+	}
+	for _, tt := range tests {
+		d := inco.ParseDirective(tt.comment)
+		if d == nil || d.Expr != "x > 0" || d.Action != tt.action {
+			t.Errorf("ParseDirective(%q) = %+v", tt.comment, d)
+		}
+	}
+}
+
+func TestEngine_Run(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"go.mod":    "module example.com/m\n\ngo 1.21\n",
+		"m.inco.go": "package m\n\nfunc F(x int) int {\n\t// @inco: x > 0\n\treturn x\n}\n",
+		"plain.go":  "package m\n\nfunc G() {}\n",
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := inco.NewEngine(root)
+	e.Log = io.Discard
+	if err := e.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	ov := e.Overlay()
+	if len(ov.Replace) != 1 || ov.Replace[filepath.Join(root, "m.inco.go")] == "" {
+		t.Errorf("Overlay = %v, want m.inco.go only", ov.Replace)
+	}
+	// The returned overlay is a copy.
+	clear(ov.Replace)
+	if len(e.Overlay().Replace) != 1 {
+		t.Error("clearing the returned overlay changed the engine's")
+	}
+}
+
+func TestEngine_RunFilesAndDiagnostics(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, src string) {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("go.mod", "module example.com/m\n\ngo 1.21\n")
+	write("m.inco.go", "package m\n\nfunc F(x int) int {\n\t// @inco: x > 0\n\treturn x\n}\n")
+	e := inco.NewEngine(root)
+	e.Log = io.Discard
+	e.SharedCache = t.TempDir()
+	if err := e.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	shadow := e.Overlay().Replace[filepath.Join(root, "m.inco.go")]
+	if !strings.HasPrefix(shadow, e.SharedCache) {
+		t.Errorf("shadow %s is not in the shared cache %s", shadow, e.SharedCache)
+	}
+
+	write("broken.inco.go", "package m\n\nfunc G( {\n\t// @inco: true\n}\n")
+	if err := e.RunFiles([]string{filepath.Join(root, "broken.inco.go")}); err != nil {
+		t.Fatalf("RunFiles: %v", err)
+	}
+	diags := e.Diagnostics()
+	if len(diags) != 1 || diags[0].Severity != inco.SeverityWarning || diags[0].Code != inco.DiagParse {
+		t.Errorf("Diagnostics = %v, want one parse warning", diags)
+	}
+}
+
+func TestEngine_Events(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "m.inco.go"), []byte("package m\n\nfunc F(x int) int {\n\t// @inco: x > 0, id=positive\n\treturn x\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var events []inco.Event
+	e := inco.NewEngine(root)
+	e.Log = io.Discard
+	e.Events = func(ev inco.Event) { events = append(events, ev) }
+	if err := e.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(events) != 2 || events[0].Kind != inco.EventStart || events[0].Total != 1 {
+		t.Fatalf("events = %+v", events)
+	}
+	ev := events[1]
+	if ev.Kind != inco.EventRegenerated || ev.Reason != inco.ReasonNew || len(ev.Directives) != 1 || ev.Directives[0] != "positive" {
+		t.Errorf("event = %+v", ev)
+	}
+}
+
+func TestRelease_Log(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "m.inco.go")
+	if err := os.WriteFile(src, []byte("package m\n\nfunc F(x int) int {\n\t// @inco: x > 0\n\treturn x\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := inco.NewEngine(root)
+	e.Log = io.Discard
+	e.Trimpath = true
+	if err := e.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var log bytes.Buffer
+	if err := inco.Release(root, true, &log); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if !strings.Contains(log.String(), "[dry-run] m.go") {
+		t.Errorf("dry run listed %q", log.String())
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("dry run changed the tree: %v", err)
+	}
+}
+
+func TestActionKind_String(t *testing.T) {
+	if s := inco.ActionLog.String(); s != "log" {
+		t.Errorf("ActionLog.String() = %q, want log", s)
+	}
+}
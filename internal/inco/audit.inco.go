@@ -23,13 +23,22 @@ type FuncAudit struct {
 	RequireCount int    // number of require directives in this function
 }
 
+// DirectiveAudit identifies one @inco: directive.
+type DirectiveAudit struct {
+	ID   string // stable ID (see directiveIDs)
+	Line int    // 1-based line number of the comment
+	Func string // enclosing function, as in FuncAudit.Name; empty outside any
+	Expr string
+}
+
 // FileAudit holds per-file audit data.
 type FileAudit struct {
-	Path         string      // absolute path
-	RelPath      string      // relative to root
-	Funcs        []FuncAudit // declared functions
-	IfCount      int         // native if statements
-	RequireCount int         // @inco: directives
+	Path         string           // absolute path
+	RelPath      string           // relative to root
+	Funcs        []FuncAudit      // declared functions
+	Directives   []DirectiveAudit // in source order
+	IfCount      int              // native if statements
+	RequireCount int              // @inco: directives
 }
 
 // AuditResult is the aggregate report.
@@ -58,12 +67,14 @@ func Audit(root string) (*AuditResult, error) {
 	fset := token.NewFileSet()
 	var files []FileAudit
 	var ignored []string
+	pkgs := make(map[string]string) // directory → import path
 
-	walkGoFiles(absRoot, func(path string) error {
-		fa := auditFile(fset, absRoot, path)
+	err = walkGoFiles(absRoot, func(path string) error {
+		fa := auditFile(fset, absRoot, path, pkgs)
 		files = append(files, fa)
 		return nil
 	})
+	_ = err // @inco: err == nil, -return(nil, fmt.Errorf("Audit: %w", err))
 
 	// Collect ignored paths by walking all .go files and checking .incoignore.
 	collectIgnored(absRoot, &ignored)
@@ -117,9 +128,19 @@ func collectIgnored(root string, out *[]string) {
 	sort.Strings(*out)
 }
 
-func auditFile(fset *token.FileSet, root, path string) FileAudit {
+// auditFile analyses the file at path. pkgs caches the import paths of
+// the directories seen so far, for directive IDs.
+func auditFile(fset *token.FileSet, root, path string, pkgs map[string]string) FileAudit {
 	f, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
 	_ = err // @inco: err == nil, -panic(err)
+	dir := filepath.Dir(path)
+	pkg, seen := pkgs[dir]
+	if !seen {
+		modDir, modPath := findModule(dir)
+		pkg = importPath(modDir, modPath, dir, f.Name.Name)
+		pkgs[dir] = pkg
+	}
+	ids := directiveIDs(f, fset, pkg)
 
 	relPath := path
 	if rel, e := filepath.Rel(root, path); e == nil {
@@ -140,6 +161,8 @@ func auditFile(fset *token.FileSet, root, path string) FileAudit {
 			_ = d // @inco: d != nil, -continue
 			fa.RequireCount++
 			directives = append(directives, directiveInfo{pos: c.Pos()})
+			line := fset.PositionFor(c.Pos(), false).Line
+			fa.Directives = append(fa.Directives, DirectiveAudit{ID: ids[line], Line: line, Expr: d.Expr})
 		}
 	}
 
@@ -188,7 +211,7 @@ func auditFile(fset *token.FileSet, root, path string) FileAudit {
 
 	// Map each @inco: to its enclosing function.
 	requireCounts := make(map[int]int) // funcRanges index → count
-	for _, d := range directives {
+	for i, d := range directives {
 		// Find innermost enclosing function.
 		bestIdx := -1
 		for i, fr := range funcRanges {
@@ -200,6 +223,7 @@ func auditFile(fset *token.FileSet, root, path string) FileAudit {
 		}
 		if bestIdx >= 0 {
 			requireCounts[bestIdx]++
+			fa.Directives[i].Func = funcRanges[bestIdx].name
 		}
 	}
 
@@ -313,6 +337,20 @@ func (r *AuditResult) PrintReport(w io.Writer) {
 		}
 	}
 
+	// --- Directives ---
+	if r.TotalDirectives > 0 {
+		fmt.Fprintf(w, "\nDirectives (%d):\n", r.TotalDirectives)
+		for _, f := range r.Files {
+			for _, d := range f.Directives {
+				where := fmt.Sprintf("%s:%d", f.RelPath, d.Line)
+				if d.Func != "" {
+					where += "  " + d.Func
+				}
+				fmt.Fprintf(w, "  %-16s  %s  %s\n", d.ID, where, d.Expr)
+			}
+		}
+	}
+
 	// --- Ignored paths ---
 	if len(r.IgnoredPaths) > 0 {
 		fmt.Fprintf(w, "\nIgnored by .incoignore (%d):\n", len(r.IgnoredPaths))
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -333,3 +334,43 @@ func Check(x int) {
 		t.Errorf("TotalDirectives = %d, want 1", result.TotalDirectives)
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Directive listing
+// ---------------------------------------------------------------------------
+
+func TestAudit_Directives(t *testing.T) {
+	dir := t.TempDir()
+	src := `package main
+
+func Check(x int) {
+	// @inco: x > 0, -return
+	func() {
+		_ = x // @inco: x < 10, id=small-x
+	}()
+}
+`
+	writeFile(t, filepath.Join(dir, "go.mod"), "module example.com/a\n\ngo 1.21\n")
+	writeFile(t, filepath.Join(dir, "main.go"), src)
+
+	result, err := Audit(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := sourceDirectiveIDs(filepath.Join(dir, "main.go"), []byte(src))
+	want := []DirectiveAudit{
+		{ID: ids[4], Line: 4, Func: "Check", Expr: "x > 0"},
+		{ID: "small-x", Line: 6, Func: "func literal", Expr: "x < 10"},
+	}
+	if got := result.Files[0].Directives; !reflect.DeepEqual(got, want) {
+		t.Errorf("Directives = %+v, want %+v", got, want)
+	}
+
+	var buf bytes.Buffer
+	result.PrintReport(&buf)
+	for _, line := range []string{ids[4] + "  main.go:4  Check  x > 0", "small-x           main.go:6  func literal  x < 10"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("report missing %q\n\nFull output:\n%s", line, buf.String())
+		}
+	}
+}
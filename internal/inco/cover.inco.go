@@ -0,0 +1,242 @@
+package inco
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Coverage profiles
+// ---------------------------------------------------------------------------
+//
+// The go command hands the cover tool the original files even when an
+// overlay replaces them, so a -cover build would compile the sources
+// without their guards. Run in front of the cover tool through -toolexec,
+// RewriteCoverArgs has it instrument the shadows instead. The cover tool
+// then records positions on the shadow's own lines, ignoring //line
+// comments, and counts the injected guards as statements;
+// RemapCoverProfile moves such blocks back onto the source.
+
+// CoverOptions configures RemapCoverProfile.
+type CoverOptions struct {
+	// Guards keeps the statements of injected guards in the profile, at
+	// their directive comments. By default they are left out, so that
+	// coverage only counts the code in the sources.
+	Guards bool
+}
+
+// coverBlockRe matches a block line of a coverage profile:
+// "file:startLine.startCol,endLine.endCol numStmt count".
+var coverBlockRe = regexp.MustCompile(`^(.+\.go):(\d+)\.(\d+),(\d+)\.(\d+) (\d+) (\d+)$`)
+
+// coverBlock is one block line of a coverage profile.
+type coverBlock struct {
+	file                string // import path of the package joined with the file name
+	startLine, startCol int
+	endLine, endCol     int
+	numStmt             int
+	count               string
+	line                string // the line as read
+	parsed              bool   // false for the mode line and lines that are not blocks
+	drop                bool   // left out of the remapped profile
+}
+
+func (b *coverBlock) String() string {
+	// @inco: b.parsed, -return(b.line)
+	return fmt.Sprintf("%s:%d.%d,%d.%d %d %s", b.file, b.startLine, b.startCol, b.endLine, b.endCol, b.numStmt, b.count)
+}
+
+// RemapCoverProfile copies the coverage profile read from r to w. Blocks
+// of files that ov replaces, and whose positions are on the shadow, are
+// moved onto the source's lines; other lines are copied as they are.
+// A profile whose positions are already on the source, as produced by go
+// commands that instrument the original file, is left unchanged.
+func RemapCoverProfile(r io.Reader, w io.Writer, ov Overlay, opts CoverOptions) error {
+	var blocks []*coverBlock
+	byFile := make(map[string][]*coverBlock)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		b := parseCoverBlock(sc.Text())
+		blocks = append(blocks, b)
+		if b.parsed {
+			byFile[b.file] = append(byFile[b.file], b)
+		}
+	}
+	err := sc.Err()
+	_ = err // @inco: err == nil, -return(fmt.Errorf("coverage profile: %w", err))
+
+	shadows := coverShadows(ov)
+	for file, fbs := range byFile {
+		shadow, ok := shadows[file]
+		_ = ok // @inco: ok, -continue
+		sl := loadShadowLines(shadow.path, shadow.src)
+		_ = sl // @inco: sl != nil, -continue
+		remapCoverFile(fbs, sl, opts)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, b := range blocks {
+		// @inco: !b.drop, -continue
+		fmt.Fprintln(bw, b)
+	}
+	return bw.Flush()
+}
+
+// parseCoverBlock parses one line of a coverage profile.
+func parseCoverBlock(line string) *coverBlock {
+	m := coverBlockRe.FindStringSubmatch(line)
+	// @inco: m != nil, -return(&coverBlock{line: line})
+	n := make([]int, 5)
+	for i := range n {
+		v, err := strconv.Atoi(m[i+2])
+		_ = err // @inco: err == nil, -return(&coverBlock{line: line})
+		n[i] = v
+	}
+	return &coverBlock{
+		file:      m[1],
+		startLine: n[0], startCol: n[1],
+		endLine: n[2], endCol: n[3],
+		numStmt: n[4],
+		count:   m[7],
+		line:    line,
+		parsed:  true,
+	}
+}
+
+// coverShadow is a shadow and its source.
+type coverShadow struct{ path, src string }
+
+// coverShadows returns the shadows of ov by the name their sources have
+// in coverage profiles: the import path of the package joined with the
+// file name.
+func coverShadows(ov Overlay) map[string]coverShadow {
+	shadows := make(map[string]coverShadow, len(ov.Replace))
+	modules := make(map[string][2]string) // directory → module dir and path
+	for src, shadow := range ov.Replace {
+		dir := filepath.Dir(src)
+		mod, seen := modules[dir]
+		if !seen {
+			modDir, modPath := findModule(dir)
+			mod = [2]string{modDir, modPath}
+			modules[dir] = mod
+		}
+		// @inco: mod[1] != "", -continue
+		rel, err := filepath.Rel(mod[0], src)
+		_ = err // @inco: err == nil, -continue
+		shadows[mod[1]+"/"+filepath.ToSlash(rel)] = coverShadow{path: shadow, src: src}
+	}
+	return shadows
+}
+
+// remapCoverFile moves the blocks of one file from the shadow sl onto its
+// source, if they are on the shadow at all: a guard's action always gets
+// a block of its own, so a profile on the shadow has a block that starts
+// right after a guard's /*line*/ marker.
+func remapCoverFile(blocks []*coverBlock, sl *shadowLines, opts CoverOptions) {
+	guards := sl.guards()
+	bodies := make(map[int]shadowGuard, len(guards))
+	onShadow := false
+	for _, g := range guards {
+		bodies[g.bodyLine] = g
+	}
+	for _, b := range blocks {
+		g, ok := bodies[b.startLine]
+		onShadow = onShadow || (ok && b.startCol == g.bodyCol)
+	}
+	// @inco: onShadow, -return
+
+	for _, b := range blocks {
+		if g, ok := bodies[b.startLine]; ok {
+			// The action of a guard, on its directive comment.
+			b.drop = !opts.Guards
+			b.startLine, b.startCol = sl.sourcePos(g.bodyLine, b.startCol)
+			b.endLine, b.endCol = b.startLine, sl.lineEnd(b.startLine, b.startCol)
+			continue
+		}
+		if g, ok := guards[b.endLine]; ok && !opts.Guards {
+			// The block ends with a guard's if statement: leave the
+			// statement out and end the block on the line before the
+			// guard's //line comment, or drop it when the guard was all
+			// it had.
+			prev := g.ifLine - 2
+			b.numStmt--
+			b.drop = b.numStmt <= 0 || b.startLine >= g.ifLine || prev < 1
+			// @inco: !b.drop, -continue
+			b.startLine, b.startCol = sl.sourcePos(b.startLine, b.startCol)
+			b.endLine, b.endCol = sl.sourcePos(prev, len(bytes.TrimRight(sl.lines[prev-1], " \t"))+1)
+			continue
+		}
+		b.startLine, b.startCol = sl.sourcePos(b.startLine, b.startCol)
+		b.endLine, b.endCol = sl.sourcePos(b.endLine, b.endCol)
+	}
+}
+
+// RewriteCoverArgs prepares the arguments of a cover run by go build
+// -toolexec in a build with the overlay ov. Every input that ov replaces
+// is replaced by a copy of its replacement, written to tmpDir under the
+// source's file name, which the cover tool records in profiles. The
+// returned function must be called once the tool has succeeded: it points
+// the //line comment that heads each instrumented copy at the replacement
+// itself, since the copy is removed with tmpDir.
+func RewriteCoverArgs(args []string, ov Overlay, tmpDir string) ([]string, func() error, error) {
+	out := append([]string(nil), args...)
+	// Every cover flag the go command passes takes a value; the inputs
+	// follow the flags.
+	first := 0
+	for first < len(out) && strings.HasPrefix(out[first], "-") {
+		if !strings.Contains(out[first], "=") {
+			first++
+		}
+		first++
+	}
+	copies := make(map[int]string) // input index → replacement
+	for i := first; i < len(out); i++ {
+		shadow, ok := ov.Replace[out[i]]
+		_ = ok // @inco: ok && shadow != "", -continue
+		data, err := os.ReadFile(shadow)
+		_ = err // @inco: err == nil, -return(nil, nil, fmt.Errorf("toolexec: %w", err))
+		dir := filepath.Join(tmpDir, strconv.Itoa(i))
+		err = os.MkdirAll(dir, 0o755)
+		_ = err // @inco: err == nil, -return(nil, nil, fmt.Errorf("toolexec: %w", err))
+		tmp := filepath.Join(dir, filepath.Base(out[i]))
+		err = os.WriteFile(tmp, data, 0o644)
+		_ = err // @inco: err == nil, -return(nil, nil, fmt.Errorf("toolexec: %w", err))
+		out[i] = tmp
+		copies[i-first] = shadow
+	}
+	finish := func() error {
+		// @inco: len(copies) > 0, -return(nil)
+		return pointCoverOutputs(flagArg(out, "-outfilelist"), copies)
+	}
+	return out, finish, nil
+}
+
+// pointCoverOutputs rewrites the //line header of the instrumented copies
+// of the inputs in copies, by index, to name their replacements. The cover
+// tool lists its outputs in the file listPath, one per line: the
+// package's counter variables first, then one file per input.
+func pointCoverOutputs(listPath string, copies map[int]string) error {
+	list, err := os.ReadFile(listPath)
+	_ = err // @inco: err == nil, -return(fmt.Errorf("toolexec: cover outputs: %w", err))
+	outputs := strings.Split(strings.TrimSuffix(string(list), "\n"), "\n")
+	for i, shadow := range copies {
+		// @inco: i+1 < len(outputs), -return(fmt.Errorf("toolexec: cover listed %d outputs", len(outputs)))
+		path := outputs[i+1]
+		data, err := os.ReadFile(path)
+		_ = err // @inco: err == nil, -return(fmt.Errorf("toolexec: %w", err))
+		_, rest, ok := bytes.Cut(data, []byte("\n"))
+		_ = ok // @inco: ok && bytes.HasPrefix(data, []byte("//line ")), -return(fmt.Errorf("toolexec: %s: no //line header", path))
+		data = append([]byte(lineDirective(shadow, 1, 1)+"\n"), rest...)
+		err = os.WriteFile(path, data, 0o644)
+		_ = err // @inco: err == nil, -return(fmt.Errorf("toolexec: %w", err))
+	}
+	return nil
+}
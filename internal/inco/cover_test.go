@@ -0,0 +1,273 @@
+package inco
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// RemapCoverProfile — coverage profiles
+// ---------------------------------------------------------------------------
+
+const coverSrc = `package c
+
+func Div(a, b int) (int, error) {
+	x := a
+	// @inco: b != 0, -return(0, fmt.Errorf("zero"))
+	if a < 0 {
+		x = -a
+	}
+	return x / b, nil
+}
+
+func Other() int {
+	return 1
+}
+`
+
+// coverProfile generates coverSrc and returns its overlay with the
+// profile that go test -coverprofile writes when it instruments the
+// shadow: positions on the shadow's lines, which have an import added and
+// the guard injected.
+func coverProfile(t *testing.T) (Overlay, string) {
+	t.Helper()
+	dir := setupDir(t, map[string]string{
+		"go.mod": "module example.com/c\n\ngo 1.21\n",
+		"lib.go": coverSrc,
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	shadow := readShadow(t, e)
+	at := func(text string) int { return lineOf(t, shadow, text) }
+	body := strings.Split(shadow, "\n")[at("return 0, fmt")-1]
+	bodyCol := strings.Index(body, "*/") + 3
+	profile := fmt.Sprintf(`mode: set
+example.com/c/lib.go:%d.2,%d.15 2 1
+example.com/c/lib.go:%d.%d,%d.%d 1 0
+example.com/c/lib.go:%d.2,%d.11 1 1
+example.com/c/lib.go:%d.3,%d.3 1 0
+example.com/c/lib.go:%d.2,%d.19 1 1
+example.com/c/lib.go:%d.2,%d.10 1 0
+example.com/other/x.go:3.2,4.10 1 1
+`,
+		at("x := a"), at("if !(b != 0)"),
+		at("return 0, fmt"), bodyCol, at("return 0, fmt"), len(body)+1,
+		at("if a < 0"), at("if a < 0"),
+		at("x = -a"), at("x = -a")+1,
+		at("return x / b"), at("return x / b"),
+		at("return 1"), at("return 1"))
+	return e.Overlay, profile
+}
+
+func remap(t *testing.T, ov Overlay, profile string, opts CoverOptions) string {
+	t.Helper()
+	var out strings.Builder
+	if err := RemapCoverProfile(strings.NewReader(profile), &out, ov, opts); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestRemapCoverProfile_WithoutGuards(t *testing.T) {
+	ov, profile := coverProfile(t)
+	want := `mode: set
+example.com/c/lib.go:4.2,4.8 1 1
+example.com/c/lib.go:6.2,6.11 1 1
+example.com/c/lib.go:7.3,8.3 1 0
+example.com/c/lib.go:9.2,9.19 1 1
+example.com/c/lib.go:13.2,13.10 1 0
+example.com/other/x.go:3.2,4.10 1 1
+`
+	if got := remap(t, ov, profile, CoverOptions{}); got != want {
+		t.Errorf("remapped profile:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRemapCoverProfile_WithGuards(t *testing.T) {
+	ov, profile := coverProfile(t)
+	directive := strings.Split(coverSrc, "\n")[4]
+	want := fmt.Sprintf(`mode: set
+example.com/c/lib.go:4.2,5.20 2 1
+example.com/c/lib.go:5.21,5.%d 1 0
+example.com/c/lib.go:6.2,6.11 1 1
+example.com/c/lib.go:7.3,8.3 1 0
+example.com/c/lib.go:9.2,9.19 1 1
+example.com/c/lib.go:13.2,13.10 1 0
+example.com/other/x.go:3.2,4.10 1 1
+`, len(directive)+1)
+	if got := remap(t, ov, profile, CoverOptions{Guards: true}); got != want {
+		t.Errorf("remapped profile:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRemapCoverProfile_SourcePositionsUnchanged(t *testing.T) {
+	ov, _ := coverProfile(t)
+	// A go command that instruments the original file reports positions
+	// on it, and no block at a guard's action.
+	profile := `mode: count
+example.com/c/lib.go:4.2,6.11 2 3
+example.com/c/lib.go:7.3,8.3 1 0
+example.com/c/lib.go:9.2,9.19 1 3
+`
+	if got := remap(t, ov, profile, CoverOptions{}); got != profile {
+		t.Errorf("profile on the source should be unchanged, got:\n%s", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// RewriteCoverArgs — instrumenting shadows
+// ---------------------------------------------------------------------------
+
+func TestRewriteCoverArgs(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":   "module example.com/c\n\ngo 1.21\n",
+		"lib.go":   coverSrc,
+		"plain.go": "package c\n",
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	lib, plain := filepath.Join(dir, "lib.go"), filepath.Join(dir, "plain.go")
+	tmp, work := t.TempDir(), t.TempDir()
+	list := filepath.Join(work, "outfiles.txt")
+	args := []string{"-pkgcfg", "cfg.txt", "-mode", "set", "-var", "goCover_1", "-outfilelist", list, plain, lib}
+
+	got, finish, err := RewriteCoverArgs(args, e.Overlay, tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[8] != plain {
+		t.Errorf("input without shadow should be unchanged, got %q", got[8])
+	}
+	if filepath.Base(got[9]) != "lib.go" || filepath.Dir(filepath.Dir(got[9])) != tmp {
+		t.Fatalf("input with shadow should be a copy named lib.go, got %q", got[9])
+	}
+	copied, _ := os.ReadFile(got[9])
+	if string(copied) != readShadow(t, e) {
+		t.Errorf("copy differs from the shadow:\n%s", copied)
+	}
+
+	// What the cover tool writes: a //line header naming its input.
+	outs := []string{filepath.Join(work, "vars.go"), filepath.Join(work, "plain.cover.go"), filepath.Join(work, "lib.cover.go")}
+	os.WriteFile(list, []byte(strings.Join(outs, "\n")+"\n"), 0o644)
+	os.WriteFile(outs[1], []byte("//line "+plain+":1:1\npackage c\n"), 0o644)
+	os.WriteFile(outs[2], []byte("//line "+got[9]+":1:1\npackage c\n"), 0o644)
+	if err := finish(); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := os.ReadFile(outs[2])
+	if want := lineDirective(readShadowPath(t, e), 1, 1) + "\npackage c\n"; string(out) != want {
+		t.Errorf("instrumented copy = %q, want %q", out, want)
+	}
+	out, _ = os.ReadFile(outs[1])
+	if !strings.HasPrefix(string(out), "//line "+plain+":1:1\n") {
+		t.Errorf("output of an input without shadow should be unchanged, got %q", out)
+	}
+}
+
+// TestInco_CoverKeepsGuards runs inco test -coverprofile on a module whose
+// test depends on a guard firing: the go command itself hands the cover
+// tool the original files, which have no guards.
+func TestInco_CoverKeepsGuards(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds inco and runs go test")
+	}
+	bin := buildInco(t)
+	dir := setupDir(t, map[string]string{
+		"go.mod": "module example.com/cv\n\ngo 1.21\n",
+		"a.go":   "package cv\n\nfunc Pos(x int) int {\n\t// @inco: x > 0\n\treturn x\n}\n",
+		"a_test.go": `package cv
+
+import "testing"
+
+func TestPos(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("guard did not fire")
+		}
+	}()
+	Pos(-1)
+}
+`,
+	})
+	run := func(name string, env []string, args ...string) (string, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), append([]string{"INCOSOCKET=off", "GOFLAGS="}, env...)...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	// A build of the originals, as plain go test makes, must not be
+	// reused for the shadows.
+	if out, err := run("go", nil, "test", "-count=1", "-cover", "."); err == nil {
+		t.Fatalf("go test without inco should not see the guard:\n%s", out)
+	}
+
+	for _, mode := range []string{"source", "guards"} {
+		out, err := run(bin, []string{"INCOCOVER=" + mode}, "test", "-count=1", "-coverprofile=c.out", ".")
+		if err != nil {
+			t.Fatalf("INCOCOVER=%s: inco test: %v\n%s", mode, err, out)
+		}
+		profile, err := os.ReadFile(filepath.Join(dir, "c.out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hasGuard := strings.Contains(string(profile), "example.com/cv/a.go:4.")
+		if hasGuard != (mode == "guards") || !strings.Contains(string(profile), "example.com/cv/a.go:5.2,5.10 1 0") {
+			t.Errorf("INCOCOVER=%s: profile:\n%s", mode, profile)
+		}
+	}
+}
+
+// buildInco builds the inco command from a copy of this module, through
+// its own overlay: without its guards, inco does not work.
+func buildInco(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	modDir, _ := findModule(wd)
+	src := t.TempDir()
+	err = filepath.WalkDir(modDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && strings.HasPrefix(d.Name(), ".") && path != modDir {
+			return filepath.SkipDir
+		}
+		rel, _ := filepath.Rel(modDir, path)
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(src, rel), 0o755)
+		}
+		if !strings.HasSuffix(path, ".go") && d.Name() != "go.mod" && d.Name() != "go.sum" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(src, rel), data, 0o644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(src)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(t.TempDir(), "inco")
+	build := exec.Command("go", "build", "-overlay", filepath.Join(src, ".inco_cache", "overlay.json"), "-o", bin, "./cmd/inco")
+	build.Dir = src
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building inco: %v\n%s", err, out)
+	}
+	return bin
+}
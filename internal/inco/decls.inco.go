@@ -0,0 +1,303 @@
+package inco
+
+import (
+	"cmp"
+	"go/build"
+	"go/build/constraint"
+	"go/scanner"
+	"go/token"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Package scope
+// ---------------------------------------------------------------------------
+//
+// A file's shadow depends on the names the other files of its package
+// declare: a directive's "user.Name" needs no import when another file
+// declares user. Those names are read with the scanner alone, remembered
+// in the manifest under the stamp of the file they were read from, and
+// combined once per package and run, so a warm run only stats the files
+// of the packages it looks at.
+
+// pkgScope is what the files of one package in one directory declare, as
+// seen by the current run's build context.
+type pkgScope struct {
+	once  sync.Once
+	files map[string][]string // file path → package-level names
+	hash  string              // hash of every name; "" when there are none
+}
+
+// packageScope returns the scope of package pkg in dir, reading it on
+// first use in the run.
+func (e *Engine) packageScope(dir, pkg string) *pkgScope {
+	v, _ := e.scopes.LoadOrStore(dir+"\x00"+pkg, &pkgScope{})
+	s := v.(*pkgScope)
+	s.once.Do(func() {
+		s.files = make(map[string][]string)
+		entries, _ := os.ReadDir(dir)
+		for _, ent := range entries {
+			name := ent.Name()
+			// @inco: !ent.IsDir() && goSourceRe.MatchString(name) && !testFileRe.MatchString(name), -continue
+			path := filepath.Join(dir, name)
+			d := e.declsOf(path)
+			// @inco: d.Package == pkg && matchDecls(&e.buildCtxt, dir, name, d), -continue
+			s.files[path] = d.Names
+		}
+		s.hash = namesHash(s.files)
+	})
+	return s
+}
+
+// siblingNames returns the package-level names declared in the files of
+// package pkg in path's directory other than path itself.
+func (e *Engine) siblingNames(path, pkg string) map[string]bool {
+	names := make(map[string]bool)
+	for p, ns := range e.packageScope(filepath.Dir(path), pkg).files {
+		_ = p // @inco: p != path, -continue
+		for _, n := range ns {
+			names[n] = true
+		}
+	}
+	return names
+}
+
+// siblingDeclHash returns the hash of the names the files of the package
+// of the source at path declare, or "" when there are none. A shadow's
+// imports depend on them, so a shadow generated against another hash is
+// stale even when its own source is unchanged.
+func (e *Engine) siblingDeclHash(path string) string {
+	self := e.declsOf(path)
+	// @inco: self.Package != "", -return("")
+	return e.packageScope(filepath.Dir(path), self.Package).hash
+}
+
+// namesHash returns a hash of the names in files, or "" when there are
+// none.
+func namesHash(files map[string][]string) string {
+	names := make(map[string]bool)
+	for _, ns := range files {
+		for _, n := range ns {
+			names[n] = true
+		}
+	}
+	// @inco: len(names) > 0, -return("")
+	return hashBytes([]byte(strings.Join(slices.Sorted(maps.Keys(names)), "\n")))
+}
+
+// declsOf returns the declarations of the source at path, reusing what
+// this engine or the previous manifest recorded while the file's stamp is
+// unchanged.
+func (e *Engine) declsOf(path string) FileDecls {
+	stamp, ok := statStamp(path)
+	_ = ok // @inco: ok, -return(FileDecls{})
+	if v, hit := e.decls.Load(path); hit {
+		prev := v.(FileDecls)
+		if prev.Size == stamp.size && prev.ModTime == stamp.modTime.UnixNano() {
+			return prev
+		}
+	}
+	src, err := os.ReadFile(path)
+	_ = err // @inco: err == nil, -return(FileDecls{})
+	d := scanDecls(src)
+	d.Size, d.ModTime = stamp.size, stamp.modTime.UnixNano()
+	if time.Since(stamp.modTime) > racyWindow {
+		e.decls.Store(path, d)
+	} else {
+		e.decls.Delete(path)
+	}
+	return d
+}
+
+// recordedDecls returns the declarations to keep in the manifest entry of
+// path: the last ones read under the file's current stamp, if any.
+func (e *Engine) recordedDecls(path string) *FileDecls {
+	v, ok := e.decls.Load(path)
+	_ = ok // @inco: ok, -return(nil)
+	d := v.(FileDecls)
+	return &d
+}
+
+// seedDecls makes the declarations recorded in m available to declsOf.
+func (e *Engine) seedDecls(m *Manifest) {
+	for path, entry := range m.Files {
+		if entry.Declares != nil {
+			e.decls.LoadOrStore(path, *entry.Declares)
+		}
+	}
+}
+
+// buildContext returns the context that decides which files of a
+// directory its package is compiled from in the current run: GOOS, GOARCH
+// and CGO_ENABLED of the engine's environment, and the build tags set in
+// GOFLAGS and in buildFlags (see RunPackages).
+func (e *Engine) buildContext(buildFlags []string) build.Context {
+	ctxt := build.Default
+	ctxt.GOOS = cmp.Or(e.getenv("GOOS"), runtime.GOOS)
+	ctxt.GOARCH = cmp.Or(e.getenv("GOARCH"), runtime.GOARCH)
+	switch e.getenv("CGO_ENABLED") {
+	case "0":
+		ctxt.CgoEnabled = false
+	case "1":
+		ctxt.CgoEnabled = true
+	}
+	flags := append(strings.Fields(e.getenv("GOFLAGS")), buildFlags...)
+	for i := 0; i < len(flags); i++ {
+		name, value, hasValue := strings.Cut(flags[i], "=")
+		name = "-" + strings.TrimLeft(name, "-")
+		switch {
+		case name == "-race" || name == "-msan" || name == "-asan":
+			ctxt.BuildTags = append(ctxt.BuildTags, name[1:])
+		case name != "-tags":
+		case hasValue:
+			ctxt.BuildTags = append(ctxt.BuildTags, splitTags(value)...)
+		case i+1 < len(flags):
+			i++
+			ctxt.BuildTags = append(ctxt.BuildTags, splitTags(flags[i])...)
+		}
+	}
+	return ctxt
+}
+
+// splitTags splits the value of -tags, comma-separated or, in its older
+// form, space-separated.
+func splitTags(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// matchDecls reports whether ctxt compiles the file dir/name, whose
+// declarations are d, into its package. Only the recorded constraints are
+// consulted; the file is not read again. As for the go command, a file
+// that imports "C" is left out when cgo is disabled.
+func matchDecls(ctxt *build.Context, dir, name string, d FileDecls) bool {
+	// @inco: !d.Cgo || ctxt.CgoEnabled, -return(false)
+	header := strings.Join(d.Constraints, "\n") + "\n\npackage " + d.Package + "\n"
+	c := *ctxt
+	c.JoinPath = pathpkg.Join
+	c.OpenFile = func(string) (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(header)), nil }
+	match, err := c.MatchFile(dir, name)
+	return err == nil && match
+}
+
+// declNames returns the package-level names declared in the Go files of
+// package pkgName in dir of fsys, other than self. When files is not nil,
+// it lists the package's files in fsys, as compiled; otherwise the files
+// of dir that build.Default matches are used. A nil fsys has no files.
+func declNames(fsys fs.FS, dir, self, pkgName string, files []string) map[string]bool {
+	names := make(map[string]bool)
+	// @inco: fsys != nil, -return(names)
+	compiled := files != nil
+	if !compiled {
+		entries, _ := fs.ReadDir(fsys, dir)
+		for _, ent := range entries {
+			name := ent.Name()
+			// @inco: !ent.IsDir() && goSourceRe.MatchString(name) && !testFileRe.MatchString(name), -continue
+			files = append(files, pathpkg.Join(dir, name))
+		}
+	}
+	for _, file := range files {
+		// @inco: file != pathpkg.Join(dir, self), -continue
+		src, err := fs.ReadFile(fsys, file)
+		_ = err // @inco: err == nil, -continue
+		d := scanDecls(src)
+		// @inco: d.Package == pkgName, -continue
+		// @inco: compiled || matchDecls(&build.Default, pathpkg.Dir(file), pathpkg.Base(file), d), -continue
+		for _, n := range d.Names {
+			names[n] = true
+		}
+	}
+	return names
+}
+
+// scanDecls reads the package clause, build constraints, cgo import and
+// package-level names of a Go source with the scanner alone: function
+// bodies and initializers are skipped over, not parsed. A source that does
+// not tokenize or has no package clause yields an empty Package.
+func scanDecls(src []byte) FileDecls {
+	var d FileDecls
+	fset := token.NewFileSet()
+	var s scanner.Scanner
+	failed := false
+	s.Init(fset.AddFile("", -1, len(src)), src, func(token.Position, string) { failed = true }, scanner.ScanComments)
+
+	var (
+		decl    token.Token // keyword of the top-level declaration being read
+		grouped bool        // the declaration is parenthesized
+		depth   int         // nesting of (), [] and {}
+		want    bool        // the next identifier is a declared name
+		list    bool        // a comma continues a var or const name list
+	)
+	for {
+		_, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if d.Package == "" {
+			switch tok {
+			case token.COMMENT:
+				if constraint.IsGoBuild(lit) || constraint.IsPlusBuild(lit) {
+					d.Constraints = append(d.Constraints, lit)
+				}
+				continue
+			case token.PACKAGE:
+				_, tok, lit = s.Scan()
+				if tok == token.IDENT {
+					d.Package = lit
+					continue
+				}
+			}
+			return FileDecls{}
+		}
+		level := depth == 0 || grouped && depth == 1
+		switch tok {
+		case token.COMMENT:
+			continue
+		case token.LPAREN, token.LBRACK, token.LBRACE:
+			grouped = grouped || depth == 0 && want && tok == token.LPAREN && decl != token.FUNC
+			want = grouped && depth == 0
+			depth++
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			depth--
+			grouped = grouped && depth > 0
+			want = false
+		case token.FUNC, token.VAR, token.CONST, token.TYPE, token.IMPORT:
+			if depth == 0 {
+				decl, grouped, want = tok, false, true
+			}
+		case token.SEMICOLON:
+			if level {
+				want = grouped
+			}
+			if depth == 0 {
+				decl = token.ILLEGAL
+			}
+		case token.IDENT:
+			declared := level && want && decl != token.IMPORT
+			if declared {
+				d.Names = append(d.Names, lit)
+			}
+			list = declared && (decl == token.VAR || decl == token.CONST)
+			want = false
+			continue
+		case token.COMMA:
+			want = level && list
+		case token.STRING:
+			d.Cgo = d.Cgo || level && decl == token.IMPORT && lit == `"C"`
+		}
+		list = false
+	}
+	if failed {
+		return FileDecls{}
+	}
+	return d
+}
@@ -0,0 +1,184 @@
+package inco
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// scanDecls
+// ---------------------------------------------------------------------------
+
+func TestScanDecls(t *testing.T) {
+	src := `//go:build linux && !race
+// +build linux,!race
+
+// Package p is documented.
+package p
+
+import (
+	"fmt"
+	c "C"
+)
+
+const A, B = 1, 2
+
+var (
+	x, y int
+	f    = func() { var hidden int; _ = hidden }
+	m    = map[string]int{"k": 1}
+)
+
+type (
+	T    struct{ field int }
+	G[P any] []P
+)
+
+type Alias = fmt.Stringer
+
+func F[T any](a, b T) (r int) { const inner = 1; return }
+
+func (t T) Method() {}
+
+func init() {}
+`
+	d := scanDecls([]byte(src))
+	if d.Package != "p" {
+		t.Errorf("Package = %q, want p", d.Package)
+	}
+	if want := []string{"//go:build linux && !race", "// +build linux,!race"}; !slices.Equal(d.Constraints, want) {
+		t.Errorf("Constraints = %q, want %q", d.Constraints, want)
+	}
+	if !d.Cgo {
+		t.Error("import of C not noticed")
+	}
+	want := []string{"A", "B", "x", "y", "f", "m", "T", "G", "Alias", "F", "init"}
+	if !slices.Equal(d.Names, want) {
+		t.Errorf("Names = %q, want %q", d.Names, want)
+	}
+}
+
+func TestScanDecls_NoPackageClause(t *testing.T) {
+	for _, src := range []string{"", "var x int\n", "package\n", "package p\n\nvar s = \"unterminated\n"} {
+		if d := scanDecls([]byte(src)); d.Package != "" {
+			t.Errorf("scanDecls(%q) = %+v, want no package", src, d)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Build context
+// ---------------------------------------------------------------------------
+
+func TestBuildContext(t *testing.T) {
+	e := NewEngine(t.TempDir())
+	e.Env = []string{"GOOS=windows", "GOARCH=arm64", "CGO_ENABLED=0", "GOFLAGS=-mod=mod -tags=a,b"}
+	ctxt := e.buildContext([]string{"-tags", "c d", "-race", "-modfile=x.mod"})
+	if ctxt.GOOS != "windows" || ctxt.GOARCH != "arm64" || ctxt.CgoEnabled {
+		t.Errorf("context is %s/%s cgo=%v", ctxt.GOOS, ctxt.GOARCH, ctxt.CgoEnabled)
+	}
+	if want := []string{"a", "b", "c", "d", "race"}; !slices.Equal(ctxt.BuildTags, want) {
+		t.Errorf("BuildTags = %q, want %q", ctxt.BuildTags, want)
+	}
+	for name, want := range map[string]bool{
+		"f.go":         true,
+		"f_windows.go": true,
+		"f_linux.go":   false,
+		"f_arm64.go":   true,
+	} {
+		if got := matchDecls(&ctxt, "dir", name, FileDecls{Package: "p"}); got != want {
+			t.Errorf("matchDecls(%s) = %v, want %v", name, got, want)
+		}
+	}
+	for _, tc := range []struct {
+		decls FileDecls
+		want  bool
+	}{
+		{FileDecls{Package: "p", Constraints: []string{"//go:build a && race"}}, true},
+		{FileDecls{Package: "p", Constraints: []string{"//go:build !c"}}, false},
+		{FileDecls{Package: "p", Constraints: []string{"// +build ignore"}}, false},
+		{FileDecls{Package: "p", Cgo: true}, false},
+	} {
+		if got := matchDecls(&ctxt, "dir", "f.go", tc.decls); got != tc.want {
+			t.Errorf("matchDecls(%+v) = %v, want %v", tc.decls, got, tc.want)
+		}
+	}
+}
+
+// The files of a package are those the build's tags select.
+func TestEngine_BuildTagsDecidePackageFiles(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go":   "package main\n\nfunc main() {\n\t// @inco: user.Name != \"\"\n}\n",
+		"tagged.go": "//go:build special\n\npackage main\n\nvar user = struct{ Name string }{\"x\"}\n",
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow := readShadow(t, e); !strings.Contains(shadow, `"os/user"`) {
+		t.Errorf("without the tag user is the package:\n%s", shadow)
+	}
+	if err := e.RunPackages(dir, []string{"-tags=special"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if shadow := readShadow(t, e); strings.Contains(shadow, `"os/user"`) {
+		t.Errorf("with the tag user is declared by tagged.go:\n%s", shadow)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Declarations recorded in the manifest
+// ---------------------------------------------------------------------------
+
+// A later run takes the declarations of a file whose stamp is unchanged
+// from the manifest instead of reading the file again.
+func TestEngine_DeclarationsFromManifest(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: user.Name != \"\"\n}\n",
+		"vars.go": "package main\n\nvar users = 1\n",
+	})
+	vars := filepath.Join(dir, "vars.go")
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(vars, old, old)
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow := readShadow(t, e); !strings.Contains(shadow, `"os/user"`) {
+		t.Fatalf("user should be imported:\n%s", shadow)
+	}
+
+	manifestPath := filepath.Join(dir, ".inco_cache", "manifest.json")
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	entry := m.Files[vars]
+	if entry.Declares == nil || !slices.Equal(entry.Declares.Names, []string{"users"}) {
+		t.Fatalf("manifest records %+v for vars.go", entry.Declares)
+	}
+	// Pretend vars.go declared user when it was last read.
+	entry.Declares.Names = []string{"user"}
+	m.Files[vars] = entry
+	data, _ = json.Marshal(&m)
+	if err := os.WriteFile(manifestPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	e = NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow := readShadow(t, e); strings.Contains(shadow, `"os/user"`) {
+		t.Errorf("the recorded declarations should have been used:\n%s", shadow)
+	}
+}
@@ -0,0 +1,158 @@
+package inco
+
+import (
+	"errors"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"sort"
+)
+
+// ---------------------------------------------------------------------------
+// Diagnostics
+// ---------------------------------------------------------------------------
+
+// Severity classifies a Diagnostic.
+type Severity int
+
+const (
+	SeverityError   Severity = iota // the file was left out of the overlay
+	SeverityWarning                 // the file was generated, but may not be what was meant
+)
+
+var severityNames = map[Severity]string{
+	SeverityError:   "error",
+	SeverityWarning: "warning",
+}
+
+func (s Severity) String() string {
+	if n, ok := severityNames[s]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// MarshalText encodes s by name, so that diagnostics read well as JSON.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a name written by MarshalText.
+func (s *Severity) UnmarshalText(text []byte) error {
+	for k, n := range severityNames {
+		if n == string(text) {
+			*s = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown severity %q", text)
+}
+
+// Diagnostic codes. They are stable and meant for tools to match on.
+const (
+	DiagRead        = "read"             // the source file could not be read
+	DiagParse       = "parse"            // the source file is not valid Go and was passed through
+	DiagWrite       = "write"            // the shadow could not be written
+	DiagInternal    = "internal"         // generation panicked
+	DiagAmbiguous   = "ambiguous-import" // a directive's package name matches several packages
+	DiagNoImport    = "missing-import"   // a directive needs a package the compiler was not given (toolexec)
+	DiagOverlay     = "overlay-conflict" // a user-supplied -overlay replaces a file that has a shadow
+	DiagDuplicateID = "duplicate-id"     // two directives of a file have the same explicit id=
+)
+
+// Diagnostic is one problem found while generating the overlay.
+type Diagnostic struct {
+	Pos       token.Position // Line and Column are 0 when the problem concerns the whole file
+	Severity  Severity
+	Code      string // one of the Diag* constants
+	Message   string
+	Directive string `json:",omitempty"` // ID of the directive the problem concerns, if one does
+}
+
+// String formats d as "file:line:col: severity: message [code]", with the
+// message labeled "in @inco: directive [id]: " when d concerns one.
+func (d Diagnostic) String() string {
+	msg := d.Message
+	if d.Directive != "" {
+		msg = "in @inco: directive [" + d.Directive + "]: " + msg
+	}
+	return fmt.Sprintf("%s: %s: %s [%s]", d.Pos, d.Severity, msg, d.Code)
+}
+
+// DiagnosticsError is returned by a run that hit at least one error
+// diagnostic. Without Engine.KeepGoing no overlay was written; with it,
+// the overlay covers every file that succeeded.
+type DiagnosticsError struct {
+	Diagnostics []Diagnostic // every diagnostic of the run, warnings included
+}
+
+func (e *DiagnosticsError) Error() string {
+	var errs []string
+	for _, d := range e.Diagnostics {
+		if d.Severity == SeverityError {
+			errs = append(errs, d.String())
+		}
+	}
+	// @inco: len(errs) > 0, -return("inco: no errors")
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return fmt.Sprintf("%s (and %d more errors)", errs[0], len(errs)-1)
+}
+
+// hasErrors reports whether diags contains an error diagnostic.
+func hasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// fileError returns the error diagnostic for a problem with the file at
+// path as a whole.
+func fileError(path, code string, err error) []Diagnostic {
+	return []Diagnostic{{
+		Pos:      token.Position{Filename: path},
+		Severity: SeverityError,
+		Code:     code,
+		Message:  err.Error(),
+	}}
+}
+
+// parseWarning returns the warning for a file that does not parse, at its
+// first syntax error. The file is passed through to the compiler as is, so
+// the message only says why its directives are not applied; the compiler
+// reports the syntax errors themselves.
+func parseWarning(path string, err error) []Diagnostic {
+	d := syntaxError(path, err)
+	d.Severity = SeverityWarning
+	d.Message = "file does not parse; passed through without its directives: " + d.Message
+	return []Diagnostic{d}
+}
+
+// syntaxError returns the error diagnostic for the first syntax error in
+// err, a parser error for the file at path.
+func syntaxError(path string, err error) Diagnostic {
+	d := Diagnostic{Pos: token.Position{Filename: path}, Severity: SeverityError, Code: DiagParse, Message: err.Error()}
+	var list scanner.ErrorList
+	if errors.As(err, &list) && len(list) > 0 {
+		d.Pos, d.Message = list[0].Pos, list[0].Msg
+	}
+	return d
+}
+
+// sortDiagnostics orders diags by file and position.
+func sortDiagnostics(diags []Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i].Pos, diags[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
@@ -0,0 +1,163 @@
+package inco
+
+import (
+	"encoding/json"
+	"errors"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// Diagnostic formatting
+// ---------------------------------------------------------------------------
+
+func TestDiagnosticsError(t *testing.T) {
+	err := &DiagnosticsError{Diagnostics: []Diagnostic{
+		{Pos: token.Position{Filename: "a.go", Line: 3, Column: 7}, Severity: SeverityError, Code: DiagInternal, Message: "boom"},
+		{Pos: token.Position{Filename: "b.go", Line: 1, Column: 1}, Severity: SeverityWarning, Code: DiagAmbiguous, Message: "ambiguous"},
+		{Pos: token.Position{Filename: "c.go"}, Severity: SeverityError, Code: DiagRead, Message: "permission denied"},
+	}}
+	want := "a.go:3:7: error: boom [internal] (and 1 more errors)"
+	if got := err.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if got := err.Diagnostics[2].String(); got != "c.go: error: permission denied [read]" {
+		t.Errorf("file-level String() = %q", got)
+	}
+}
+
+func TestDiagnostic_JSON(t *testing.T) {
+	d := Diagnostic{Pos: token.Position{Filename: "a.go", Line: 2}, Severity: SeverityWarning, Code: DiagAmbiguous, Message: "m"}
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Severity":"warning"`) {
+		t.Errorf("severity should be encoded by name: %s", data)
+	}
+	var back Diagnostic
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back != d {
+		t.Errorf("round trip = %+v, want %+v", back, d)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Engine — aggregated diagnostics and KeepGoing
+// ---------------------------------------------------------------------------
+
+// setupBrokenDir creates a tree with one good file and two dangling
+// symlinks named like Go sources, which fail to read.
+func setupBrokenDir(t *testing.T) string {
+	t.Helper()
+	dir := setupDir(t, map[string]string{
+		"good.go":  "package main\n\nfunc Good(x int) {\n\t// @inco: x > 0\n}\n",
+		"nodir.go": "package main\n\nfunc Plain() {}\n",
+	})
+	for _, name := range []string{"gone.go", "lost.go"} {
+		if err := os.Symlink(filepath.Join(dir, "missing", name), filepath.Join(dir, name)); err != nil {
+			t.Skipf("symlinks unsupported: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestEngine_DiagnosticsCollected(t *testing.T) {
+	dir := setupBrokenDir(t)
+	e := NewEngine(dir)
+	err := e.Run()
+	var de *DiagnosticsError
+	if !errors.As(err, &de) {
+		t.Fatalf("expected a *DiagnosticsError, got %v", err)
+	}
+	var files []string
+	for _, d := range de.Diagnostics {
+		if d.Severity != SeverityError || d.Code != DiagRead {
+			t.Errorf("unexpected diagnostic %v", d)
+		}
+		files = append(files, filepath.Base(d.Pos.Filename))
+	}
+	if strings.Join(files, ",") != "gone.go,lost.go" {
+		t.Errorf("expected read errors for gone.go and lost.go in order, got %v", de.Diagnostics)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".inco_cache", "overlay.json")); err == nil {
+		t.Error("without KeepGoing no overlay should be written")
+	}
+	// good.go's shadow was written before the run failed; it must not be
+	// left behind in the cache.
+	if shadows, _ := filepath.Glob(filepath.Join(dir, ".inco_cache", "*.go")); len(shadows) != 0 {
+		t.Errorf("a failed run should remove the shadows it wrote, found %v", shadows)
+	}
+}
+
+func TestEngine_KeepGoing(t *testing.T) {
+	dir := setupBrokenDir(t)
+	e := NewEngine(dir)
+	e.KeepGoing = true
+	var de *DiagnosticsError
+	if err := e.Run(); !errors.As(err, &de) {
+		t.Fatalf("expected a *DiagnosticsError, got %v", err)
+	}
+	if len(e.Overlay.Replace) != 1 {
+		t.Fatalf("overlay should map only good.go, got %v", e.Overlay.Replace)
+	}
+	if _, ok := e.Overlay.Replace[filepath.Join(dir, "good.go")]; !ok {
+		t.Errorf("good.go missing from overlay: %v", e.Overlay.Replace)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".inco_cache", "overlay.json")); err != nil {
+		t.Errorf("overlay should be written: %v", err)
+	}
+
+	// Failed files are not recorded, so fixing one regenerates it.
+	os.Remove(filepath.Join(dir, "gone.go"))
+	os.WriteFile(filepath.Join(dir, "gone.go"), []byte("package main\n\nfunc Gone(x int) {\n\t// @inco: x > 0\n}\n"), 0o644)
+	os.Remove(filepath.Join(dir, "lost.go"))
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Diagnostics) != 0 || len(e.Overlay.Replace) != 2 {
+		t.Errorf("after the fix: diagnostics %v, overlay %v", e.Diagnostics, e.Overlay.Replace)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Engine — unparsable files
+// ---------------------------------------------------------------------------
+
+func TestEngine_UnparsableFilePassedThrough(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"good.go": "package main\n\nfunc Good(x int) {\n\t// @inco: x > 0\n}\n",
+		"bad.go":  "package main\n\nfunc Bad(x int) {\n\t// @inco: x > 0\n\tx +\n}\n",
+	})
+	bad := filepath.Join(dir, "bad.go")
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatalf("a syntax error should not fail the run: %v", err)
+	}
+	if _, ok := e.Overlay.Replace[bad]; ok {
+		t.Error("unparsable file should stay out of the overlay")
+	}
+	if _, ok := e.Overlay.Replace[filepath.Join(dir, "good.go")]; !ok {
+		t.Error("other files should still be generated")
+	}
+	if len(e.Diagnostics) != 1 {
+		t.Fatalf("expected one warning, got %v", e.Diagnostics)
+	}
+	if d := e.Diagnostics[0]; d.Severity != SeverityWarning || d.Code != DiagParse || d.Pos.Filename != bad || d.Pos.Line != 6 {
+		t.Errorf("unexpected warning %v", d)
+	}
+
+	// Fixing the file brings it into the overlay.
+	os.WriteFile(bad, []byte("package main\n\nfunc Bad(x int) {\n\t// @inco: x > 0\n}\n"), 0o644)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.Overlay.Replace[bad]; !ok || len(e.Diagnostics) != 0 {
+		t.Errorf("fixed file should be generated: overlay %v, diagnostics %v", e.Overlay.Replace, e.Diagnostics)
+	}
+}
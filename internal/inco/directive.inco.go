@@ -19,6 +19,14 @@ var (
 	// Group 3: action arguments (optional)
 	actionRe = regexp.MustCompile(`^(.+),\s*-(panic|return|continue|break|log)(?:\((.+)\))?\s*$`)
 
+	// idRe matches a trailing ", id=NAME" that overrides the derived ID.
+	// Group 1: the ID
+	idRe = regexp.MustCompile(`,\s*id=([A-Za-z0-9][\w.\-/]*)\s*$`)
+
+	// importPragmaRe matches the body of an @inco.import: comment.
+	// Group 1: local name (optional), Group 2: import path
+	importPragmaRe = regexp.MustCompile(`^@inco\.import:\s+(?:([A-Za-z_]\w*)\s+)?"([^"\s]+)"$`)
+
 	// commentRe strips Go comment delimiters.
 	// Group 1: content of // comment
 	// Group 2: content of /* */ comment
@@ -37,7 +45,7 @@ var actionFromName = map[string]ActionKind{
 // ParseDirective extracts a Directive from a comment string.
 // Returns nil when the comment is not a valid @inco: directive.
 //
-// Syntax: @inco: <expr>[, -action[(args...)]]
+// Syntax: @inco: <expr>[, -action[(args...)]][, id=<name>]
 func ParseDirective(comment string) *Directive {
 	body := stripComment(comment)
 	// @inco: body != "", -return(nil)
@@ -47,7 +55,12 @@ func ParseDirective(comment string) *Directive {
 	rest := m[1]
 
 	d := &Directive{Action: ActionPanic}
-	if am := actionRe.FindStringSubmatch(rest); am != nil {
+	if im := idRe.FindStringSubmatchIndex(rest); im != nil {
+		d.ID = rest[im[2]:im[3]]
+		rest = rest[:im[0]]
+	}
+	am := actionRe.FindStringSubmatch(rest)
+	if am != nil {
 		d.Expr = strings.TrimSpace(am[1])
 		d.Action = actionFromName[am[2]]
 		if am[3] != "" {
@@ -58,6 +71,7 @@ func ParseDirective(comment string) *Directive {
 	}
 
 	// @inco: d.Expr != "", -return(nil)
+	locateDirective(comment, d, am != nil)
 	return d
 }
 
@@ -65,6 +79,38 @@ func ParseDirective(comment string) *Directive {
 // Helpers
 // ---------------------------------------------------------------------------
 
+// locateDirective records where the expression and action name start
+// within the raw comment text so that generated code can point back at them.
+// explicit reports whether an action was written; the implicit panic has no
+// text of its own and keeps ActionOffset at 0.
+func locateDirective(comment string, d *Directive, explicit bool) {
+	marker := strings.Index(comment, "@inco:")
+	// @inco: marker >= 0, -return
+	if i := strings.Index(comment[marker:], d.Expr); i >= 0 {
+		d.ExprOffset = marker + i
+	}
+	// @inco: explicit, -return
+	tail := d.ExprOffset + len(d.Expr)
+	if i := strings.Index(comment[tail:], "-"+d.Action.String()); i >= 0 {
+		d.ActionOffset = tail + i + 1
+	}
+}
+
+// ParseImportPragma extracts an ImportPragma from a comment string.
+// Returns nil when the comment is not a valid @inco.import: pragma.
+// Without an explicit name the last element of the path is used.
+//
+// Syntax: @inco.import: [name] "import/path"
+func ParseImportPragma(comment string) *ImportPragma {
+	m := importPragmaRe.FindStringSubmatch(stripComment(comment))
+	// @inco: m != nil, -return(nil)
+	p := &ImportPragma{Name: m[1], Path: m[2]}
+	if p.Name == "" {
+		p.Name = defaultImportName(p.Path)
+	}
+	return p
+}
+
 // stripComment removes Go comment delimiters and returns trimmed content.
 func stripComment(s string) string {
 	s = strings.TrimSpace(s)
@@ -169,7 +169,7 @@ func TestParseDirective_Break(t *testing.T) {
 func TestBuildPanicBody_Do(t *testing.T) {
 	e := NewEngine(t.TempDir())
 	d := &Directive{Action: ActionDo, Expr: "x != nil", ActionArgs: []string{`log.Println("x is nil")`}}
-	body := e.buildPanicBody(d, "test.go", 1)
+	body := e.buildPanicBody(d, "", "test.go", 1)
 	want := `log.Println("x is nil")`
 	if body != want {
 		t.Errorf("got %q, want %q", body, want)
@@ -179,7 +179,7 @@ func TestBuildPanicBody_Do(t *testing.T) {
 func TestBuildPanicBody_DoMultiExpr(t *testing.T) {
 	e := NewEngine(t.TempDir())
 	d := &Directive{Action: ActionDo, Expr: "ok", ActionArgs: []string{"count++", `log.Println("fail")`}}
-	body := e.buildPanicBody(d, "test.go", 1)
+	body := e.buildPanicBody(d, "", "test.go", 1)
 	want := `count++; log.Println("fail")`
 	if body != want {
 		t.Errorf("got %q, want %q", body, want)
@@ -213,6 +213,27 @@ func TestParseDirective_Log(t *testing.T) {
 	}
 }
 
+func TestParseDirective_ID(t *testing.T) {
+	tests := []struct {
+		in, expr, id string
+		action       ActionKind
+	}{
+		{"// @inco: x > 0, id=positive-x", "x > 0", "positive-x", ActionPanic},
+		{"// @inco: x > 0, -return(err), id=billing/x.1", "x > 0", "billing/x.1", ActionReturn},
+		{"// @inco: f(a, id), -continue", "f(a, id)", "", ActionContinue},
+	}
+	for _, tt := range tests {
+		d := ParseDirective(tt.in)
+		if d == nil {
+			t.Fatalf("ParseDirective(%q) = nil", tt.in)
+		}
+		if d.Expr != tt.expr || d.ID != tt.id || d.Action != tt.action {
+			t.Errorf("ParseDirective(%q) = expr %q, id %q, action %v; want %q, %q, %v",
+				tt.in, d.Expr, d.ID, d.Action, tt.expr, tt.id, tt.action)
+		}
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Edge cases — comma inside expression
 // ---------------------------------------------------------------------------
@@ -338,3 +359,58 @@ func TestSplitTopLevel(t *testing.T) {
 		}
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Expression and action offsets
+// ---------------------------------------------------------------------------
+
+func TestParseDirective_Offsets(t *testing.T) {
+	cases := []struct {
+		input     string
+		expr, act int
+	}{
+		{"// @inco: x > 0", 10, 0},
+		{"// @inco: x > 0, -panic", 10, 18},
+		{`// @inco: x > 0, -panic("bad")`, 10, 18},
+		{"// @inco: err == nil, -return(nil, err)", 10, 23},
+		{"//@inco:   ok, -continue", 11, 16},
+		{"/* @inco: x > 0, -break */", 10, 18},
+	}
+	for _, c := range cases {
+		d := ParseDirective(c.input)
+		if d == nil {
+			t.Fatalf("ParseDirective(%q) = nil", c.input)
+		}
+		if d.ExprOffset != c.expr {
+			t.Errorf("ParseDirective(%q).ExprOffset = %d, want %d", c.input, d.ExprOffset, c.expr)
+		}
+		if d.ActionOffset != c.act {
+			t.Errorf("ParseDirective(%q).ActionOffset = %d, want %d", c.input, d.ActionOffset, c.act)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// ParseImportPragma
+// ---------------------------------------------------------------------------
+
+func TestParseImportPragma(t *testing.T) {
+	tests := []struct {
+		input string
+		want  *ImportPragma
+	}{
+		{`// @inco.import: tmpl "html/template"`, &ImportPragma{Name: "tmpl", Path: "html/template"}},
+		{`// @inco.import: "html/template"`, &ImportPragma{Name: "template", Path: "html/template"}},
+		{`/* @inco.import: yaml "example.com/yaml/v3" */`, &ImportPragma{Name: "yaml", Path: "example.com/yaml/v3"}},
+		{`// @inco.import: "example.com/m/v2"`, &ImportPragma{Name: "m", Path: "example.com/m/v2"}},
+		{`// @inco.import: tmpl html/template`, nil}, // unquoted path
+		{`// @inco.import:`, nil},
+		{`// @inco: x > 0`, nil},
+	}
+	for _, tt := range tests {
+		got := ParseImportPragma(tt.input)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseImportPragma(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
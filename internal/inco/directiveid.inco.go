@@ -0,0 +1,152 @@
+package inco
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Directive IDs
+// ---------------------------------------------------------------------------
+//
+// A directive's position changes whenever lines are added above it, so
+// reports and messages also name it by an ID that survives such edits: a
+// hash of the package's import path, the enclosing function and the
+// expression with its formatting normalized. An explicit id= in the
+// directive takes precedence.
+
+// directiveIDs returns the IDs of the directives of f by the line of their
+// comment. pkg is the import path of f's package.
+//
+// Directives that hash alike (the same expression twice in one function)
+// are told apart by their order. Directives outside any function and in
+// init functions, whose names need not be unique in a package, are scoped
+// by the file name as well. A derived ID that an explicit id= or another
+// directive of the file already has is derived again with a counter, so
+// that the IDs of a file are unique.
+func directiveIDs(f *ast.File, fset *token.FileSet, pkg string) map[int]string {
+	ids := make(map[int]string)
+	taken := make(map[string]bool)
+	keys := make(map[int]string) // line → hash key, for directives without id=
+	var lines []int
+	seen := make(map[string]int)
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			d := ParseDirective(c.Text)
+			_ = d // @inco: d != nil, -continue
+			pos := fset.PositionFor(c.Pos(), false)
+			if d.ID != "" {
+				ids[pos.Line] = d.ID
+				taken[d.ID] = true
+				continue
+			}
+			fn := enclosingFunc(f, c.Pos())
+			if fn == "" || fn == "init" {
+				fn = filepath.Base(pos.Filename) + ":" + fn
+			}
+			key := pkg + "\x00" + fn + "\x00" + normalizeExpr(d.Expr)
+			seen[key]++
+			if n := seen[key]; n > 1 {
+				key += "\x00" + strconv.Itoa(n)
+			}
+			keys[pos.Line] = key
+			lines = append(lines, pos.Line)
+		}
+	}
+	for _, line := range lines {
+		id := hashID(keys[line])
+		for n := 2; taken[id]; n++ {
+			id = hashID(keys[line] + "\x00collision " + strconv.Itoa(n))
+		}
+		ids[line] = id
+		taken[id] = true
+	}
+	return ids
+}
+
+// duplicateIDs reports every directive of f whose explicit id= an earlier
+// directive of the file already has. The derived IDs of a file never
+// repeat, but nothing stops two explicit ones from doing so.
+func duplicateIDs(f *ast.File, fset *token.FileSet) []Diagnostic {
+	var diags []Diagnostic
+	first := make(map[string]token.Position) // id= value → its first directive
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			d := ParseDirective(c.Text)
+			_ = d // @inco: d != nil && d.ID != "", -continue
+			pos := fset.Position(c.Pos())
+			prev, dup := first[d.ID]
+			if !dup {
+				first[d.ID] = pos
+				continue
+			}
+			diags = append(diags, Diagnostic{
+				Pos:       pos,
+				Severity:  SeverityWarning,
+				Code:      DiagDuplicateID,
+				Message:   fmt.Sprintf("id=%s is already used by the directive on line %d", d.ID, prev.Line),
+				Directive: d.ID,
+			})
+		}
+	}
+	return diags
+}
+
+// hashID returns the derived ID for key: 16 hex digits of its SHA-256.
+func hashID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// enclosingFunc returns the name of the function declaration of f that
+// contains pos, as Type.Method for methods, or "" outside any. Function
+// literals count as part of the declaration they appear in.
+func enclosingFunc(f *ast.File, pos token.Pos) string {
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		_ = ok // @inco: ok && fn.Pos() <= pos && pos < fn.End(), -continue
+		if fn.Recv != nil && len(fn.Recv.List) > 0 {
+			return recvTypeName(fn.Recv.List[0].Type) + "." + fn.Name.Name
+		}
+		return fn.Name.Name
+	}
+	return ""
+}
+
+// normalizeExpr returns expr as gofmt prints it, or with its runs of
+// white space collapsed when it does not parse.
+func normalizeExpr(expr string) string {
+	x, err := parser.ParseExpr(expr)
+	_ = err // @inco: err == nil, -return(strings.Join(strings.Fields(expr), " "))
+	var b strings.Builder
+	err = format.Node(&b, token.NewFileSet(), x)
+	_ = err // @inco: err == nil, -return(strings.Join(strings.Fields(expr), " "))
+	return b.String()
+}
+
+// sourceDirectiveIDs parses content, the source file at path, and returns
+// the IDs of its directives by line; none when it does not parse.
+func sourceDirectiveIDs(path string, content []byte) map[int]string {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, content, parser.ParseComments|parser.SkipObjectResolution)
+	_ = err // @inco: err == nil, -return(nil)
+	modDir, modPath := findModule(filepath.Dir(path))
+	return directiveIDs(f, fset, importPath(modDir, modPath, filepath.Dir(path), f.Name.Name))
+}
+
+// importPath returns the import path of the package in dir, part of the
+// module modPath rooted at modDir, or name when dir is in no module.
+func importPath(modDir, modPath, dir, name string) string {
+	// @inco: modPath != "", -return(name)
+	rel, err := filepath.Rel(modDir, dir)
+	_ = err // @inco: err == nil && !strings.HasPrefix(rel, ".."), -return(name)
+	// @inco: rel != ".", -return(modPath)
+	return modPath + "/" + filepath.ToSlash(rel)
+}
@@ -0,0 +1,119 @@
+package inco
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// Directive IDs
+// ---------------------------------------------------------------------------
+
+func testDirectiveIDs(t *testing.T, pkg, src string) map[int]string {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "f.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return directiveIDs(f, fset, pkg)
+}
+
+const idSrc = `package p
+
+func A(x, y int) {
+	// @inco: x > 0
+	// @inco: y > 0, -return
+	// @inco: x > 0
+}
+
+func (t *T) B(x int) {
+	_ = x // @inco: x > 0, id=b-positive
+	// @inco: x > 0
+}
+`
+
+func TestDirectiveIDs_StableAcrossEdits(t *testing.T) {
+	before := testDirectiveIDs(t, "example.com/p", idSrc)
+	// Lines added above, the expressions spaced differently, and actions
+	// changed: the IDs stay.
+	edited := strings.NewReplacer(
+		"package p\n", "package p\n\n// Doc.\n\n",
+		"@inco: x > 0\n\t// @inco: y > 0, -return", "@inco: x>0\n\t// @inco: y  >  0, -panic(\"y\")",
+	).Replace(idSrc)
+	after := testDirectiveIDs(t, "example.com/p", edited)
+	for line, id := range before {
+		if got := after[line+3]; got != id {
+			t.Errorf("ID of the directive on line %d changed from %s to %s", line, id, got)
+		}
+	}
+}
+
+func TestDirectiveIDs_Distinct(t *testing.T) {
+	ids := testDirectiveIDs(t, "example.com/p", idSrc)
+	if ids[10] != "b-positive" {
+		t.Errorf("explicit ID = %q, want b-positive", ids[10])
+	}
+	// The same expression in another function, in the same function
+	// again, and in another package.
+	other := testDirectiveIDs(t, "example.com/q", idSrc)
+	seen := map[string]int{}
+	for _, id := range []string{ids[4], ids[5], ids[6], ids[11], other[4]} {
+		if len(id) != 16 {
+			t.Errorf("derived ID %q, want 16 hex digits", id)
+		}
+		if seen[id]++; seen[id] > 1 {
+			t.Errorf("ID %s is not unique: %v", id, ids)
+		}
+	}
+}
+
+func TestDirectiveIDs_Collision(t *testing.T) {
+	// An explicit ID that equals what B's directive would derive: the
+	// derived one gives way.
+	derived := hashID("example.com/p\x00B\x00x > 0")
+	src := "package p\n\nfunc A(x int) {\n\t// @inco: x > 0, id=" + derived + "\n}\n\nfunc B(x int) {\n\t// @inco: x > 0\n}\n"
+	ids := testDirectiveIDs(t, "example.com/p", src)
+	if ids[4] != derived {
+		t.Errorf("explicit ID = %q, want %q", ids[4], derived)
+	}
+	if ids[8] == derived || len(ids[8]) != 16 {
+		t.Errorf("derived ID %q should differ from the explicit %q", ids[8], derived)
+	}
+}
+
+func TestDirectiveIDs_InPanicMessage(t *testing.T) {
+	src := []byte("package p\n\nfunc F(x int) {\n\t// @inco: x > 0\n}\n")
+	shadow, _, err := GenerateSource("p/f.go", src, GenerateOptions{PackagePath: "example.com/p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := testDirectiveIDs(t, "example.com/p", string(src))[4]
+	if want := `"inco violation [` + id + `]: x > 0 (at p/f.go:4)"`; !strings.Contains(string(shadow), want) {
+		t.Errorf("shadow lacks %s:\n%s", want, shadow)
+	}
+}
+
+func TestDirectiveIDs_DuplicateExplicit(t *testing.T) {
+	src := []byte("package p\n\nfunc F(x, y int) {\n\t// @inco: x > 0, id=positive\n\t// @inco: y > 0, id=positive\n\t// @inco: x < 9, id=small\n}\n")
+	shadow, diags, err := GenerateSource("p/f.go", src, GenerateOptions{PackagePath: "example.com/p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 1 {
+		t.Fatalf("diagnostics = %v, want one duplicate-id warning", diags)
+	}
+	d := diags[0]
+	if d.Code != DiagDuplicateID || d.Severity != SeverityWarning || d.Pos.Line != 5 || d.Directive != "positive" {
+		t.Errorf("diagnostic = %+v, want a duplicate-id warning for line 5", d)
+	}
+	if !strings.Contains(d.Message, "line 4") {
+		t.Errorf("message %q does not name the first directive's line", d.Message)
+	}
+	// The file is still generated, with all its guards.
+	if strings.Count(string(shadow), "if !(") != 3 {
+		t.Errorf("shadow lacks a guard:\n%s", shadow)
+	}
+}
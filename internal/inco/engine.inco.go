@@ -1,23 +1,24 @@
 package inco
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"go/ast"
-	"go/format"
+	"go/build"
 	"go/parser"
 	"go/token"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
-	"sync/atomic"
-
-	"golang.org/x/tools/go/ast/astutil"
+	"time"
 )
 
 // ---------------------------------------------------------------------------
@@ -27,18 +28,104 @@ import (
 // Engine scans Go source files for @inco: directives and produces an
 // overlay that injects the corresponding if-statements at compile time.
 type Engine struct {
-	Root       string
-	Overlay    Overlay
-	importMap  map[string]string // lazily built: package name → import path
-	importOnce sync.Once
+	Root    string
+	Overlay Overlay
+
+	// Trimpath writes module-relative paths (e.g. example.com/m/pkg/f.go)
+	// into //line directives instead of absolute ones, matching what
+	// `go build -trimpath` records. Shadows then do not depend on where the
+	// checkout lives, so released files are byte-identical across machines.
+	Trimpath bool
+
+	// LockTimeout bounds how long Run waits for another process to release
+	// the .inco_cache lock before failing with ErrCacheLocked.
+	LockTimeout time.Duration
+
+	// ShadowGrace keeps shadows that dropped out of the overlay on disk for
+	// at least this long, so that a go command still building from the
+	// previous overlay does not lose its files. Zero removes them as soon
+	// as the new overlay is in place.
+	ShadowGrace time.Duration
+
+	// SharedCache, when set, is a per-user directory (see
+	// DefaultSharedCacheDir) holding content-addressed shadows shared by
+	// every checkout and worktree; the project overlay points into it.
+	// Shadows in it always have module-relative //line paths, as with
+	// Trimpath, since an absolute path would tie them to one checkout.
+	SharedCache string
+
+	// LocalModules also generates the files of modules that live on disk
+	// outside Root: the targets of local replace directives (`replace
+	// example.com/lib => ../lib`) and the modules of the governing go.work.
+	// Their shadows go into Root's overlay, so directives in a library
+	// checked out next to the application are enforced in its builds.
+	LocalModules bool
+
+	// Env, if not nil, is the environment of the go commands the engine
+	// runs and where GOWORK is looked up, in place of the process's (as
+	// with exec.Cmd.Env). A daemon sets it to each client's environment.
+	Env []string
+
+	// KeepGoing commits the overlay for every file that succeeded even when
+	// others failed, instead of leaving the previous overlay in place. The
+	// run still returns a *DiagnosticsError; failed files are left out of
+	// the overlay (so they build without their directives) and retried by
+	// the next run.
+	KeepGoing bool
+
+	// Diagnostics holds every problem found by the last run, ordered by
+	// position: errors for files that could not be generated and warnings
+	// for files that were.
+	Diagnostics []Diagnostic
+
+	// Log receives progress messages such as the summary line; nil means
+	// os.Stderr and io.Discard silences them.
+	Log io.Writer
+
+	// Events, if set, receives an EventStart and then one event per file
+	// the run looks at: cached, regenerated, skipped or failed, with the
+	// reason. It is called from worker goroutines, one call at a time, and
+	// should return quickly.
+	Events func(Event)
+
+	config       string                    // configuration fingerprint of the current run
+	logMu        sync.Mutex                // serializes writes to Log from workers
+	eventMu      sync.Mutex                // serializes calls to Events
+	manifest     *Manifest                 // last manifest written, reused while manifest.json is unchanged
+	manifestAt   fileStamp                 // stamp of manifest.json when manifest was written
+	imports      map[string]*moduleImports // module dir → lazily built import map
+	importsMu    sync.Mutex
+	importMisses sync.Map     // file path → importMiss, for the current run
+	workFile     string       // lazily resolved: governing go.work, if any
+	modules      []moduleInfo // lazily discovered, deepest first
+	modOnce      sync.Once
+	mem          *memSource    // set for in-memory generation (GenerateSource)
+	stamps       sync.Map      // path → srcStamp of sources read by earlier runs
+	decls        sync.Map      // path → FileDecls of sources read for their declarations
+	buildCtxt    build.Context // which files make up a package in the current run
+	scopes       sync.Map      // dir and package name → *pkgScope, for the current run
 }
 
+// srcStamp records the size and modification time a source had when it
+// was read, and its hash, so that a long-lived engine can recognize an
+// unchanged file without reading it again.
+type srcStamp struct {
+	fileStamp
+	hash string
+}
+
+// racyWindow is how recently a source may have been modified for its stamp
+// to be trusted: a file written again within the file system's timestamp
+// granularity could keep its stamp with different content.
+const racyWindow = 2 * time.Second
+
 // NewEngine creates an engine rooted at the given directory.
 func NewEngine(root string) *Engine {
 	// @inco: root != "", -panic("NewEngine: root must not be empty")
 	return &Engine{
-		Root:    root,
-		Overlay: Overlay{Replace: make(map[string]string)},
+		Root:        root,
+		Overlay:     Overlay{Replace: make(map[string]string)},
+		LockTimeout: 2 * time.Minute,
 	}
 }
 
@@ -50,168 +137,550 @@ func NewEngine(root string) *Engine {
 type fileResult struct {
 	Path       string
 	SrcHash    string
-	ShadowPath string
-	ShadowData []byte // nil when reused from cache
-	Cached     bool
+	ShadowPath string     // empty when the file has no directives
+	Decls      string     // siblingDeclHash the shadow was generated against
+	Cached     bool       // true when reused from the manifest
+	Reason     string     // why the file was reused, regenerated or skipped (Reason*)
+	Map        *ShadowMap // line mapping of a newly generated shadow; nil when reused
 }
 
 // Run scans all Go source files under Root, processes @inco: directives,
 // and writes the overlay + shadow files into .inco_cache/.
 //
+// Files that do not mention "@inco:" are never parsed and stay out of the
+// overlay; the manifest still records their hash.
+//
 // Incremental: if a source file's content hash matches the manifest and
 // the shadow file still exists, the file is skipped.
 //
-// File processing is parallelized across available CPUs.
+// File processing is parallelized across available CPUs. Each worker reads
+// a file once, then hashes, parses, generates and writes its shadow from
+// that buffer; only the overlay and manifest are assembled serially.
+//
+// A file that does not parse is passed through untouched with a warning,
+// leaving its syntax errors to the compiler. A file that cannot be read or
+// written does not stop the others: every problem is collected into
+// Diagnostics, and Run returns a *DiagnosticsError listing them (see
+// KeepGoing).
+//
+// Concurrent runs on the same Root are serialized by an advisory lock on
+// .inco_cache (see LockTimeout), and every artifact is written to a
+// temporary file and renamed into place, so readers never observe a
+// partially written overlay, manifest or shadow.
 func (e *Engine) Run() error {
+	return e.RunContext(context.Background())
+}
+
+// RunContext is Run with cancellation. When ctx is done while waiting for
+// the cache lock or generating files, the run stops, leaves the previous
+// overlay and manifest in place and returns ctx.Err().
+func (e *Engine) RunContext(ctx context.Context) error {
 	// @inco: e != nil, -return(fmt.Errorf("Run: nil engine"))
+	e.resetWorkspace()
+	return e.run(ctx, nil, nil)
+}
+
+// RunFiles is the incremental counterpart of Run for callers that already
+// know which files changed, such as a file watcher. Only the given paths
+// are read and regenerated (paths that no longer exist are dropped); every
+// other file is taken from the manifest without touching it. When the
+// engine version or configuration changed since the last run, RunFiles
+// falls back to a full Run.
+func (e *Engine) RunFiles(changed []string) error {
+	// @inco: e != nil, -return(fmt.Errorf("RunFiles: nil engine"))
+	e.resetWorkspace()
+	return e.run(context.Background(), nil, func(m *Manifest) ([]string, []fileResult, error) {
+		// Without a usable manifest the unchanged files are unknown.
+		if len(m.Files) == 0 {
+			paths, err := e.collectGoFiles()
+			return paths, nil, err
+		}
+		paths, known := e.splitChanged(changed, m)
+		return paths, known, nil
+	})
+}
+
+// RunPackages is Run restricted to the packages matching patterns, which
+// are interpreted relative to dir as by `go build`, and to their
+// dependencies (including those of their tests) inside Root. buildFlags
+// are the build's flags that change which files and packages it uses,
+// such as -tags, -mod and -modfile, in go command syntax; their tags also
+// decide which files of a directory the names directives may refer to
+// are looked up in. Only those packages' files are read and regenerated;
+// every other file keeps its manifest entry and shadow untouched, unless
+// the engine version or configuration changed since the last run, which
+// drops them. Without patterns, every file is, as by Run.
+func (e *Engine) RunPackages(dir string, buildFlags, patterns []string) error {
+	// @inco: e != nil, -return(fmt.Errorf("RunPackages: nil engine"))
+	e.resetWorkspace()
+	// @inco: len(patterns) > 0, -return(e.run(context.Background(), buildFlags, nil))
+	dirs, err := e.packageDirs(dir, buildFlags, patterns)
+	_ = err // @inco: err == nil, -return(err)
+	return e.run(context.Background(), buildFlags, func(m *Manifest) ([]string, []fileResult, error) {
+		paths, known := e.splitScope(dirs, m)
+		return paths, known, nil
+	})
+}
+
+// selectFiles chooses the files of a partial run from the previous
+// manifest: the paths to process, and the entries carried over unchanged.
+type selectFiles func(oldManifest *Manifest) (paths []string, known []fileResult, err error)
+
+// run implements RunContext (sel == nil), RunFiles and RunPackages.
+// buildFlags decide, as in RunPackages, which files of a directory make
+// up its package.
+func (e *Engine) run(ctx context.Context, buildFlags []string, sel selectFiles) error {
 	// @inco: e.Root != "", -return(fmt.Errorf("Run: root must not be empty"))
 
+	err := os.MkdirAll(e.cacheDir(), 0o755)
+	_ = err // @inco: err == nil, -return(fmt.Errorf("Run: mkdir: %w", err))
+	unlock, err := e.lockCache(ctx)
+	_ = err // @inco: err == nil, -return(err)
+	defer unlock()
+
+	e.Overlay = Overlay{Replace: make(map[string]string)}
+	e.Diagnostics = nil
 	oldManifest := e.loadManifest()
 	oldOverlay := e.loadOverlayIfExists()
-	paths := collectGoFiles(e.Root)
+	if oldManifest.Version == EngineVersion() {
+		e.seedDecls(oldManifest)
+	}
+	e.buildCtxt = e.buildContext(buildFlags)
+	e.scopes.Clear()
+	config := e.configFingerprint()
+	if e.config != "" && e.config != config {
+		// go.mod/go.sum changed under a long-lived engine.
+		e.imports = nil
+	}
+	e.revalidateImports()
+	e.config = config
+	newManifest := &Manifest{
+		Version: EngineVersion(),
+		Config:  e.config,
+		Files:   make(map[string]ManifestEntry),
+	}
+	// Shadows from another inco build or configuration cannot be reused.
+	fresh := ReasonNew
+	switch {
+	case len(oldManifest.Files) == 0:
+	case oldManifest.Version != newManifest.Version:
+		fresh = ReasonVersion
+	case oldManifest.Config != newManifest.Config:
+		fresh = ReasonConfig
+	}
+	if fresh != ReasonNew {
+		oldManifest.Files = make(map[string]ManifestEntry)
+	}
 
-	// Process files concurrently.
+	var paths []string
+	var known []fileResult
+	if sel == nil {
+		paths, err = e.collectGoFiles()
+	} else {
+		paths, known, err = sel(oldManifest)
+	}
+	_ = err // @inco: err == nil, -return(fmt.Errorf("Run: %w", err))
+
+	results, diags := e.processAll(ctx, paths, oldManifest, fresh)
+	if err := ctx.Err(); err != nil {
+		e.discardRun(oldOverlay)
+		return err
+	}
+	e.flushImports()
+	sortDiagnostics(diags)
+	e.Diagnostics = diags
+	failed := hasErrors(diags)
+	if failed && !e.KeepGoing {
+		e.discardRun(oldOverlay)
+		return &DiagnosticsError{Diagnostics: diags}
+	}
+	err = e.commitResults(append(results, known...), oldOverlay, newManifest)
+	_ = err // @inco: err == nil, -return(err)
+	// @inco: !failed, -return(&DiagnosticsError{Diagnostics: diags})
+	return nil
+}
+
+// splitChanged partitions the files of an incremental run: changed files
+// that still exist and that a full walk would visit (plus any whose shadow
+// has gone missing, and the shadowed files of the changed files' packages,
+// whose imports depend on their declarations) are returned for processing,
+// and every other manifest entry is carried over as a cached result.
+func (e *Engine) splitChanged(changed []string, oldManifest *Manifest) ([]string, []fileResult) {
+	isChanged := make(map[string]bool, len(changed))
+	changedDirs := make(map[string]bool)
+	var paths []string
+	for _, p := range changed {
+		// @inco: !isChanged[p], -continue
+		isChanged[p] = true
+		changedDirs[filepath.Dir(p)] = true
+		if _, err := os.Stat(p); err == nil && e.isWalkedGoFile(p) {
+			paths = append(paths, p)
+		}
+	}
+	var known []fileResult
+	for p, entry := range oldManifest.Files {
+		// @inco: !isChanged[p], -continue
+		if entry.ShadowPath != "" && !e.shadowExists(entry.ShadowPath) {
+			paths = append(paths, p)
+			continue
+		}
+		if entry.ShadowPath != "" && changedDirs[filepath.Dir(p)] {
+			if _, err := os.Stat(p); err == nil {
+				paths = append(paths, p)
+				continue
+			}
+		}
+		known = append(known, fileResult{Path: p, SrcHash: entry.SrcHash, ShadowPath: entry.ShadowPath, Decls: entry.Decls, Cached: true})
+	}
+	return paths, known
+}
+
+// splitScope partitions the files of a package-scoped run: the files a
+// full walk would visit in the package directories dirs are returned for
+// processing, and manifest entries outside dirs are carried over (entries
+// inside dirs whose file is gone are dropped).
+func (e *Engine) splitScope(dirs map[string]bool, oldManifest *Manifest) ([]string, []fileResult) {
+	var paths []string
+	for dir := range dirs {
+		entries, _ := os.ReadDir(dir)
+		for _, ent := range entries {
+			p := filepath.Join(dir, ent.Name())
+			if !ent.IsDir() && e.isWalkedGoFile(p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	sort.Strings(paths)
+	var known []fileResult
+	for p, entry := range oldManifest.Files {
+		// @inco: !dirs[filepath.Dir(p)], -continue
+		if entry.ShadowPath != "" && !e.shadowExists(entry.ShadowPath) {
+			paths = append(paths, p)
+			continue
+		}
+		known = append(known, fileResult{Path: p, SrcHash: entry.SrcHash, ShadowPath: entry.ShadowPath, Decls: entry.Decls, Cached: true})
+	}
+	return paths, known
+}
+
+// unchanged reports whether the source at path, now with stamp, still has
+// hash according to what an earlier run of this engine read.
+func (e *Engine) unchanged(path string, stamp fileStamp, hash string) bool {
+	v, ok := e.stamps.Load(path)
+	_ = ok // @inco: ok, -return(false)
+	prev := v.(srcStamp)
+	return prev.hash == hash && prev.size == stamp.size && prev.modTime.Equal(stamp.modTime)
+}
+
+// goCommand returns the go command with args, run in dir and in the
+// engine's environment.
+func (e *Engine) goCommand(dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command(goBinary(e.Env), args...)
+	cmd.Dir = dir
+	cmd.Env = e.Env
+	return cmd
+}
+
+// getenv returns the value of key in the engine's environment.
+func (e *Engine) getenv(key string) string {
+	// @inco: e.Env != nil, -return(os.Getenv(key))
+	return envValue(e.Env, key)
+}
+
+// envValue returns the value of key in env, a list of KEY=value pairs in
+// which the last occurrence wins.
+func envValue(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if v, ok := strings.CutPrefix(env[i], key+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// goBinary returns the go command to run in env (as by exec.Cmd.Env). With
+// a nil env it is "go", looked up on this process's PATH; otherwise the go
+// command is looked up on env's PATH, so that a daemon serving a client
+// runs the client's toolchain rather than its own.
+func goBinary(env []string) string {
+	// @inco: env != nil, -return("go")
+	for _, dir := range filepath.SplitList(envValue(env, "PATH")) {
+		// @inco: dir != "", -continue
+		path := filepath.Join(dir, "go")
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() && fi.Mode()&0o111 != 0 {
+			return path
+		}
+	}
+	return "go"
+}
+
+// collectGoFiles returns the files a full run processes: those under each
+// of the engine's walk roots.
+func (e *Engine) collectGoFiles() ([]string, error) {
+	var paths []string
+	for _, root := range e.walkRoots() {
+		p, err := collectGoFiles(root)
+		_ = err // @inco: err == nil, -return(nil, err)
+		paths = append(paths, p...)
+	}
+	return paths, nil
+}
+
+// isWalkedGoFile reports whether a full run would process path.
+func (e *Engine) isWalkedGoFile(path string) bool {
+	root := e.walkRootOf(path)
+	return root != "" && isWalkedGoFile(root, path)
+}
+
+// packageDirs returns the directories inside the walk roots (see
+// LocalModules) of the packages matching patterns (relative to dir) and of
+// all their dependencies, as reported by go list with buildFlags. Test
+// dependencies are included so that `inco test` is covered.
+func (e *Engine) packageDirs(dir string, buildFlags, patterns []string) (map[string]bool, error) {
+	args := append([]string{"list", "-e", "-deps", "-test", "-f", "{{if not .Standard}}{{.Dir}}{{end}}"}, buildFlags...)
+	args = append(args, patterns...)
+	cmd := e.goCommand(dir, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	_ = err // @inco: err == nil, -return(nil, fmt.Errorf("go list %s: %v: %s", strings.Join(patterns, " "), err, bytes.TrimSpace(stderr.Bytes())))
+
+	dirs := make(map[string]bool)
+	for _, d := range strings.Split(string(out), "\n") {
+		// @inco: d != "", -continue
+		// @inco: e.walkRootOf(d) != "", -continue
+		dirs[d] = true
+	}
+	return dirs, nil
+}
+
+// processAll runs processFile over paths in parallel. Every file is
+// processed even when others fail; it returns the results of the files
+// that succeeded, in path order, and the diagnostics of all of them.
+func (e *Engine) processAll(ctx context.Context, paths []string, oldManifest *Manifest, fresh string) ([]fileResult, []Diagnostic) {
 	results := make([]fileResult, len(paths))
+	diags := make([][]Diagnostic, len(paths))
 	workers := runtime.GOMAXPROCS(0)
 	if workers > len(paths) {
 		workers = len(paths)
 	}
 
 	var wg sync.WaitGroup
-	var workerErr atomic.Value // stores first error from a worker
 	ch := make(chan int, len(paths))
 	for i := range paths {
 		ch <- i
 	}
 	close(ch)
 
+	e.emit(Event{Kind: EventStart, Total: len(paths)})
 	for w := 0; w < workers; w++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			defer func() {
-				if r := recover(); r != nil {
-					workerErr.CompareAndSwap(nil, fmt.Errorf("%v", r))
-				}
-			}()
 			// Each goroutine gets its own fset to avoid contention.
 			fset := token.NewFileSet()
 			for idx := range ch {
-				path := paths[idx]
-				srcHash, err := hashFile(path)
-				if err != nil {
-					workerErr.CompareAndSwap(nil, err)
-					return
-				}
-
-				// Check cache: source unchanged & shadow file exists → reuse.
-				if prev, ok := oldManifest.Files[path]; ok && prev.SrcHash == srcHash {
-					if _, err := os.Stat(prev.ShadowPath); err == nil {
-						results[idx] = fileResult{
-							Path: path, SrcHash: srcHash,
-							ShadowPath: prev.ShadowPath, Cached: true,
-						}
-						continue
-					}
-				}
-
-				// Cache miss — remove stale shadow before generating new one.
-				if old, ok := oldOverlay[path]; ok {
-					os.Remove(old)
-				}
-
-				// Parse and process.
-				f, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
-				if err != nil {
-					workerErr.CompareAndSwap(nil, fmt.Errorf("parse %s: %w", path, err))
-					return
-				}
-				shadowData := e.generateShadow(path, f, fset)
-				results[idx] = fileResult{
-					Path: path, SrcHash: srcHash,
-					ShadowData: shadowData,
-				}
+				// @inco: ctx.Err() == nil, -return
+				results[idx], diags[idx] = e.processFile(paths[idx], fset, oldManifest, fresh)
+				e.emit(fileEvent(paths[idx], results[idx], diags[idx]))
 			}
 		}()
 	}
 	wg.Wait()
+	// A file whose directives named a package before another file of this
+	// run brought it into the import map is generated again.
+	for i, p := range paths {
+		if e.missedImport(p) && ctx.Err() == nil {
+			results[i], diags[i] = e.processFile(p, token.NewFileSet(), oldManifest, fresh)
+		}
+	}
+
+	var ok []fileResult
+	var all []Diagnostic
+	for i := range paths {
+		all = append(all, diags[i]...)
+		// @inco: !hasErrors(diags[i]), -continue
+		ok = append(ok, results[i])
+	}
+	return ok, all
+}
+
+// processFile runs the whole pipeline for one source file: read, hash,
+// cache lookup, pre-scan, parse, generate and write the shadow. The file
+// is read exactly once. It is safe to call from multiple goroutines as
+// long as each caller passes its own fset. Problems are returned as
+// diagnostics; a panic becomes a DiagInternal error for the file.
+func (e *Engine) processFile(path string, fset *token.FileSet, oldManifest *Manifest, fresh string) (r fileResult, diags []Diagnostic) {
+	defer func() {
+		if p := recover(); p != nil {
+			r, diags = fileResult{}, fileError(path, DiagInternal, fmt.Errorf("%v", p))
+		}
+	}()
+	stamp, statOK := statStamp(path)
+	if prev, ok := oldManifest.Files[path]; ok && statOK && e.unchanged(path, stamp, prev.SrcHash) {
+		if prev.ShadowPath == "" || e.shadowExists(prev.ShadowPath) && e.siblingDeclHash(path) == prev.Decls {
+			return cachedResult(path, prev), nil
+		}
+	}
+	src, err := os.ReadFile(path)
+	_ = err // @inco: err == nil, -return(fileResult{}, fileError(path, DiagRead, err))
+	srcHash := hashBytes(src)
+	if statOK && time.Since(stamp.modTime) > racyWindow {
+		e.stamps.Store(path, srcStamp{stamp, srcHash})
+	}
+
+	// Check cache: source and the declarations of its package's other
+	// files unchanged & shadow file (if any) exists → reuse. fresh explains
+	// files the manifest does not know.
+	reason := fresh
+	if prev, ok := oldManifest.Files[path]; ok {
+		reason = ReasonChanged
+		if prev.SrcHash == srcHash {
+			switch {
+			case prev.ShadowPath == "":
+				return cachedResult(path, prev), nil
+			case !e.shadowExists(prev.ShadowPath):
+				reason = ReasonShadowMissing
+			case e.siblingDeclHash(path) != prev.Decls:
+				reason = ReasonPackageChanged
+			default:
+				return cachedResult(path, prev), nil
+			}
+		}
+	}
 
-	if v := workerErr.Load(); v != nil {
-		return v.(error)
+	// Pre-scan: without the marker there is nothing to inject, so skip
+	// parsing and leave the file out of the overlay.
+	hasMarker := bytes.Contains(src, directiveMarker)
+	_ = hasMarker // @inco: hasMarker, -return(fileResult{Path: path, SrcHash: srcHash, Reason: ReasonNoDirectives}, nil)
+	e.noteImports(path, src, fset)
+	decls := e.siblingDeclHash(path)
+
+	// Shared cache: another checkout may already have generated it.
+	var sharedPath string
+	if e.SharedCache != "" {
+		sharedPath = e.sharedShadowPath(path, srcHash, decls)
+		if markUsed(sharedPath) {
+			return fileResult{Path: path, SrcHash: srcHash, ShadowPath: sharedPath, Decls: decls, Cached: true, Reason: ReasonSharedCache}, nil
+		}
 	}
 
-	return e.commitResults(results, oldOverlay)
+	// A file that does not parse stays out of the overlay, so that go
+	// build reports its syntax errors at the original positions.
+	f, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	_ = err // @inco: err == nil, -return(fileResult{Path: path, SrcHash: srcHash, Reason: ReasonDoesNotParse}, parseWarning(path, err))
+	content, directives, diags := e.generateShadow(path, src, f, fset)
+	if sharedPath != "" {
+		err = os.MkdirAll(filepath.Dir(sharedPath), 0o755)
+		_ = err // @inco: err == nil, -return(fileResult{}, fileError(path, DiagWrite, fmt.Errorf("shared cache: %w", err)))
+		err = writeFileAtomic(sharedPath, content)
+		_ = err // @inco: err == nil, -return(fileResult{}, fileError(path, DiagWrite, fmt.Errorf("shared cache: %w", err)))
+		m := shadowMapOf(newShadowLines(sharedPath, content, src), path, directives)
+		return fileResult{Path: path, SrcHash: srcHash, ShadowPath: sharedPath, Decls: decls, Reason: reason, Map: &m}, diags
+	}
+	shadowPath, err := e.writeShadow(path, content)
+	_ = err // @inco: err == nil, -return(fileResult{}, fileError(path, DiagWrite, err))
+	m := shadowMapOf(newShadowLines(shadowPath, content, src), path, directives)
+	return fileResult{Path: path, SrcHash: srcHash, ShadowPath: shadowPath, Decls: decls, Reason: reason, Map: &m}, diags
+}
+
+// cachedResult is the result of reusing the manifest entry prev for path.
+func cachedResult(path string, prev ManifestEntry) fileResult {
+	return fileResult{Path: path, SrcHash: prev.SrcHash, ShadowPath: prev.ShadowPath, Decls: prev.Decls, Cached: true, Reason: ReasonUnchanged}
 }
 
-// commitResults writes shadow files, builds overlay & manifest, and
-// cleans up stale shadows for deleted source files.
-func (e *Engine) commitResults(results []fileResult, oldOverlay map[string]string) error {
-	newManifest := &Manifest{Files: make(map[string]ManifestEntry)}
+// shadowExists reports whether a previously generated shadow is still on
+// disk, marking it used when it lives in the shared cache.
+func (e *Engine) shadowExists(shadowPath string) bool {
+	// @inco: !e.isShared(shadowPath), -return(markUsed(shadowPath))
+	_, err := os.Stat(shadowPath)
+	return err == nil
+}
+
+// commitResults builds the overlay & fills newManifest from the per-file
+// results, writes them and the source map, and only then prunes shadows
+// that are no longer mapped (source deleted, changed, or its directives
+// removed).
+func (e *Engine) commitResults(results []fileResult, oldOverlay map[string]string, newManifest *Manifest) error {
 	var skipped int
 	for _, r := range results {
+		// Files without directives are recorded too (hash only) so that
+		// later edits are detected.
+		newManifest.Files[r.Path] = ManifestEntry{SrcHash: r.SrcHash, ShadowPath: r.ShadowPath, Decls: r.Decls, Declares: e.recordedDecls(r.Path)}
+		// @inco: r.ShadowPath != "", -continue
+		e.Overlay.Replace[r.Path] = r.ShadowPath
 		if r.Cached {
-			e.Overlay.Replace[r.Path] = r.ShadowPath
-			newManifest.Files[r.Path] = ManifestEntry{SrcHash: r.SrcHash, ShadowPath: r.ShadowPath}
 			skipped++
-		} else {
-			err := e.writeShadow(r.Path, r.ShadowData)
-			_ = err // @inco: err == nil, -return(err)
-			if sp, ok := e.Overlay.Replace[r.Path]; ok {
-				newManifest.Files[r.Path] = ManifestEntry{SrcHash: r.SrcHash, ShadowPath: sp}
-			}
-		}
-	}
-
-	// Clean up shadows for source files that no longer exist.
-	for srcPath, shadowPath := range oldOverlay {
-		if _, ok := newManifest.Files[srcPath]; !ok {
-			os.Remove(shadowPath)
 		}
 	}
 
 	err := e.writeOverlay()
 	_ = err // @inco: err == nil, -return(err)
+	err = e.writeSourceMap(results)
+	_ = err // @inco: err == nil, -return(err)
 	err = e.writeManifest(newManifest)
 	_ = err // @inco: err == nil, -return(err)
+	e.pruneShadows(oldOverlay)
 
 	if len(e.Overlay.Replace) > 0 {
 		processed := len(e.Overlay.Replace) - skipped
-		fmt.Fprintf(os.Stderr, "inco: overlay written to %s (%d file(s) mapped, %d processed, %d cached)\n",
+		e.logf("inco: overlay written to %s (%d file(s) mapped, %d processed, %d cached)\n",
 			filepath.Join(e.Root, ".inco_cache", "overlay.json"),
 			len(e.Overlay.Replace), processed, skipped)
 	}
 	return nil
 }
 
+// logf prints a progress message to e.Log, or to stderr when unset.
+func (e *Engine) logf(format string, args ...any) {
+	e.logMu.Lock()
+	defer e.logMu.Unlock()
+	fmt.Fprintf(logWriter(e.Log), format, args...)
+}
+
+// logWriter returns w, or os.Stderr when w is nil.
+func logWriter(w io.Writer) io.Writer {
+	if w == nil {
+		return os.Stderr
+	}
+	return w
+}
+
 // ---------------------------------------------------------------------------
 // File processing
 // ---------------------------------------------------------------------------
 
-// generateShadow produces the shadow file content for a source file.
-// It is safe to call from multiple goroutines — it only reads e.Root
-// and uses the provided fset.
-func (e *Engine) generateShadow(path string, f *ast.File, fset *token.FileSet) []byte {
+// generateShadow produces the shadow file content for a source file from
+// its already-read content src and parsed AST f. It is safe to call from
+// multiple goroutines — it only reads e.Root and uses the provided fset.
+// It also returns the directives of src by line, and diagnostics that
+// warn about the generated content.
+func (e *Engine) generateShadow(path string, src []byte, f *ast.File, fset *token.FileSet) ([]byte, map[int]directiveCol, []Diagnostic) {
 	// @inco: path != "", -panic("generateShadow: empty path")
 	// @inco: f != nil, -panic("generateShadow: nil AST")
 	// 1. Collect directive lines from AST comments.
 	directives := make(map[int]*Directive) // 1-based line → Directive
+	columns := make(map[int]int)           // 1-based line → comment column
 	for _, cg := range f.Comments {
 		for _, c := range cg.List {
 			d := ParseDirective(c.Text)
 			_ = d // @inco: d != nil, -continue
-			line := fset.Position(c.Pos()).Line
-			directives[line] = d
+			// Lines of src, not those named by //line comments in it.
+			pos := fset.PositionFor(c.Pos(), false)
+			directives[pos.Line] = d
+			columns[pos.Line] = pos.Column
 		}
 	}
 
-	// 2. Read source as lines.
-	src, err := os.ReadFile(path)
-	_ = err // @inco: err == nil, -panic(err)
+	ids := directiveIDs(f, fset, e.packagePath(path, f))
+
+	// 2. Split source into lines.
 	lines := strings.Split(string(src), "\n")
 
 	// 3. Classify directives as standalone or inline using AST.
 	standalone := make(map[int]*Directive)
 	inline := make(map[int]*Directive)
+	found := make(map[int]directiveCol, len(directives))
 
 	stmtLines := collectStmtLines(f, fset)
 	for lineNum, d := range directives {
@@ -219,6 +688,7 @@ func (e *Engine) generateShadow(path string, f *ast.File, fset *token.FileSet) [
 		// @inco: idx >= 0 && idx < len(lines), -continue
 		trimmed := strings.TrimSpace(lines[idx])
 		isCommentLine := strings.HasPrefix(trimmed, "//") || strings.HasPrefix(trimmed, "/*")
+		found[lineNum] = directiveCol{col: columns[lineNum], standalone: isCommentLine, d: d, id: ids[lineNum]}
 		if isCommentLine {
 			standalone[lineNum] = d
 		} else if stmtLines[lineNum] {
@@ -235,17 +705,21 @@ func (e *Engine) generateShadow(path string, f *ast.File, fset *token.FileSet) [
 
 		if d, ok := standalone[lineNum]; ok {
 			indent := extractIndent(line)
-			output = append(output, fmt.Sprintf("//line %s:%d", path, lineNum))
-			output = append(output, e.generateIfBlock(d, indent, path, lineNum))
+			output = append(output, e.generateIfBlock(d, ids[lineNum], indent, path, lineNum, columns[lineNum]))
 			prevWasDirective = true
 		} else if d, ok := inline[lineNum]; ok {
+			if prevWasDirective {
+				// The statement is the user's code: resume the source's
+				// numbering after the guard before it.
+				output = append(output, lineDirective(e.linePath(path), lineNum, 1))
+			}
 			output = append(output, line)
 			indent := extractIndent(line)
-			output = append(output, e.generateIfBlock(d, indent, path, lineNum))
+			output = append(output, e.generateIfBlock(d, ids[lineNum], indent, path, lineNum, columns[lineNum]))
 			prevWasDirective = true
 		} else {
 			if prevWasDirective {
-				output = append(output, fmt.Sprintf("//line %s:%d", path, lineNum))
+				output = append(output, lineDirective(e.linePath(path), lineNum, 1))
 				prevWasDirective = false
 			}
 			output = append(output, line)
@@ -254,24 +728,103 @@ func (e *Engine) generateShadow(path string, f *ast.File, fset *token.FileSet) [
 
 	// 5. Add missing imports.
 	content := strings.Join(output, "\n")
-	content = e.addMissingImports(content, f, directives)
+	content, diags := e.addMissingImports(path, content, f, fset, directives, columns, ids)
+	diags = append(duplicateIDs(f, fset), diags...)
 
-	return []byte(content)
+	return []byte(content), found, diags
 }
 
 // ---------------------------------------------------------------------------
 // Code generation
 // ---------------------------------------------------------------------------
 
-// generateIfBlock returns the text of the injected if-statement.
+// generateIfBlock returns the text of the injected if-statement, preceded
+// by a //line directive that maps it onto the directive comment. id is the
+// directive's ID and col the 1-based column of the comment. The //line
+// column is chosen so that the expression inside "!(...)" lands on its
+// text in the comment, and a /*line*/ marker does the same for the action.
 //
-//	if !(expr) {
-//	    panic(...)
-//	}
-func (e *Engine) generateIfBlock(d *Directive, indent, path string, line int) string {
+//	//line file.go:12:5
+//	    if !(expr) {
+//	        /*line file.go:12:20*/panic(...)
+//	    }
+func (e *Engine) generateIfBlock(d *Directive, id, indent, path string, line, col int) string {
+	exprCol := col + d.ExprOffset
+	actionCol := exprCol
+	if d.ActionOffset > 0 {
+		actionCol = col + d.ActionOffset
+	}
+	// The //line column applies to the first character of the next line,
+	// i.e. the indent that precedes "if !(".
+	startCol := exprCol - len(indent) - len("if !(")
+	if startCol < 1 {
+		startCol = 1
+	}
+	linePath := e.linePath(path)
 	cond := fmt.Sprintf("!(%s)", d.Expr)
-	body := e.buildPanicBody(d, path, line)
-	return fmt.Sprintf("%sif %s {\n%s\t%s\n%s}", indent, cond, indent, body, indent)
+	body := lineMarker(linePath, line, actionCol) + e.buildPanicBody(d, id, path, line)
+	return fmt.Sprintf("%s\n%sif %s {\n%s\t%s\n%s}",
+		lineDirective(linePath, line, startCol), indent, cond, indent, body, indent)
+}
+
+// linePath returns the file name recorded in //line directives for path.
+// With Trimpath set it is the module path joined with the slash-separated
+// path relative to the module root, falling back to the path relative to
+// Root when no go.mod is found.
+func (e *Engine) linePath(path string) string {
+	// @inco: e.mem == nil, -return(e.mem.linePath)
+	// @inco: e.trimpath(), -return(path)
+	if mod := e.moduleOf(path); mod.Path != "" {
+		if rel, err := filepath.Rel(mod.Dir, path); err == nil {
+			return mod.Path + "/" + filepath.ToSlash(rel)
+		}
+	}
+	rel, err := filepath.Rel(e.Root, path)
+	_ = err // @inco: err == nil, -return(path)
+	return filepath.ToSlash(rel)
+}
+
+// packagePath returns the import path of the package of the file at
+// path, whose syntax tree is f, for directive IDs.
+func (e *Engine) packagePath(path string, f *ast.File) string {
+	// @inco: e.mem == nil, -return(e.mem.pkgPath)
+	mod := e.moduleOf(path)
+	return importPath(mod.Dir, mod.Path, filepath.Dir(path), f.Name.Name)
+}
+
+// trimpath reports whether //line directives get module-relative paths:
+// with Trimpath, and with the shared cache, whose shadows must not depend
+// on where the checkout lives.
+func (e *Engine) trimpath() bool {
+	return e.Trimpath || e.SharedCache != ""
+}
+
+// messagePath returns the name of the file at path in default panic
+// messages: slash-separated and relative to its module root, as
+// toolexec's compileShadow names it too, or to Root outside any module.
+// GenerateSource is given that name already.
+func (e *Engine) messagePath(path string) string {
+	base := e.Root
+	if e.mem == nil {
+		if mod := e.moduleOf(path); mod.Path != "" {
+			base = mod.Dir
+		}
+	}
+	rel, err := filepath.Rel(base, path)
+	_ = err // @inco: err == nil, -return(filepath.ToSlash(path))
+	return filepath.ToSlash(rel)
+}
+
+// lineDirective returns a //line comment that positions the next line at
+// path:line:col. It must be emitted at column 1.
+func lineDirective(path string, line, col int) string {
+	return fmt.Sprintf("//line %s:%d:%d", path, line, col)
+}
+
+// lineMarker returns an inline /*line*/ comment that positions the
+// character immediately following it at path:line:col.
+func lineMarker(path string, line, col int) string {
+	return fmt.Sprintf("/*line %s:%d:%d*/", path, line, col)
 }
 
 // buildPanicBody generates the action statement for @inco:.
@@ -281,9 +834,10 @@ func (e *Engine) generateIfBlock(d *Directive, indent, path string, line int) st
 //   - ActionContinue      → continue
 //   - ActionDo + args     → args[0]; args[1]; ...
 //   - ActionBreak         → break
+//   - ActionLog + args    → log.Println(args...)
 //   - ActionPanic + args  → panic(arg)
-//   - ActionPanic default → panic("inco violation: <expr> (at file:line)")
-func (e *Engine) buildPanicBody(d *Directive, path string, line int) string {
+//   - ActionPanic default → panic("inco violation [<id>]: <expr> (at file:line)")
+func (e *Engine) buildPanicBody(d *Directive, id, path string, line int) string {
 	switch d.Action {
 	case ActionReturn:
 		if len(d.ActionArgs) > 0 {
@@ -302,162 +856,94 @@ func (e *Engine) buildPanicBody(d *Directive, path string, line int) string {
 		if len(d.ActionArgs) > 0 {
 			return "panic(" + d.ActionArgs[0] + ")"
 		}
-		relPath := path
-		if rel, err := filepath.Rel(e.Root, path); err == nil {
-			relPath = rel
-		}
-		msg := fmt.Sprintf("inco violation: %s (at %s:%d)", d.Expr, relPath, line)
+		msg := fmt.Sprintf("inco violation [%s]: %s (at %s:%d)", id, d.Expr, e.messagePath(path), line)
 		return fmt.Sprintf("panic(%q)", msg)
 	}
 }
 
 // ---------------------------------------------------------------------------
-// Import management
+// Shadow & overlay I/O
 // ---------------------------------------------------------------------------
 
-// buildImportMap dynamically resolves package names to import paths by
-// querying the Go toolchain. The result is cached for the engine's lifetime
-// so that "go list" runs at most once per invocation.
-func (e *Engine) buildImportMap() map[string]string {
-	e.importOnce.Do(func() {
-		e.importMap = make(map[string]string)
-		ambiguous := make(map[string]bool)
-
-		// 1. All standard library packages.
-		e.collectPackages(ambiguous, "-e", "std")
-
-		// 2. Packages already used in the module (covers third-party deps).
-		e.collectPackages(ambiguous, "-e", "-deps", "./...")
+// writeShadow writes content to a content-addressed file in .inco_cache
+// and returns its path. The cache directory must already exist. Safe for
+// concurrent use.
+func (e *Engine) writeShadow(origPath string, content []byte) (string, error) {
+	hash := sha256.Sum256(content)
+	shadowName := fmt.Sprintf("%s_%x.go",
+		strings.TrimSuffix(filepath.Base(origPath), ".go"),
+		hash[:8])
+	shadowPath := filepath.Join(e.cacheDir(), shadowName)
 
-		// Remove ambiguous names (multiple import paths share a short name,
-		// e.g. "template" → text/template vs html/template).
-		for name := range ambiguous {
-			delete(e.importMap, name)
-		}
-	})
-	return e.importMap
+	err := writeFileAtomic(shadowPath, content)
+	_ = err // @inco: err == nil, -return("", fmt.Errorf("writeShadow: write: %w", err))
+	return shadowPath, nil
 }
 
-// collectPackages runs "go list" with the given patterns and records
-// each name → importPath pair in e.importMap.
-func (e *Engine) collectPackages(ambiguous map[string]bool, patterns ...string) {
-	args := append([]string{"list", "-f", "{{.Name}} {{.ImportPath}}"}, patterns...)
-	cmd := exec.Command("go", args...)
-	cmd.Dir = e.Root
-	out, err := cmd.Output()
-	_ = err // @inco: err == nil, -return
-	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
-		// @inco: line != "", -continue
-		parts := strings.SplitN(line, " ", 2)
-		valid := len(parts) == 2 && parts[0] != "" && parts[0] != "main"
-		_ = valid // @inco: valid, -continue
-		name, impPath := parts[0], parts[1]
-		// Skip internal and vendored packages — they are not freely importable.
-		internal := internalPkgRe.MatchString(impPath)
-		_ = internal // @inco: !internal, -continue
-		if existing, ok := e.importMap[name]; ok && existing != impPath {
-			ambiguous[name] = true
-		} else if !ambiguous[name] {
-			e.importMap[name] = impPath
-		}
-	}
+// cacheDir returns the .inco_cache directory under Root.
+func (e *Engine) cacheDir() string {
+	return filepath.Join(e.Root, ".inco_cache")
 }
 
-// pkgRefRe matches package-qualified identifiers like fmt.Errorf, errors.New.
-var pkgRefRe = regexp.MustCompile(`\b([a-zA-Z_]\w*)\.\w+`)
-
-// internalPkgRe matches import paths that are internal or vendored.
-var internalPkgRe = regexp.MustCompile(`(^|/)internal/|(^|/)vendor/`)
+func (e *Engine) writeOverlay() error {
+	data, err := json.MarshalIndent(e.Overlay, "", "  ")
+	_ = err // @inco: err == nil, -return(fmt.Errorf("writeOverlay: marshal: %w", err))
+	err = writeFileAtomic(filepath.Join(e.cacheDir(), "overlay.json"), data)
+	_ = err // @inco: err == nil, -return(fmt.Errorf("writeOverlay: write: %w", err))
+	return nil
+}
 
-// addMissingImports re-parses the shadow content, detects package references
-// in directive action args, and adds missing imports via astutil.AddImport.
-func (e *Engine) addMissingImports(content string, origFile *ast.File, directives map[int]*Directive) string {
-	// 1. Collect all package-qualified identifiers from directives.
-	needed := make(map[string]bool)
-	for _, d := range directives {
-		sources := d.ActionArgs
-		if d.Expr != "" {
-			sources = append(sources, d.Expr)
-		}
-		for _, s := range sources {
-			for _, match := range pkgRefRe.FindAllStringSubmatch(s, -1) {
-				needed[match[1]] = true
-			}
-		}
+// pruneShadows removes shadows from oldOverlay that the new overlay no
+// longer references, and any other shadow in .inco_cache that neither
+// references, such as those written by a run that failed. With
+// ShadowGrace set, a retired shadow is instead stamped with the time it
+// was retired, and unreferenced shadows are removed once their stamp is
+// older than the grace period.
+func (e *Engine) pruneShadows(oldOverlay map[string]string) {
+	live := make(map[string]bool, len(e.Overlay.Replace))
+	for _, sp := range e.Overlay.Replace {
+		live[sp] = true
 	}
-	// @inco: len(needed) > 0, -return(content)
-
-	// 2. Determine which packages are already imported.
-	imported := make(map[string]bool)
-	for _, imp := range origFile.Imports {
-		path := strings.Trim(imp.Path.Value, `"`)
-		// Use local name if aliased, otherwise last segment.
-		var name string
-		if imp.Name != nil {
-			name = imp.Name.Name
-		} else {
-			parts := strings.Split(path, "/")
-			name = parts[len(parts)-1]
+	now := time.Now()
+	retired := make(map[string]bool)
+	for _, sp := range oldOverlay {
+		// @inco: !live[sp] && !e.isShared(sp), -continue
+		if e.ShadowGrace <= 0 {
+			os.Remove(sp)
+			continue
 		}
-		imported[name] = true
+		os.Chtimes(sp, now, now)
+		retired[sp] = true
 	}
+	e.sweepShadows(live, retired, now)
+}
 
-	// 3. Find which needed packages are missing.
-	importMap := e.buildImportMap()
-	var toAdd []string
-	for pkg := range needed {
-		// @inco: !imported[pkg], -continue
-		if _, ok := importMap[pkg]; ok {
-			toAdd = append(toAdd, pkg)
+// sweepShadows removes the shadows in .inco_cache that are neither live
+// nor retired, right away or, with ShadowGrace set, once they are older
+// than the grace period.
+func (e *Engine) sweepShadows(live, retired map[string]bool, now time.Time) {
+	entries, err := os.ReadDir(e.cacheDir())
+	_ = err // @inco: err == nil, -return
+	for _, ent := range entries {
+		sp := filepath.Join(e.cacheDir(), ent.Name())
+		isShadow := !ent.IsDir() && strings.HasSuffix(ent.Name(), ".go")
+		_ = isShadow // @inco: isShadow && !live[sp] && !retired[sp], -continue
+		info, err := ent.Info()
+		_ = err // @inco: err == nil, -continue
+		if e.ShadowGrace <= 0 || now.Sub(info.ModTime()) > e.ShadowGrace {
+			os.Remove(sp)
 		}
 	}
-	// @inco: len(toAdd) > 0, -return(content)
-
-	// 4. Re-parse the shadow content and add imports via astutil.
-	fset := token.NewFileSet()
-	shadowAST, err := parser.ParseFile(fset, "", content, parser.ParseComments)
-	_ = err // @inco: err == nil, -return(content)
-	for _, pkg := range toAdd {
-		astutil.AddImport(fset, shadowAST, importMap[pkg])
-	}
-
-	// 5. Re-render.
-	var buf strings.Builder
-	err = format.Node(&buf, fset, shadowAST)
-	_ = err // @inco: err == nil, -return(content)
-	return buf.String()
 }
 
-// ---------------------------------------------------------------------------
-// Shadow & overlay I/O
-// ---------------------------------------------------------------------------
-
-func (e *Engine) writeShadow(origPath string, content []byte) error {
-	cacheDir := filepath.Join(e.Root, ".inco_cache")
-	err := os.MkdirAll(cacheDir, 0o755)
-	_ = err // @inco: err == nil, -return(fmt.Errorf("writeShadow: mkdir: %w", err))
-
-	hash := sha256.Sum256(content)
-	shadowName := fmt.Sprintf("%s_%x.go",
-		strings.TrimSuffix(filepath.Base(origPath), ".go"),
-		hash[:8])
-	shadowPath := filepath.Join(cacheDir, shadowName)
-
-	err = os.WriteFile(shadowPath, content, 0o644)
-	_ = err // @inco: err == nil, -return(fmt.Errorf("writeShadow: write: %w", err))
-	e.Overlay.Replace[origPath] = shadowPath
-	return nil
-}
-
-func (e *Engine) writeOverlay() error {
-	cacheDir := filepath.Join(e.Root, ".inco_cache")
-	err := os.MkdirAll(cacheDir, 0o755)
-	_ = err // @inco: err == nil, -return(fmt.Errorf("writeOverlay: mkdir: %w", err))
-	data, err := json.MarshalIndent(e.Overlay, "", "  ")
-	_ = err // @inco: err == nil, -return(fmt.Errorf("writeOverlay: marshal: %w", err))
-	err = os.WriteFile(filepath.Join(cacheDir, "overlay.json"), data, 0o644)
-	_ = err // @inco: err == nil, -return(fmt.Errorf("writeOverlay: write: %w", err))
-	return nil
+// discardRun removes the shadows a failed run wrote, which no overlay
+// references; the previous overlay and its shadows stay in place.
+func (e *Engine) discardRun(oldOverlay map[string]string) {
+	live := make(map[string]bool, len(oldOverlay))
+	for _, sp := range oldOverlay {
+		live[sp] = true
+	}
+	e.sweepShadows(live, nil, time.Now())
 }
 
 // loadOverlayIfExists reads the previous overlay.json and returns the
@@ -481,6 +967,14 @@ func (e *Engine) manifestPath() string {
 }
 
 func (e *Engine) loadManifest() *Manifest {
+	// A long-lived engine (inco serve) keeps the manifest it last wrote and
+	// skips the reload unless another process has replaced the file since.
+	if e.manifest != nil {
+		if stamp, ok := statStamp(e.manifestPath()); ok && stamp == e.manifestAt {
+			return e.manifest
+		}
+		e.manifest = nil
+	}
 	data, err := os.ReadFile(e.manifestPath())
 	_ = err // @inco: err == nil, -return(&Manifest{Files: make(map[string]ManifestEntry)})
 	var m Manifest
@@ -491,24 +985,42 @@ func (e *Engine) loadManifest() *Manifest {
 }
 
 func (e *Engine) writeManifest(m *Manifest) error {
-	cacheDir := filepath.Join(e.Root, ".inco_cache")
-	err := os.MkdirAll(cacheDir, 0o755)
-	_ = err // @inco: err == nil, -return(fmt.Errorf("writeManifest: mkdir: %w", err))
 	data, err := json.MarshalIndent(m, "", "  ")
 	_ = err // @inco: err == nil, -return(fmt.Errorf("writeManifest: marshal: %w", err))
-	err = os.WriteFile(e.manifestPath(), data, 0o644)
+	err = writeFileAtomic(e.manifestPath(), data)
 	_ = err // @inco: err == nil, -return(fmt.Errorf("writeManifest: write: %w", err))
+	e.manifest = m
+	e.manifestAt, _ = statStamp(e.manifestPath())
 	return nil
 }
 
-// hashFile returns the hex-encoded SHA-256 of a file's contents.
-func hashFile(path string) (string, error) {
-	data, err := os.ReadFile(path)
-	_ = err // @inco: err == nil, -return("", fmt.Errorf("hashFile %s: %w", path, err))
+// writeFileAtomic writes data to a temporary file in the same directory
+// and renames it over path, so readers see either the old or the new
+// content, never a truncated file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	_ = err // @inco: err == nil, -return(err)
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+	_, err = f.Write(data)
+	cerr := f.Close()
+	_ = err  // @inco: err == nil, -return(err)
+	_ = cerr // @inco: cerr == nil, -return(cerr)
+	err = os.Chmod(tmp, 0o644)
+	_ = err // @inco: err == nil, -return(err)
+	return os.Rename(tmp, path)
+}
+
+// hashBytes returns the hex-encoded SHA-256 of data.
+func hashBytes(data []byte) string {
 	h := sha256.Sum256(data)
-	return fmt.Sprintf("%x", h), nil
+	return fmt.Sprintf("%x", h)
 }
 
+// directiveMarker is the byte sequence every @inco: directive contains.
+// Files without it are skipped before parsing.
+var directiveMarker = []byte("@inco:")
+
 // ---------------------------------------------------------------------------
 // Utilities
 // ---------------------------------------------------------------------------
@@ -529,7 +1041,7 @@ func collectStmtLines(f *ast.File, fset *token.FileSet) map[int]bool {
 		case *ast.AssignStmt, *ast.ExprStmt, *ast.ReturnStmt,
 			*ast.IncDecStmt, *ast.SendStmt, *ast.GoStmt, *ast.DeferStmt,
 			*ast.BranchStmt:
-			lines[fset.Position(n.Pos()).Line] = true
+			lines[fset.PositionFor(n.Pos(), false).Line] = true
 		}
 		return true
 	})
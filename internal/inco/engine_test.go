@@ -2,10 +2,16 @@ package inco
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 // setupDir creates a temp directory with Go source files and returns its path.
@@ -50,8 +56,236 @@ func TestEngine_NoDirectives(t *testing.T) {
 	if err := e.Run(); err != nil {
 		t.Fatal(err)
 	}
+	if len(e.Overlay.Replace) != 0 {
+		t.Errorf("expected 0 overlay entries, got %d", len(e.Overlay.Replace))
+	}
+	// The manifest still records the file so that later edits are detected.
+	m := e.loadManifest()
+	entry, ok := m.Files[filepath.Join(dir, "main.go")]
+	if !ok {
+		t.Fatal("manifest should record files without directives")
+	}
+	if entry.SrcHash == "" || entry.ShadowPath != "" {
+		t.Errorf("manifest entry = %+v, want hash only", entry)
+	}
+}
+
+func TestEngine_DirectiveAddedLater(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {}\n",
+	})
+	if err := NewEngine(dir).Run(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {\n\t// @inco: true\n}\n"), 0o644)
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
 	if len(e.Overlay.Replace) != 1 {
-		t.Errorf("expected 1 overlay entry, got %d", len(e.Overlay.Replace))
+		t.Errorf("expected 1 overlay entry after adding a directive, got %d", len(e.Overlay.Replace))
+	}
+}
+
+func TestEngine_DirectiveRemovedLater(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	e1 := NewEngine(dir)
+	if err := e1.Run(); err != nil {
+		t.Fatal(err)
+	}
+	oldShadow := e1.Overlay.Replace[filepath.Join(dir, "main.go")]
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0o644)
+	e2 := NewEngine(dir)
+	if err := e2.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(e2.Overlay.Replace) != 0 {
+		t.Errorf("expected 0 overlay entries after removing the directive, got %d", len(e2.Overlay.Replace))
+	}
+	if _, err := os.Stat(oldShadow); !os.IsNotExist(err) {
+		t.Errorf("old shadow should be removed: %s", oldShadow)
+	}
+}
+
+func TestEngine_StampsAvoidRereading(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: 1 > 0\n}\n",
+	})
+	path := filepath.Join(dir, "main.go")
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(path, old, old)
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// Same size and modification time: a long-lived engine trusts its
+	// stamp and does not read the file again; a new engine does.
+	os.WriteFile(path, []byte("package main\n\nfunc main() {\n\t// @inco: 2 > 0\n}\n"), 0o644)
+	os.Chtimes(path, old, old)
+	var reasons []string
+	e.Events = func(ev Event) {
+		if ev.Kind != EventStart {
+			reasons = append(reasons, ev.Reason)
+		}
+	}
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reasons) != 1 || reasons[0] != ReasonUnchanged {
+		t.Errorf("stamped file should be reused unread, got %v", reasons)
+	}
+	e2 := NewEngine(dir)
+	if err := e2.Run(); err != nil {
+		t.Fatal(err)
+	}
+	shadow, _ := os.ReadFile(e2.Overlay.Replace[path])
+	if !strings.Contains(string(shadow), "2 > 0") {
+		t.Errorf("a new engine should read the file:\n%s", shadow)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// RunFiles — incremental regeneration
+// ---------------------------------------------------------------------------
+
+func TestEngine_RunFiles(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"a.go": "package main\n\nfunc a(x int) {\n\t// @inco: x > 0\n}\n",
+		"b.go": "package main\n\nfunc b(y int) {\n\t// @inco: y > 0\n}\n",
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	aPath, bPath := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")
+	oldB := e.Overlay.Replace[bPath]
+
+	os.WriteFile(aPath, []byte("package main\n\nfunc a(x int) {\n\t// @inco: x > 1\n}\n"), 0o644)
+	os.Remove(bPath)
+	os.WriteFile(filepath.Join(dir, "c.go"), []byte("package main\n\nfunc c(z int) {\n\t// @inco: z > 0\n}\n"), 0o644)
+	// b.go is deleted but not reported: RunFiles trusts the manifest for it.
+	if err := e.RunFiles([]string{aPath, filepath.Join(dir, "c.go")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Overlay.Replace) != 3 {
+		t.Fatalf("expected 3 overlay entries, got %d", len(e.Overlay.Replace))
+	}
+	shadow, _ := os.ReadFile(e.Overlay.Replace[aPath])
+	if !strings.Contains(string(shadow), "x > 1") {
+		t.Errorf("a.go shadow not regenerated:\n%s", shadow)
+	}
+	if e.Overlay.Replace[bPath] != oldB {
+		t.Errorf("b.go shadow should be carried over from the manifest")
+	}
+
+	if err := e.RunFiles([]string{bPath}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.Overlay.Replace[bPath]; ok {
+		t.Error("deleted b.go should be dropped from the overlay")
+	}
+	if len(e.Overlay.Replace) != 2 {
+		t.Errorf("expected 2 overlay entries, got %d", len(e.Overlay.Replace))
+	}
+}
+
+func TestEngine_RunFilesRespectsIgnore(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go":     "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+		"gen.pb.go":   "package main\n\n// @inco: true\nfunc Gen() {}\n",
+		".incoignore": "*.pb.go\n",
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RunFiles([]string{filepath.Join(dir, "gen.pb.go")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Overlay.Replace) != 1 {
+		t.Errorf("expected 1 overlay entry (main.go only), got %d", len(e.Overlay.Replace))
+	}
+}
+
+// ---------------------------------------------------------------------------
+// RunPackages — package-scoped generation
+// ---------------------------------------------------------------------------
+
+func TestEngine_RunPackages(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":      "module example.com/m\n\ngo 1.21\n",
+		"a/a.go":      "package a\n\nimport \"example.com/m/b\"\n\nfunc A(x int) {\n\t// @inco: x > 0\n\tb.B(x)\n}\n",
+		"b/b.go":      "package b\n\nfunc B(x int) {\n\t// @inco: x > 0\n}\n",
+		"b/b_test.go": "package b\n\nimport (\n\t\"testing\"\n\n\t\"example.com/m/d\"\n)\n\nfunc TestB(t *testing.T) { d.D(1) }\n",
+		"c/c.go":      "package c\n\nfunc C(x int) {\n\t// @inco: x > 0\n}\n",
+		"d/d.go":      "package d\n\nfunc D(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	e := NewEngine(dir)
+	if err := e.RunPackages(filepath.Join(dir, "a"), nil, []string{"./..."}); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Overlay.Replace) != 2 {
+		t.Fatalf("./... in a/ should generate a and its dependency b only, got %v", e.Overlay.Replace)
+	}
+	if err := e.RunPackages(dir, nil, []string{"./a", "./b"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/a.go", "b/b.go", "d/d.go"} {
+		if _, ok := e.Overlay.Replace[filepath.Join(dir, name)]; !ok {
+			t.Errorf("%s (pattern, dependency or test dependency) should be generated", name)
+		}
+	}
+	if _, ok := e.Overlay.Replace[filepath.Join(dir, "c", "c.go")]; ok {
+		t.Error("c/c.go is outside the dependency closure and should not be generated")
+	}
+}
+
+func TestEngine_RunPackagesBuildFlags(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":          "module example.com/m\n\ngo 1.21\n",
+		"main.go":         "package main\n\nfunc main() {}\n",
+		"main_special.go": "//go:build special\n\npackage main\n\nimport _ \"example.com/m/a\"\n",
+		"a/a.go":          "package a\n\nfunc A(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	aPath := filepath.Join(dir, "a", "a.go")
+	e := NewEngine(dir)
+	if err := e.RunPackages(dir, nil, []string{"."}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.Overlay.Replace[aPath]; ok {
+		t.Fatal("a is only imported with -tags=special and should not be generated without it")
+	}
+	if err := e.RunPackages(dir, []string{"-tags=special"}, []string{"."}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.Overlay.Replace[aPath]; !ok {
+		t.Error("a is a dependency with -tags=special and should be generated")
+	}
+}
+
+func TestEngine_RunPackagesKeepsOtherEntries(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.21\n",
+		"a/a.go": "package a\n\nfunc A(x int) {\n\t// @inco: x > 0\n}\n",
+		"c/c.go": "package c\n\nfunc C(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	cPath := filepath.Join(dir, "c", "c.go")
+	oldC := e.Overlay.Replace[cPath]
+	os.WriteFile(cPath, []byte("package c\n\nfunc C(x int) {\n\t// @inco: x > 1\n}\n"), 0o644)
+	if err := e.RunPackages(dir, nil, []string{"./a"}); err != nil {
+		t.Fatal(err)
+	}
+	if e.Overlay.Replace[cPath] != oldC {
+		t.Error("c/c.go is out of scope: its entry should be carried over untouched")
+	}
+	if _, err := os.Stat(oldC); err != nil {
+		t.Errorf("out-of-scope shadow should be kept: %v", err)
 	}
 }
 
@@ -248,7 +482,7 @@ func X(x int) {
 	// @inco: x > 0
 }
 `,
-		"main.go": "package main\n\nfunc main() {}\n",
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
 	})
 	e := NewEngine(dir)
 	if err := e.Run(); err != nil {
@@ -553,7 +787,7 @@ func B(y int) {
 
 func TestEngine_SkipsTestFiles(t *testing.T) {
 	dir := setupDir(t, map[string]string{
-		"main.go":      "package main\n\nfunc main() {}\n",
+		"main.go":      "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
 		"main_test.go": "package main\n\nfunc TestFoo() {\n\t// @inco: true\n}\n",
 	})
 	e := NewEngine(dir)
@@ -589,6 +823,136 @@ func Do(s string) (int, error) {
 	}
 }
 
+func TestEngine_ImportMapPersisted(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc Do(s string) error {\n\t// @inco: len(s) > 0, -return(fmt.Errorf(\"empty\"))\n\treturn nil\n}\n",
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := e.loadImportMap(dir, e.importMapKey(dir))
+	if !ok || m["fmt"] != "fmt" || m["html/template"] != "template" {
+		t.Fatalf("imports.json should hold the resolved map, got ok=%v fmt=%q", ok, m["fmt"])
+	}
+}
+
+func TestEngine_ImportMapCacheReused(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc Do(s string) {\n\t// @inco: len(s) > 0, -panic(zz.Err)\n}\n",
+	})
+	e := NewEngine(dir)
+	os.MkdirAll(e.cacheDir(), 0o755)
+	e.writeImportMap(dir, e.importMapKey(dir), map[string]string{"example.com/zz": "zz"})
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// "zz" can only come from the cached map: go list knows no such package.
+	if shadow := readShadow(t, e); !strings.Contains(shadow, `"example.com/zz"`) {
+		t.Errorf("should resolve zz from the cached import map, got:\n%s", shadow)
+	}
+}
+
+func TestEngine_ImportMapCacheKeyMismatch(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc Do(s string) {\n\t// @inco: len(s) > 0, -panic(zz.Err)\n}\n",
+	})
+	e := NewEngine(dir)
+	os.MkdirAll(e.cacheDir(), 0o755)
+	e.writeImportMap(dir, "stale", map[string]string{"example.com/zz": "zz"})
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow := readShadow(t, e); strings.Contains(shadow, `"example.com/zz"`) {
+		t.Errorf("an import map with a stale key must be rebuilt, got:\n%s", shadow)
+	}
+}
+
+func TestEngine_ImportMapFollowsNewImports(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":   "module example.com/m\n\ngo 1.21\n",
+		"main.go":  "package main\n\nfunc main() {}\n",
+		"zz/zz.go": "package zz\n\nvar Err = \"zz\"\n",
+		"yy/yy.go": "package yy\n\nfunc Do(s string) {\n\t// @inco: len(s) > 0\n}\n",
+	})
+	long := NewEngine(dir)
+	if err := long.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// zz is not imported anywhere yet; importing it from main.go changes
+	// neither go.mod nor go.sum, but must still reach the import map. Only
+	// the imports of files with directives are noted.
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nimport _ \"example.com/m/zz\"\n\nfunc main() {\n\t// @inco: true\n}\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "yy", "yy.go"), []byte("package yy\n\nfunc Do(s string) {\n\t// @inco: len(s) > 0, -panic(zz.Err)\n}\n"), 0o644)
+	for _, e := range []*Engine{long, NewEngine(dir)} {
+		if err := e.Run(); err != nil {
+			t.Fatal(err)
+		}
+		shadow, _ := os.ReadFile(e.Overlay.Replace[filepath.Join(dir, "yy", "yy.go")])
+		if !strings.Contains(string(shadow), `"example.com/m/zz"`) {
+			t.Errorf("zz should resolve once a file imports it:\n%s", shadow)
+		}
+	}
+}
+
+// A new import is looked up on its own; the cached map is extended, not
+// rebuilt.
+func TestEngine_ImportMapExtendedIncrementally(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":   "module example.com/m\n\ngo 1.21\n",
+		"main.go":  "package main\n\nimport _ \"example.com/m/yy\"\n\nfunc main() {\n\t// @inco: true\n}\n",
+		"yy/yy.go": "package yy\n",
+	})
+	e := NewEngine(dir)
+	os.MkdirAll(e.cacheDir(), 0o755)
+	key := e.importMapKey(dir)
+	e.writeImportMap(dir, key, map[string]string{"example.com/zz": "zz"})
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := e.loadImportMap(dir, key)
+	if !ok || m["example.com/zz"] != "zz" || m["example.com/m/yy"] != "yy" {
+		t.Fatalf("the cached map should keep zz and gain yy, got ok=%v %v", ok, m)
+	}
+}
+
+// An internal package is not importable by name, but once go list has
+// reported it, files importing it do not look it up again.
+func TestEngine_ImportMapRemembersInternalPackages(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("wraps go in a shell script")
+	}
+	goPath, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not found")
+	}
+	dir := setupDir(t, map[string]string{
+		"go.mod":          "module example.com/m\n\ngo 1.21\n",
+		"internal/x/x.go": "package x\n",
+	})
+	bin := t.TempDir()
+	calls := filepath.Join(bin, "calls")
+	os.WriteFile(filepath.Join(bin, "go"), []byte("#!/bin/sh\necho \"$*\" >> "+calls+"\nexec "+goPath+" \"$@\"\n"), 0o755)
+	e := NewEngine(dir)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "PATH=") {
+			e.Env = append(e.Env, kv)
+		}
+	}
+	e.Env = append(e.Env, "PATH="+bin)
+	for i := 0; i < 3; i++ {
+		src := fmt.Sprintf("package main\n\nimport _ \"example.com/m/internal/x\"\n\nfunc main() {\n\t// @inco: len(os.Args) >= %d\n}\n", i)
+		os.WriteFile(filepath.Join(dir, "main.go"), []byte(src), 0o644)
+		if err := e.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log, _ := os.ReadFile(calls)
+	if n := strings.Count(string(log), "example.com/m/internal/x"); n > 1 {
+		t.Errorf("internal/x looked up %d times, want at most once:\n%s", n, log)
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Deeply nested closure
 // ---------------------------------------------------------------------------
@@ -627,7 +991,7 @@ func Outer() {
 
 func TestEngine_SkipsVendor(t *testing.T) {
 	dir := setupDir(t, map[string]string{
-		"main.go":        "package main\n\nfunc main() {}\n",
+		"main.go":        "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
 		"vendor/v/v.go":  "package v\n\nfunc V(x int) {\n\t// @inco: x > 0\n}\n",
 		"testdata/td.go": "package td\n\nfunc TD(x int) {\n\t// @inco: x > 0\n}\n",
 	})
@@ -674,6 +1038,35 @@ func doSomething() error { return nil }
 	}
 }
 
+func TestEngine_InlineDirectiveAfterGuard(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": `package main
+
+func Do(x, y int) {
+	// @inco: x > 0
+	_ = y // @inco: y > 0
+}
+`,
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	shadow := readShadow(t, e)
+	// The statement is user code on line 5: a //line comment resumes the
+	// source's numbering after the guard before it.
+	lines := strings.Split(shadow, "\n")
+	i := lineOf(t, shadow, "_ = y") - 1
+	want := lineDirective(filepath.Join(dir, "main.go"), 5, 1)
+	if i == 0 || lines[i-1] != want {
+		t.Errorf("statement should follow %q, got:\n%s", want, shadow)
+	}
+	sl := newShadowLines(readShadowPath(t, e), []byte(shadow), nil)
+	if line, _, ok := sl.position(i+1, 2); !ok || line != 5 {
+		t.Errorf("statement maps to line %d, want 5", line)
+	}
+}
+
 // ---------------------------------------------------------------------------
 // //line at column 1
 // ---------------------------------------------------------------------------
@@ -917,3 +1310,415 @@ func Do(x int) {
 		}
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Column-accurate //line and /*line*/ markers
+// ---------------------------------------------------------------------------
+
+func TestEngine_LineDirectiveColumns(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": `package main
+
+func Do(x int) error {
+	// @inco: x > 0, -return(fmt.Errorf("bad"))
+	_ = x // @inco: x < 10
+	return nil
+}
+`,
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	shadow := readShadow(t, e)
+	path := filepath.Join(dir, "main.go")
+	for _, want := range []string{
+		// Standalone: comment at column 2, expr at 12, "return" at 20.
+		"//line " + path + ":4:6\n\tif !(x > 0)",
+		"/*line " + path + ":4:20*/return fmt.Errorf",
+		// Inline: comment at column 8, expr at 18; default panic maps to expr.
+		"//line " + path + ":5:12\n\tif !(x < 10)",
+		"/*line " + path + ":5:18*/panic(",
+		// Following source line is restored with a column.
+		"//line " + path + ":6:1\n",
+	} {
+		if !strings.Contains(shadow, want) {
+			t.Errorf("shadow should contain %q, got:\n%s", want, shadow)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Trimpath — module-relative //line paths
+// ---------------------------------------------------------------------------
+
+func TestEngine_TrimpathModuleRelative(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.21\n",
+		"pkg/a.go": `package pkg
+
+func Do(x int) {
+	// @inco: x > 0
+	_ = x
+}
+`,
+	})
+	e := NewEngine(dir)
+	e.Trimpath = true
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	shadow := readShadow(t, e)
+	if !strings.Contains(shadow, "//line example.com/m/pkg/a.go:4:") {
+		t.Errorf("//line should use module-relative path, got:\n%s", shadow)
+	}
+	if strings.Contains(shadow, dir) {
+		t.Errorf("shadow should not contain the absolute root %s, got:\n%s", dir, shadow)
+	}
+}
+
+func TestEngine_TrimpathReproducible(t *testing.T) {
+	files := map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.21\n",
+		"a.go": `package m
+
+func Do(s string) error {
+	// @inco: s != "", -return(fmt.Errorf("empty"))
+	return nil
+}
+`,
+	}
+	var shadows []string
+	for i := 0; i < 2; i++ {
+		e := NewEngine(setupDir(t, files))
+		e.Trimpath = true
+		if err := e.Run(); err != nil {
+			t.Fatal(err)
+		}
+		shadows = append(shadows, readShadow(t, e))
+	}
+	if shadows[0] != shadows[1] {
+		t.Errorf("trimmed shadows differ across roots:\n%s\n---\n%s", shadows[0], shadows[1])
+	}
+}
+
+func TestEngine_TrimpathInvalidatesCache(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.21\n",
+		"a.go": `package m
+
+func Do(x int) {
+	// @inco: x > 0
+	_ = x
+}
+`,
+	})
+	if err := NewEngine(dir).Run(); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(dir)
+	e.Trimpath = true
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow := readShadow(t, e); strings.Contains(shadow, dir) {
+		t.Errorf("switching to Trimpath should regenerate the shadow, got:\n%s", shadow)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Benchmarks — synthetic tree
+// ---------------------------------------------------------------------------
+
+// benchTreeSize is the number of files in the synthetic benchmark tree.
+const benchTreeSize = 10000
+
+// setupBenchTree writes n source files spread over n/100 packages. Every
+// other file contains directives; the rest are plain Go.
+func setupBenchTree(b *testing.B, n int) string {
+	b.Helper()
+	dir := b.TempDir()
+	for i := 0; i < n; i++ {
+		pkg := fmt.Sprintf("p%03d", i/100)
+		src := fmt.Sprintf("package %s\n\nfunc F%d(x int, s string) error {\n\treturn nil\n}\n", pkg, i)
+		if i%2 == 0 {
+			src = fmt.Sprintf(`package %s
+
+func F%d(x int, s string) error {
+	// @inco: x > 0
+	// @inco: s != "", -return(fmt.Errorf("empty"))
+	for i := 0; i < x; i++ {
+		// @inco: i != 42, -continue
+		_ = i
+	}
+	return nil
+}
+`, pkg, i)
+		}
+		p := filepath.Join(dir, pkg, fmt.Sprintf("f%d.go", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(src), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// BenchmarkEngine_RunCold measures a full generation with an empty cache.
+func BenchmarkEngine_RunCold(b *testing.B) {
+	dir := setupBenchTree(b, benchTreeSize)
+	e := NewEngine(dir)
+	e.Log = io.Discard
+	e.buildImportMap(dir) // exclude the one-off `go list` from the measurement
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		os.RemoveAll(filepath.Join(dir, ".inco_cache"))
+		e.Overlay = Overlay{Replace: make(map[string]string)}
+		b.StartTimer()
+		if err := e.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEngine_RunWarm measures an incremental run where every file is
+// served from the manifest.
+func BenchmarkEngine_RunWarm(b *testing.B) {
+	dir := setupBenchTree(b, benchTreeSize)
+	run := func() error {
+		e := NewEngine(dir)
+		e.Log = io.Discard
+		return e.Run()
+	}
+	if err := run(); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Cache invalidation — engine version and configuration
+// ---------------------------------------------------------------------------
+
+// tamperShadows overwrites every shadow in the overlay so that a later
+// run reveals whether it regenerated (content restored) or reused it.
+func tamperShadows(t *testing.T, e *Engine) {
+	t.Helper()
+	for _, sp := range e.Overlay.Replace {
+		if err := os.WriteFile(sp, []byte("tampered"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEngine_ManifestKeptInMemory(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if m := e.loadManifest(); m != e.manifest {
+		t.Fatal("unchanged manifest.json should not be reloaded")
+	}
+	// Another process rewrites the manifest: the engine must notice.
+	os.WriteFile(e.manifestPath(), []byte(`{"version":"other","files":{}}`), 0o644)
+	if m := e.loadManifest(); m.Version != "other" {
+		t.Fatalf("expected the rewritten manifest, got version %q", m.Version)
+	}
+}
+
+func TestEngine_ManifestRecordsVersionAndConfig(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	m := e.loadManifest()
+	if m.Version != EngineVersion() {
+		t.Errorf("manifest Version = %q, want %q", m.Version, EngineVersion())
+	}
+	if m.Config == "" {
+		t.Error("manifest should record a config fingerprint")
+	}
+}
+
+func TestEngine_VersionChangeInvalidatesCache(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	e1 := NewEngine(dir)
+	if err := e1.Run(); err != nil {
+		t.Fatal(err)
+	}
+	tamperShadows(t, e1)
+
+	// Same version and config — the (tampered) shadow is reused.
+	e2 := NewEngine(dir)
+	if err := e2.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow := readShadow(t, e2); shadow != "tampered" {
+		t.Fatalf("unchanged version should reuse the cached shadow, got:\n%s", shadow)
+	}
+
+	// Pretend the cache was written by another inco build.
+	m := e2.loadManifest()
+	m.Version = "f0 v0.0.1"
+	if err := e2.writeManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	e3 := NewEngine(dir)
+	if err := e3.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow := readShadow(t, e3); !strings.Contains(shadow, "if !(true)") {
+		t.Errorf("version change should regenerate the shadow, got:\n%s", shadow)
+	}
+}
+
+func TestEngine_GoModChangeInvalidatesCache(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":  "module example.com/m\n\ngo 1.21\n",
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	e1 := NewEngine(dir)
+	if err := e1.Run(); err != nil {
+		t.Fatal(err)
+	}
+	tamperShadows(t, e1)
+
+	os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/m\n\ngo 1.22\n"), 0o644)
+	e2 := NewEngine(dir)
+	if err := e2.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow := readShadow(t, e2); !strings.Contains(shadow, "if !(true)") {
+		t.Errorf("go.mod change should regenerate the shadow, got:\n%s", shadow)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Concurrency — cache lock, atomic writes, deferred pruning
+// ---------------------------------------------------------------------------
+
+func TestEngine_ConcurrentRuns(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"a.go": "package main\n\nfunc A(x int) {\n\t// @inco: x > 0\n}\n",
+		"b.go": "package main\n\nfunc B(y int) {\n\t// @inco: y > 0\n}\n",
+	})
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- NewEngine(dir).Run() }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	ov, err := loadOverlay(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ov.Replace) != 2 {
+		t.Fatalf("overlay has %d entries, want 2", len(ov.Replace))
+	}
+	for _, sp := range ov.Replace {
+		if _, err := os.Stat(sp); err != nil {
+			t.Errorf("overlay points at missing shadow: %v", err)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, ".inco_cache"))
+	for _, ent := range entries {
+		if strings.Contains(ent.Name(), ".tmp") {
+			t.Errorf("leftover temp file %s", ent.Name())
+		}
+	}
+}
+
+func TestEngine_LockHeld(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	os.MkdirAll(filepath.Join(dir, ".inco_cache"), 0o755)
+	unlock, ok, err := tryLock(filepath.Join(dir, ".inco_cache", "lock"))
+	if err != nil || !ok {
+		t.Fatalf("tryLock = %v, %v", ok, err)
+	}
+
+	e := NewEngine(dir)
+	e.LockTimeout = 0
+	if err := e.Run(); !errors.Is(err, ErrCacheLocked) {
+		t.Fatalf("Run with lock held = %v, want ErrCacheLocked", err)
+	}
+
+	// Released while waiting — the run proceeds.
+	e = NewEngine(dir)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlock()
+	}()
+	if err := e.Run(); err != nil {
+		t.Fatalf("Run after release: %v", err)
+	}
+	if len(e.Overlay.Replace) != 1 {
+		t.Errorf("expected 1 overlay entry, got %d", len(e.Overlay.Replace))
+	}
+}
+
+func TestEngine_ShadowGraceKeepsRetiredShadow(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	e1 := NewEngine(dir)
+	if err := e1.Run(); err != nil {
+		t.Fatal(err)
+	}
+	oldShadow := readShadowPath(t, e1)
+
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {\n\t// @inco: false\n}\n"), 0o644)
+	e2 := NewEngine(dir)
+	e2.ShadowGrace = time.Hour
+	if err := e2.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldShadow); err != nil {
+		t.Errorf("retired shadow should survive the grace period: %v", err)
+	}
+
+	// Once the grace period has passed, the next run removes it.
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(oldShadow, old, old)
+	e3 := NewEngine(dir)
+	e3.ShadowGrace = time.Hour
+	if err := e3.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldShadow); !os.IsNotExist(err) {
+		t.Errorf("expired shadow should be removed: %s", oldShadow)
+	}
+	if _, err := os.Stat(readShadowPath(t, e3)); err != nil {
+		t.Errorf("live shadow should be kept: %v", err)
+	}
+}
+
+// readShadowPath returns the path of the first shadow file in the overlay.
+func readShadowPath(t *testing.T, e *Engine) string {
+	t.Helper()
+	for _, sp := range e.Overlay.Replace {
+		return sp
+	}
+	t.Fatal("no shadow files")
+	return ""
+}
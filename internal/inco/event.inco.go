@@ -0,0 +1,112 @@
+package inco
+
+import "fmt"
+
+// ---------------------------------------------------------------------------
+// Progress events
+// ---------------------------------------------------------------------------
+
+// EventKind identifies what an Event reports.
+type EventKind int
+
+const (
+	EventStart       EventKind = iota // a run is about to look at Total files
+	EventCached                       // the file's previous shadow (or lack of one) was reused
+	EventRegenerated                  // a new shadow was written
+	EventSkipped                      // the file was read but stays out of the overlay
+	EventError                        // the file failed; see Diagnostics
+)
+
+var eventNames = map[EventKind]string{
+	EventStart:       "start",
+	EventCached:      "cached",
+	EventRegenerated: "regenerated",
+	EventSkipped:     "skipped",
+	EventError:       "error",
+}
+
+func (k EventKind) String() string {
+	if n, ok := eventNames[k]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// MarshalText encodes k by name.
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes a name written by MarshalText.
+func (k *EventKind) UnmarshalText(text []byte) error {
+	for v, n := range eventNames {
+		if n == string(text) {
+			*k = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event kind %q", text)
+}
+
+// Reasons given in Event.Reason.
+const (
+	ReasonUnchanged      = "unchanged"              // content hash matches the manifest
+	ReasonNew            = "new file"               // not in the manifest
+	ReasonChanged        = "source changed"         // content hash differs from the manifest
+	ReasonShadowMissing  = "shadow missing"         // the recorded shadow was deleted
+	ReasonPackageChanged = "package changed"        // another file of the package declares different names
+	ReasonVersion        = "engine version changed" // the manifest was written by another inco build
+	ReasonConfig         = "configuration changed"  // Trimpath, go.mod, go.sum or go.work changed
+	ReasonSharedCache    = "shared cache"           // another checkout generated the same shadow
+	ReasonNoDirectives   = "no directives"          // the file never mentions @inco:
+	ReasonDoesNotParse   = "does not parse"         // passed through to the compiler
+)
+
+// Event reports the progress of a run to Engine.Events.
+type Event struct {
+	Kind        EventKind
+	Path        string       // source file; empty for EventStart
+	Reason      string       // one of the Reason* constants; empty for EventStart and EventError
+	Total       int          // EventStart only: number of files the run looks at
+	Diagnostics []Diagnostic `json:",omitempty"` // problems found in the file
+	Directives  []string     `json:",omitempty"` // EventRegenerated only: IDs of the directives guarded in the new shadow, in source order
+}
+
+// emit delivers ev to the event sink, if any. Events from concurrent
+// workers are delivered one at a time.
+func (e *Engine) emit(ev Event) {
+	// @inco: e.Events != nil, -return
+	e.eventMu.Lock()
+	defer e.eventMu.Unlock()
+	e.Events(ev)
+}
+
+// fileEvent returns the event for the processed file at path.
+func fileEvent(path string, r fileResult, diags []Diagnostic) Event {
+	ev := Event{Path: path, Reason: r.Reason, Diagnostics: diags}
+	switch {
+	case hasErrors(diags):
+		ev.Kind, ev.Reason = EventError, ""
+	case r.Cached:
+		ev.Kind = EventCached
+	case r.ShadowPath == "":
+		ev.Kind = EventSkipped
+	default:
+		ev.Kind = EventRegenerated
+		ev.Directives = guardedIDs(r.Map)
+	}
+	return ev
+}
+
+// guardedIDs returns the IDs of the directives whose guards m maps, in
+// order, or nil without m.
+func guardedIDs(m *ShadowMap) []string {
+	// @inco: m != nil, -return(nil)
+	var ids []string
+	for _, r := range m.Ranges {
+		if r.Directive != nil {
+			ids = append(ids, r.Directive.ID)
+		}
+	}
+	return ids
+}
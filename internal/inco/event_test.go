@@ -0,0 +1,116 @@
+package inco
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Events
+// ---------------------------------------------------------------------------
+
+// recordEvents runs e and returns its file events by base name, failing the
+// test unless exactly one EventStart came first.
+func recordEvents(t *testing.T, e *Engine) map[string]Event {
+	t.Helper()
+	var events []Event
+	e.Events = func(ev Event) { events = append(events, ev) }
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || events[0].Kind != EventStart || events[0].Total != len(events)-1 {
+		t.Fatalf("expected EventStart with the file count first, got %+v", events)
+	}
+	byName := make(map[string]Event)
+	for _, ev := range events[1:] {
+		byName[filepath.Base(ev.Path)] = ev
+	}
+	return byName
+}
+
+func TestEngine_Events(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":   "module example.com/m\n\ngo 1.22\n",
+		"a.go":     "package m\n\nfunc A(x int) {\n\t// @inco: x > 0\n}\n",
+		"b.go":     "package m\n\nfunc B(x int) {\n\t// @inco: x > 0\n}\n",
+		"c.go":     "package m\n\nfunc C(x int) {\n\t// @inco: x > 0\n}\n",
+		"plain.go": "package m\n\nfunc Plain() {}\n",
+		"bad.go":   "package m\n\nfunc Bad( {\n\t// @inco: true\n}\n",
+	})
+	e := NewEngine(dir)
+	check := func(events map[string]Event, name string, kind EventKind, reason string) {
+		t.Helper()
+		if ev := events[name]; ev.Kind != kind || ev.Reason != reason {
+			t.Errorf("%s: got %s (%s), want %s (%s)", name, ev.Kind, ev.Reason, kind, reason)
+		}
+	}
+
+	events := recordEvents(t, e)
+	check(events, "a.go", EventRegenerated, ReasonNew)
+	check(events, "plain.go", EventSkipped, ReasonNoDirectives)
+	check(events, "bad.go", EventSkipped, ReasonDoesNotParse)
+	if len(events["bad.go"].Diagnostics) != 1 {
+		t.Errorf("bad.go event should carry its warning, got %+v", events["bad.go"])
+	}
+	aSrc, _ := os.ReadFile(filepath.Join(dir, "a.go"))
+	if id := sourceDirectiveIDs(filepath.Join(dir, "a.go"), aSrc)[4]; !reflect.DeepEqual(events["a.go"].Directives, []string{id}) {
+		t.Errorf("a.go event should list directive %s, got %v", id, events["a.go"].Directives)
+	}
+
+	os.WriteFile(filepath.Join(dir, "b.go"), []byte("package m\n\nfunc B(x int) {\n\t// @inco: x > 1\n}\n"), 0o644)
+	os.Remove(e.Overlay.Replace[filepath.Join(dir, "c.go")])
+	events = recordEvents(t, e)
+	check(events, "a.go", EventCached, ReasonUnchanged)
+	check(events, "b.go", EventRegenerated, ReasonChanged)
+	check(events, "c.go", EventRegenerated, ReasonShadowMissing)
+
+	e.Trimpath = true
+	events = recordEvents(t, e)
+	check(events, "a.go", EventRegenerated, ReasonConfig)
+}
+
+// ---------------------------------------------------------------------------
+// Cancellation
+// ---------------------------------------------------------------------------
+
+func TestEngine_RunContextCanceled(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e := NewEngine(dir)
+	if err := e.RunContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunContext = %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".inco_cache", "overlay.json")); err == nil {
+		t.Error("a canceled run should not write an overlay")
+	}
+}
+
+func TestEngine_RunContextCanceledWhileLocked(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	os.MkdirAll(filepath.Join(dir, ".inco_cache"), 0o755)
+	unlock, ok, err := tryLock(filepath.Join(dir, ".inco_cache", "lock"))
+	if err != nil || !ok {
+		t.Fatalf("tryLock = %v, %v", ok, err)
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := NewEngine(dir).RunContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RunContext = %v, want context.DeadlineExceeded", err)
+	}
+	if waited := time.Since(start); waited > 10*time.Second {
+		t.Errorf("cancellation took %s", waited)
+	}
+}
@@ -0,0 +1,116 @@
+package inco
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// In-memory generation
+// ---------------------------------------------------------------------------
+
+// GenerateOptions configures GenerateSource.
+type GenerateOptions struct {
+	// FS holds the file's package. The other files in the directory of
+	// filename that build.Default matches are read from it, so that names
+	// they declare are not mistaken for packages. Nil means src is
+	// considered on its own.
+	FS fs.FS
+
+	// Files, if not nil, lists the package's other files in FS, exactly as
+	// they are compiled, in place of the directory's files.
+	Files []string
+
+	// LinePath is the file name written into //line directives (and so
+	// reported by the compiler and in stack traces); empty means filename.
+	LinePath string
+
+	// Imports maps package names to the import paths that directives may
+	// use without importing them; "" marks a name that must not be
+	// guessed. Nil means the standard library, listed once per process
+	// with `go list std`.
+	Imports map[string]string
+
+	// PackagePath is the import path of the file's package, from which
+	// the IDs of its directives are derived; empty means the package name.
+	PackagePath string
+}
+
+// memSource replaces the disk and go.mod lookups of an engine that
+// generates a single file in memory.
+type memSource struct {
+	fsys     fs.FS
+	files    []string
+	linePath string
+	pkgPath  string
+	imports  *moduleImports
+}
+
+// GenerateSource returns the shadow of one Go source file: src with its
+// directives expanded and missing imports added, exactly as Run would
+// write it to .inco_cache. Nothing is written to disk and nothing is read
+// beyond opts.FS, except that a nil opts.Imports runs `go list std` once
+// per process. filename is the slash-separated path of the file in
+// opts.FS.
+//
+// A file without directives is returned unchanged. Warnings (such as an
+// ambiguous package name) are returned as diagnostics alongside the
+// shadow; a file that does not parse yields its syntax error as both an
+// error diagnostic and a *DiagnosticsError.
+func GenerateSource(filename string, src []byte, opts GenerateOptions) (shadow []byte, diags []Diagnostic, err error) {
+	// @inco: filename != "", -return(nil, nil, fmt.Errorf("GenerateSource: filename must not be empty"))
+	// @inco: bytes.Contains(src, directiveMarker), -return(src, nil, nil)
+	defer func() {
+		if p := recover(); p != nil {
+			shadow, diags, err = generateFailed(fileError(filename, DiagInternal, fmt.Errorf("%v", p)))
+		}
+	}()
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	_ = err // @inco: err == nil, -return(generateFailed([]Diagnostic{syntaxError(filename, err)}))
+
+	mem := &memSource{fsys: opts.FS, files: opts.Files, linePath: opts.LinePath, pkgPath: opts.PackagePath, imports: &moduleImports{}}
+	if mem.linePath == "" {
+		mem.linePath = filename
+	}
+	if mem.pkgPath == "" {
+		mem.pkgPath = f.Name.Name
+	}
+	names := opts.Imports
+	if names == nil {
+		names = stdImports()
+	}
+	mem.imports.setNames(names)
+	e := &Engine{Root: ".", mem: mem}
+	shadow, _, diags = e.generateShadow(filename, src, f, fset)
+	return shadow, diags, nil
+}
+
+// generateFailed returns the results of GenerateSource for a file that
+// could not be generated.
+func generateFailed(diags []Diagnostic) ([]byte, []Diagnostic, error) {
+	return nil, diags, &DiagnosticsError{Diagnostics: diags}
+}
+
+var (
+	stdImportsOnce sync.Once
+	stdImportsMap  map[string]string
+)
+
+// stdImports returns the import map of the standard library, built with
+// go list on first use. It is empty when the go command is unavailable.
+func stdImports() map[string]string {
+	stdImportsOnce.Do(func() {
+		var mi moduleImports
+		paths := make(map[string]string)
+		collectPackages(nil, os.TempDir(), paths, "-e", "std")
+		mi.setPaths(paths)
+		stdImportsMap = mi.names
+	})
+	return stdImportsMap
+}
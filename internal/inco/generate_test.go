@@ -0,0 +1,68 @@
+package inco
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// ---------------------------------------------------------------------------
+// GenerateSource — in-memory generation
+// ---------------------------------------------------------------------------
+
+func TestGenerateSource(t *testing.T) {
+	src := []byte("package p\n\nfunc F(x int) error {\n\t// @inco: x > 0, -return(fmt.Errorf(\"bad x\"))\n\treturn nil\n}\n")
+	shadow, diags, err := GenerateSource("p/f.inco.go", src, GenerateOptions{LinePath: "example.com/m/p/f.inco.go"})
+	if err != nil || len(diags) != 0 {
+		t.Fatalf("GenerateSource: %v, %v", err, diags)
+	}
+	got := string(shadow)
+	for _, want := range []string{"if !(x > 0)", "//line example.com/m/p/f.inco.go:4:", `"fmt"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("shadow missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestGenerateSource_NoDirectives(t *testing.T) {
+	src := []byte("package p\n\nfunc F() {}\n")
+	shadow, _, err := GenerateSource("f.go", src, GenerateOptions{})
+	if err != nil || string(shadow) != string(src) {
+		t.Errorf("file without directives should be returned as is, got %q, %v", shadow, err)
+	}
+}
+
+func TestGenerateSource_SiblingsAndImports(t *testing.T) {
+	fsys := fstest.MapFS{
+		"p/names.go":   {Data: []byte("package p\n\nvar metrics = struct{ Ok func() bool }{}\n")},
+		"p/ignored.go": {Data: []byte("//go:build ignore\n\npackage p\n\nvar lib = 1\n")},
+	}
+	src := []byte("package p\n\nfunc F() {\n\t// @inco: metrics.Ok() && lib.Ready()\n}\n")
+	shadow, _, err := GenerateSource("p/f.go", src, GenerateOptions{
+		FS:      fsys,
+		Imports: map[string]string{"metrics": "example.com/metrics", "lib": "example.com/lib"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(shadow)
+	if strings.Contains(got, "example.com/metrics") {
+		t.Errorf("name declared in a sibling file must not be imported:\n%s", got)
+	}
+	if !strings.Contains(got, `"example.com/lib"`) {
+		t.Errorf("name declared only in an excluded file should be imported:\n%s", got)
+	}
+}
+
+func TestGenerateSource_SyntaxError(t *testing.T) {
+	src := []byte("package p\n\nfunc F( {\n\t// @inco: true\n}\n")
+	shadow, diags, err := GenerateSource("f.go", src, GenerateOptions{})
+	var de *DiagnosticsError
+	if shadow != nil || !errors.As(err, &de) {
+		t.Fatalf("expected a *DiagnosticsError, got %q, %v", shadow, err)
+	}
+	if len(diags) != 1 || diags[0].Code != DiagParse || diags[0].Severity != SeverityError || diags[0].Pos.Line != 3 {
+		t.Errorf("unexpected diagnostics %v", diags)
+	}
+}
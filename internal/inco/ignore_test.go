@@ -139,7 +139,7 @@ func TestIgnore_NilSafe(t *testing.T) {
 
 func TestEngine_IncoignoreSkipsFile(t *testing.T) {
 	dir := setupDir(t, map[string]string{
-		"main.go": "package main\n\nfunc main() {}\n",
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
 		"gen.pb.go": `package main
 
 // @inco: true
@@ -149,7 +149,7 @@ func Generated() {}
 	})
 	e := NewEngine(dir)
 	e.Run()
-	// main.go always gets a shadow; gen.pb.go should be ignored.
+	// main.go gets a shadow; gen.pb.go should be ignored.
 	ignoredPath := filepath.Join(dir, "gen.pb.go")
 	if _, ok := e.Overlay.Replace[ignoredPath]; ok {
 		t.Fatal("gen.pb.go should be ignored by .incoignore but appears in overlay")
@@ -161,7 +161,7 @@ func Generated() {}
 
 func TestEngine_IncoignoreSkipsDir(t *testing.T) {
 	dir := setupDir(t, map[string]string{
-		"main.go": "package main\n\nfunc main() {}\n",
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
 		"extra/lib.go": `package extra
 
 // @inco: true
@@ -187,7 +187,7 @@ func Lib() {}
 
 func TestEngine_NestedIncoignore(t *testing.T) {
 	dir := setupDir(t, map[string]string{
-		"main.go": "package main\n\nfunc main() {}\n",
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
 		"sub/ok.go": `package sub
 
 // @inco: true
@@ -216,3 +216,36 @@ func Gen() {}
 		t.Fatalf("expected 2 overlay entries (main.go + sub/ok.go), got %d", len(e.Overlay.Replace))
 	}
 }
+
+// isWalkedGoFile must agree with walkGoFiles on every file of the tree.
+func TestIsWalkedGoFile_MatchesWalk(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go":               "package main\n",
+		"main_test.go":          "package main\n",
+		".incoignore":           "gen/\n",
+		"gen/gen.go":            "package gen\n",
+		"sub/ok.go":             "package sub\n",
+		"sub/gen.pb.go":         "package sub\n",
+		"sub/.incoignore":       "*.pb.go\ndeep/\n",
+		"sub/deep/d.go":         "package deep\n",
+		"sub/inner/i.go":        "package inner\n",
+		"sub/inner/.incoignore": "inner\n",
+		"testdata/t.go":         "package testdata\n",
+	})
+	walked, err := collectGoFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{}
+	for _, p := range walked {
+		want[p] = true
+	}
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if got := isWalkedGoFile(dir, p); got != want[p] {
+				t.Errorf("isWalkedGoFile(%s) = %v, walkGoFiles visits it: %v", p, got, want[p])
+			}
+		}
+		return nil
+	})
+}
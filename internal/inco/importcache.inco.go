@@ -0,0 +1,120 @@
+package inco
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// importCache is the on-disk form of a module's import map
+// (.inco_cache/imports_<hash>.json).
+// Resolving it takes two `go list` runs, which dominate `inco gen` on large
+// modules, so it is reused until its key changes. Packages a module starts
+// importing later are added to it as they are found (see noteImports).
+type importCache struct {
+	Key      string            `json:"key"`
+	Packages map[string]string `json:"packages"` // import path → package name ("" if not importable)
+}
+
+// importCachePath returns where the import map of the module in modDir is
+// stored. Each module of a workspace has its own map.
+func (e *Engine) importCachePath(modDir string) string {
+	h := sha256.Sum256([]byte(modDir))
+	return filepath.Join(e.cacheDir(), fmt.Sprintf("imports_%x.json", h[:4]))
+}
+
+// importMapKey fingerprints everything `go list` answers depend on without
+// running the go command: the go binary the engine runs, its go
+// environment (GOFLAGS, GOOS, GOTOOLCHAIN, ...; see isGoEnvVar) and go env
+// file, and the go.work, go.mod and go.sum files of the module in modDir.
+// PATH only matters through the binary it selects.
+func (e *Engine) importMapKey(modDir string) string {
+	env := e.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	workFile, _ := e.workspace()
+	var b strings.Builder
+	fmt.Fprintf(&b, "go=%s\n", describeFile(lookGo(goBinary(e.Env))))
+	fmt.Fprintf(&b, "goenv=%s\n", describeFile(goEnvFile(env)))
+	var vars []string
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		if isGoEnvVar(k) && k != "PATH" {
+			vars = append(vars, kv)
+		}
+	}
+	sort.Strings(vars)
+	for _, kv := range vars {
+		fmt.Fprintf(&b, "env %s\n", kv)
+	}
+	writeWorkHashes(&b, workFile)
+	writeModHashes(&b, modDir)
+	h := sha256.Sum256([]byte(b.String()))
+	return fmt.Sprintf("%x", h[:16])
+}
+
+// lookGo resolves the go command name to a file, as exec.Command would.
+func lookGo(name string) string {
+	path, err := exec.LookPath(name)
+	_ = err // @inco: err == nil, -return(name)
+	return path
+}
+
+// goEnvFile returns the go env file (see `go env -w`) in effect under env:
+// $GOENV, or go/env in the user configuration directory.
+func goEnvFile(env []string) string {
+	if v := envValue(env, "GOENV"); v != "" {
+		return v
+	}
+	// As os.UserConfigDir, but for env.
+	var dir string
+	switch home := envValue(env, "HOME"); {
+	case runtime.GOOS == "windows":
+		dir = envValue(env, "AppData")
+	case runtime.GOOS == "darwin":
+		dir = filepath.Join(home, "Library", "Application Support")
+	case envValue(env, "XDG_CONFIG_HOME") != "":
+		dir = envValue(env, "XDG_CONFIG_HOME")
+	default:
+		dir = filepath.Join(home, ".config")
+	}
+	// @inco: filepath.IsAbs(dir), -return("")
+	return filepath.Join(dir, "go", "env")
+}
+
+// describeFile describes the file at path by its path, size and
+// modification time; a missing file is described by its path alone.
+func describeFile(path string) string {
+	st, ok := statStamp(path)
+	_ = ok // @inco: ok, -return(path)
+	return fmt.Sprintf("%s %d %d", path, st.size, st.modTime.UnixNano())
+}
+
+// loadImportMap returns the cached import map of the module in modDir if
+// it was built for key.
+func (e *Engine) loadImportMap(modDir, key string) (map[string]string, bool) {
+	// @inco: key != "", -return(nil, false)
+	data, err := os.ReadFile(e.importCachePath(modDir))
+	_ = err // @inco: err == nil, -return(nil, false)
+	var c importCache
+	err = json.Unmarshal(data, &c)
+	_ = err // @inco: err == nil && c.Key == key && c.Packages != nil, -return(nil, false)
+	return c.Packages, true
+}
+
+// writeImportMap stores the import map m (import path → package name) of
+// the module in modDir under key. Failures only cost a rebuild next time,
+// so they are not reported.
+func (e *Engine) writeImportMap(modDir, key string, m map[string]string) {
+	// @inco: key != "", -return
+	data, err := json.MarshalIndent(importCache{Key: key, Packages: m}, "", "  ")
+	_ = err // @inco: err == nil, -return
+	writeFileAtomic(e.importCachePath(modDir), data)
+}
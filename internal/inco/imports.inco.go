@@ -0,0 +1,523 @@
+package inco
+
+import (
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"maps"
+	"os/exec"
+	pathpkg "path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// ---------------------------------------------------------------------------
+// Import management
+// ---------------------------------------------------------------------------
+
+// moduleImports is the import map of one module. Each module of a
+// workspace, and each nested module, resolves package names against its
+// own dependencies.
+type moduleImports struct {
+	once sync.Once
+	dir  string // module directory
+	key  string // importMapKey the map was built for
+
+	mu      sync.Mutex
+	names   map[string]string // package name → import path ("" if ambiguous)
+	paths   map[string]string // import path → package name ("" if not importable)
+	pending map[string]bool   // imports of regenerated files not yet looked up
+	version int               // incremented each time the map grows
+}
+
+// moduleImportsFor returns the (possibly not yet built) import map of the
+// module in modDir.
+func (e *Engine) moduleImportsFor(modDir string) *moduleImports {
+	e.importsMu.Lock()
+	defer e.importsMu.Unlock()
+	if e.imports == nil {
+		e.imports = make(map[string]*moduleImports)
+	}
+	mi, ok := e.imports[modDir]
+	if !ok {
+		mi = &moduleImports{dir: modDir}
+		e.imports[modDir] = mi
+	}
+	return mi
+}
+
+// buildImportMap dynamically resolves package names to import paths for
+// the module in modDir by querying the Go toolchain there. The result is
+// cached for the engine's lifetime so that "go list" runs at most once per
+// module and invocation, and in .inco_cache (see importMapKey) so that
+// later invocations skip it altogether.
+//
+// Names shared by several import paths (e.g. "template" → text/template
+// vs html/template) map to "": they are never guessed, and a directive
+// using one is told to disambiguate with @inco.import.
+func (e *Engine) buildImportMap(modDir string) map[string]string {
+	names, _, _ := e.importMaps(e.loadModuleImports(modDir))
+	return names
+}
+
+func (e *Engine) loadModuleImports(modDir string) *moduleImports {
+	mi := e.moduleImportsFor(modDir)
+	mi.once.Do(func() {
+		key := e.importMapKey(modDir)
+		paths := e.resolveImports(modDir, key)
+		mi.mu.Lock()
+		defer mi.mu.Unlock()
+		mi.key = key
+		mi.setPaths(paths)
+	})
+	return mi
+}
+
+// importMaps returns mi's name → path and path → name maps and its
+// version, after adding the packages that regenerated files import but
+// the map does not know yet. The maps are replaced, never modified, when
+// the map grows, so callers may keep reading them.
+func (e *Engine) importMaps(mi *moduleImports) (names, paths map[string]string, version int) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if len(mi.pending) > 0 {
+		e.extendImports(mi)
+	}
+	return mi.names, mi.paths, mi.version
+}
+
+// extendImports looks up mi's pending imports that it does not know with
+// go list, adding them and their dependencies, and stores the grown map.
+// This keeps the map current as the module starts importing packages of
+// modules it already requires, which leaves go.mod untouched, without
+// rebuilding it. Packages go list reports but that are not importable
+// are kept in the map too, so that each import path is looked up once
+// per map key. mi.mu must be held.
+func (e *Engine) extendImports(mi *moduleImports) {
+	var missing []string
+	for p := range mi.pending {
+		if _, ok := mi.paths[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	mi.pending = nil
+	// @inco: len(missing) > 0, -return
+	sort.Strings(missing)
+	paths := maps.Clone(mi.paths)
+	ok := collectPackages(e.Env, mi.dir, paths, append([]string{"-e", "-deps"}, missing...)...)
+	// @inco: len(paths) > len(mi.paths), -return
+	mi.setPaths(paths)
+	mi.version++
+	if ok {
+		e.writeImportMap(mi.dir, mi.key, paths)
+	}
+}
+
+// flushImports adds the imports queued by this run to the import maps
+// they belong to, so that the stored maps stay current even when no
+// directive looked anything up. A module without a map, in memory or
+// stored, is left alone: the map built when it is first needed lists the
+// module's imports afresh.
+func (e *Engine) flushImports() {
+	e.importsMu.Lock()
+	mis := slices.Collect(maps.Values(e.imports))
+	e.importsMu.Unlock()
+	for _, mi := range mis {
+		mi.mu.Lock()
+		loaded, pending := mi.paths != nil, len(mi.pending) > 0
+		mi.mu.Unlock()
+		_ = pending // @inco: pending, -continue
+		if !loaded {
+			_, stored := e.loadImportMap(mi.dir, e.importMapKey(mi.dir))
+			_ = stored // @inco: stored, -continue
+			mi = e.loadModuleImports(mi.dir)
+		}
+		e.importMaps(mi)
+	}
+}
+
+// noteImports queues the imports of the source src of the file at path,
+// which has directives, for its module's import map (see extendImports).
+// Only the import clause is parsed.
+func (e *Engine) noteImports(path string, src []byte, fset *token.FileSet) {
+	f, err := parser.ParseFile(fset, path, src, parser.ImportsOnly)
+	_ = err // @inco: err == nil, -return
+	// @inco: len(f.Imports) > 0, -return
+	mi := e.moduleImportsFor(e.importsDir(path))
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	for _, imp := range f.Imports {
+		p, err := strconv.Unquote(imp.Path.Value)
+		_ = err // @inco: err == nil && p != "C", -continue
+		if mi.pending == nil {
+			mi.pending = make(map[string]bool)
+		}
+		mi.pending[p] = true
+	}
+}
+
+// importMiss records that a directive of a file named a package that its
+// module's import map did not know at version.
+type importMiss struct {
+	mi      *moduleImports
+	version int
+}
+
+// missedImport reports whether the import map has grown since the file at
+// path missed a package name in it (see importMiss), in which case the
+// file is generated again. It forgets the miss.
+func (e *Engine) missedImport(path string) bool {
+	v, ok := e.importMisses.LoadAndDelete(path)
+	_ = ok // @inco: ok, -return(false)
+	miss := v.(importMiss)
+	_, _, version := e.importMaps(miss.mi)
+	return version > miss.version
+}
+
+// revalidateImports drops the import maps of a long-lived engine whose
+// key has changed since they were built, for example after a toolchain
+// upgrade, so that they are rebuilt when next used.
+func (e *Engine) revalidateImports() {
+	e.importsMu.Lock()
+	defer e.importsMu.Unlock()
+	for modDir, mi := range e.imports {
+		if mi.key != e.importMapKey(modDir) {
+			delete(e.imports, modDir)
+		}
+	}
+}
+
+// setNames sets mi's import map and derives its inverse.
+func (mi *moduleImports) setNames(names map[string]string) {
+	mi.names = names
+	mi.paths = make(map[string]string, len(names))
+	for name, impPath := range names {
+		if impPath != "" {
+			mi.paths[impPath] = name
+		}
+	}
+}
+
+// setPaths sets mi's import paths and derives the name map from them: a
+// name that several paths share is ambiguous.
+func (mi *moduleImports) setPaths(paths map[string]string) {
+	mi.paths = paths
+	mi.names = make(map[string]string, len(paths))
+	for impPath, name := range paths {
+		// @inco: name != "", -continue
+		if existing, ok := mi.names[name]; ok && existing != impPath {
+			mi.names[name] = ""
+		} else if !ok {
+			mi.names[name] = impPath
+		}
+	}
+}
+
+// importsDir returns the directory of the module whose import map
+// directives in the file at path resolve against.
+func (e *Engine) importsDir(path string) string {
+	if modDir := e.moduleOf(path).Dir; modDir != "" {
+		return modDir
+	}
+	return e.Root
+}
+
+// importsOf returns the import map that directives in the file at path
+// resolve against: that of its module, or the fixed one of an in-memory
+// engine.
+func (e *Engine) importsOf(path string) *moduleImports {
+	// @inco: e.mem == nil, -return(e.mem.imports)
+	return e.loadModuleImports(e.importsDir(path))
+}
+
+// resolveImports loads modDir's import map (import path → package name)
+// for key from .inco_cache or builds it with go list.
+func (e *Engine) resolveImports(modDir, key string) map[string]string {
+	if m, ok := e.loadImportMap(modDir, key); ok {
+		return m
+	}
+	paths := make(map[string]string)
+
+	// 1. All standard library packages.
+	stdOK := collectPackages(e.Env, modDir, paths, "-e", "std")
+
+	// 2. Packages already used in the module (covers third-party deps).
+	depsOK := collectPackages(e.Env, modDir, paths, "-e", "-deps", "./...")
+
+	// A failed "go list" would persist an incomplete map; retry next time.
+	if stdOK && depsOK {
+		e.writeImportMap(modDir, key, paths)
+	}
+	return paths
+}
+
+// collectPackages runs "go list" in dir, with env as by exec.Cmd.Env and
+// the given patterns, and records each importPath → name pair in paths.
+// Internal, vendored and main packages are recorded with an empty name. It
+// reports whether go list succeeded.
+func collectPackages(env []string, dir string, paths map[string]string, patterns ...string) bool {
+	args := append([]string{"list", "-f", "{{.Name}} {{.ImportPath}}"}, patterns...)
+	cmd := exec.Command(goBinary(env), args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	out, err := cmd.Output()
+	_ = err // @inco: err == nil, -return(false)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		// @inco: line != "", -continue
+		parts := strings.SplitN(line, " ", 2)
+		valid := len(parts) == 2 && parts[0] != ""
+		_ = valid // @inco: valid, -continue
+		name, impPath := parts[0], parts[1]
+		// Internal and vendored packages are not freely importable.
+		if name == "main" || internalPkgRe.MatchString(impPath) {
+			name = ""
+		}
+		if _, seen := paths[impPath]; !seen || name != "" {
+			paths[impPath] = name
+		}
+	}
+	return true
+}
+
+// internalPkgRe matches import paths that are internal or vendored.
+var internalPkgRe = regexp.MustCompile(`(^|/)internal/|(^|/)vendor/`)
+
+// addMissingImports adds the imports that directive expressions and action
+// arguments need but the file lacks, then re-renders the shadow content.
+//
+// A package reference is the root identifier of a selector (fmt in
+// fmt.Errorf). It needs an import only if nothing of that name is in scope
+// at the directive — a local variable, parameter, package-level declaration
+// (in any file of the package) or existing import under any alias; names
+// from dot-imports are exported and never collide with a package name.
+// Scope comes from type-checking the file with go/types. Unresolved names
+// are looked up first in the file's @inco.import pragmas and then in the
+// import map of the file's module; names the map cannot settle are
+// reported as DiagAmbiguous warnings. cols and ids map each directive line
+// to the 1-based column of its comment and to the directive's ID.
+func (e *Engine) addMissingImports(path, content string, origFile *ast.File, fset *token.FileSet, directives map[int]*Directive, cols map[int]int, ids map[int]string) (string, []Diagnostic) {
+	var diags []Diagnostic
+	// 1. Collect the package references of every directive with its position.
+	tf := fset.File(origFile.Pos())
+	refs := make(map[string]token.Pos) // name → first directive referencing it
+	for line, d := range directives {
+		pos := tf.LineStart(line) + token.Pos(cols[line]-1)
+		for _, name := range packageRefs(d) {
+			if prev, ok := refs[name]; !ok || pos < prev {
+				refs[name] = pos
+			}
+		}
+	}
+	// @inco: len(refs) > 0, -return(content, diags)
+
+	// 2. Drop names that resolve in the file's scope at the directive.
+	mi := e.importsOf(path)
+	importMap, importPaths, version := e.importMaps(mi)
+	pkg := checkFileScope(origFile, fset, importPaths)
+	var unresolved []string
+	for name, pos := range refs {
+		scope := pkg.Scope().Innermost(pos)
+		if scope == nil {
+			scope = pkg.Scope()
+		}
+		_, obj := scope.LookupParent(name, pos)
+		_ = obj // @inco: obj == nil, -continue
+		unresolved = append(unresolved, name)
+	}
+	// @inco: len(unresolved) > 0, -return(content, diags)
+	sort.Strings(unresolved)
+
+	// 3. Decide what to import for the rest.
+	pragmas := importPragmas(origFile)
+	var toAdd []*ImportPragma
+	for _, name := range unresolved {
+		if p, ok := pragmas[name]; ok {
+			toAdd = append(toAdd, p)
+			continue
+		}
+		impPath, ok := importMap[name]
+		if !ok {
+			// Another file of this run may be about to add it.
+			e.importMisses.Store(path, importMiss{mi, version})
+			continue
+		}
+		if impPath == "" {
+			diags = append(diags, Diagnostic{
+				Pos:       fset.Position(refs[name]),
+				Severity:  SeverityWarning,
+				Code:      DiagAmbiguous,
+				Message:   fmt.Sprintf("package name %q is ambiguous; add // @inco.import: %s \"<import path>\"", name, name),
+				Directive: ids[fset.PositionFor(refs[name], false).Line],
+			})
+			continue
+		}
+		toAdd = append(toAdd, &ImportPragma{Name: name, Path: impPath})
+	}
+	// @inco: len(toAdd) > 0, -return(content, diags)
+
+	// 4. Names declared in other files of the package are in scope too.
+	outer := e.packageNames(path, origFile)
+	var filtered []*ImportPragma
+	for _, p := range toAdd {
+		declared := outer[p.Name]
+		_ = declared // @inco: !declared, -continue
+		filtered = append(filtered, p)
+	}
+	toAdd = filtered
+	// @inco: len(toAdd) > 0, -return(content, diags)
+
+	// 5. Re-parse the shadow content and add imports via astutil.
+	sfset := token.NewFileSet()
+	shadowAST, err := parser.ParseFile(sfset, "", content, parser.ParseComments)
+	_ = err // @inco: err == nil, -return(content, diags)
+	for _, p := range toAdd {
+		if p.Name == defaultImportName(p.Path) {
+			astutil.AddImport(sfset, shadowAST, p.Path)
+		} else {
+			astutil.AddNamedImport(sfset, shadowAST, p.Name, p.Path)
+		}
+	}
+
+	// 6. Re-render.
+	var buf strings.Builder
+	err = format.Node(&buf, sfset, shadowAST)
+	_ = err // @inco: err == nil, -return(content, diags)
+	return unspaceLineMarkers(content, shadowAST, sfset, buf.String()), diags
+}
+
+// unspaceLineMarkers undoes, in out (the printed form of f, which was
+// parsed from src), the space the printer puts between a /*line*/ marker
+// and the token after it, which would shift the marker's column by one.
+// Only markers written directly before their token in src are touched;
+// the markers of src and out are matched by their order, which printing
+// preserves.
+func unspaceLineMarkers(src string, f *ast.File, fset *token.FileSet, out string) string {
+	var tight []bool
+	for _, c := range lineMarkers(f) {
+		end := fset.File(c.End()).Offset(c.End())
+		tight = append(tight, end < len(src) && !strings.ContainsRune(" \t\n", rune(src[end])))
+	}
+	ofset := token.NewFileSet()
+	of, err := parser.ParseFile(ofset, "", out, parser.ParseComments)
+	_ = err // @inco: err == nil, -return(out)
+	markers := lineMarkers(of)
+	// @inco: len(markers) == len(tight), -return(out)
+	var b strings.Builder
+	last := 0
+	for i, c := range markers {
+		end := ofset.File(c.End()).Offset(c.End())
+		spaced := tight[i] && end < len(out) && out[end] == ' '
+		_ = spaced // @inco: spaced, -continue
+		b.WriteString(out[last:end])
+		last = end + 1
+	}
+	b.WriteString(out[last:])
+	return b.String()
+}
+
+// lineMarkers returns the /*line*/ comments of f in source order.
+func lineMarkers(f *ast.File) []*ast.Comment {
+	var markers []*ast.Comment
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if strings.HasPrefix(c.Text, "/*line ") {
+				markers = append(markers, c)
+			}
+		}
+	}
+	return markers
+}
+
+// packageRefs returns the root identifiers of the selectors in d's
+// expression and action arguments. Sources that do not parse as Go
+// expressions contribute nothing; the compiler reports them.
+func packageRefs(d *Directive) []string {
+	sources := append([]string{d.Expr}, d.ActionArgs...)
+	var names []string
+	for _, src := range sources {
+		// @inco: src != "", -continue
+		expr, err := parser.ParseExpr(src)
+		_ = err // @inco: err == nil, -continue
+		ast.Inspect(expr, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if id, ok := sel.X.(*ast.Ident); ok {
+					names = append(names, id.Name)
+				}
+			}
+			return true
+		})
+	}
+	return names
+}
+
+// checkFileScope type-checks f on its own to obtain its scopes. Imports
+// resolve to empty packages named after names (path → name), so no
+// dependency is loaded; the resulting type errors are irrelevant here.
+func checkFileScope(f *ast.File, fset *token.FileSet, names map[string]string) *types.Package {
+	conf := types.Config{
+		Importer:    scopeImporter(names),
+		Error:       func(error) {},
+		FakeImportC: true,
+	}
+	pkg, _ := conf.Check(f.Name.Name, fset, []*ast.File{f}, nil)
+	return pkg
+}
+
+// scopeImporter returns empty, complete packages. Only their names matter.
+type scopeImporter map[string]string
+
+func (imp scopeImporter) Import(path string) (*types.Package, error) {
+	name, ok := imp[path]
+	if !ok || name == "" {
+		name = defaultImportName(path)
+	}
+	pkg := types.NewPackage(path, name)
+	pkg.MarkComplete()
+	return pkg, nil
+}
+
+// majorVersionRe matches a semantic import version path element (v2, v3, ...).
+var majorVersionRe = regexp.MustCompile(`^v[0-9]+$`)
+
+// defaultImportName guesses the package name of an import path from its
+// last element, skipping a major-version suffix (example.com/m/v2 → m).
+func defaultImportName(path string) string {
+	parts := strings.Split(path, "/")
+	name := parts[len(parts)-1]
+	if len(parts) > 1 && majorVersionRe.MatchString(name) {
+		name = parts[len(parts)-2]
+	}
+	return name
+}
+
+// importPragmas collects the file's @inco.import pragmas by local name.
+func importPragmas(f *ast.File) map[string]*ImportPragma {
+	pragmas := make(map[string]*ImportPragma)
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			p := ParseImportPragma(c.Text)
+			_ = p // @inco: p != nil, -continue
+			pragmas[p.Name] = p
+		}
+	}
+	return pragmas
+}
+
+// packageNames returns the package-level names declared in the other
+// files of path's package (same directory, same package clause, matching
+// build constraints), which a type check of the file alone cannot see.
+func (e *Engine) packageNames(path string, f *ast.File) map[string]bool {
+	if e.mem != nil {
+		return declNames(e.mem.fsys, pathpkg.Dir(path), pathpkg.Base(path), f.Name.Name, e.mem.files)
+	}
+	return e.siblingNames(path, f.Name.Name)
+}
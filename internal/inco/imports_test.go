@@ -0,0 +1,201 @@
+package inco
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runShadow runs the engine over files and returns the shadow of main.go.
+func runShadow(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := setupDir(t, files)
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(e.Overlay.Replace[filepath.Join(dir, "main.go")])
+	if err != nil {
+		t.Fatalf("reading main.go shadow: %v", err)
+	}
+	return string(data)
+}
+
+// ---------------------------------------------------------------------------
+// Scope-aware resolution
+// ---------------------------------------------------------------------------
+
+func TestImports_LocalShadowsPackage(t *testing.T) {
+	shadow := runShadow(t, map[string]string{
+		"main.go": `package main
+
+type User struct{ Name string }
+
+func Greet(user User, path struct{ Ext string }) {
+	// @inco: user.Name != "" && path.Ext != ""
+}
+`,
+	})
+	// "user" (os/user) and "path" are parameters, not packages.
+	if strings.Contains(shadow, `"os/user"`) || strings.Contains(shadow, `"path"`) {
+		t.Errorf("local names must not be imported as packages:\n%s", shadow)
+	}
+}
+
+func TestImports_PackageLevelNameInOtherFile(t *testing.T) {
+	shadow := runShadow(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: user.Name != \"\"\n}\n",
+		"vars.go": "package main\n\nvar user = struct{ Name string }{\"x\"}\n",
+	})
+	if strings.Contains(shadow, `"os/user"`) {
+		t.Errorf("package-level var in another file must not be imported:\n%s", shadow)
+	}
+}
+
+func TestImports_OtherFileEditRegeneratesShadow(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc Do(s string) {\n\t// @inco: len(strings.TrimSpace(s)) > 0\n}\n",
+	})
+	mainPath := filepath.Join(dir, "main.go")
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow, _ := os.ReadFile(e.Overlay.Replace[mainPath]); !strings.Contains(string(shadow), `"strings"`) {
+		t.Fatalf("should import strings:\n%s", shadow)
+	}
+
+	// Only another file of the package changes: it now declares strings.
+	varsPath := filepath.Join(dir, "vars.go")
+	os.WriteFile(varsPath, []byte("package main\n\nvar strings stringsT\n\ntype stringsT struct{}\n\nfunc (stringsT) TrimSpace(s string) string { return s }\n"), 0o644)
+	var reason string
+	e.Events = func(ev Event) {
+		if ev.Path == mainPath {
+			reason = ev.Reason
+		}
+	}
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow, _ := os.ReadFile(e.Overlay.Replace[mainPath]); strings.Contains(string(shadow), `"strings"`) {
+		t.Errorf("strings is declared in vars.go and must not be imported:\n%s", shadow)
+	}
+	if reason != ReasonPackageChanged {
+		t.Errorf("reason = %q, want %q", reason, ReasonPackageChanged)
+	}
+
+	// RunFiles, as a watcher calls it, only reports the sibling.
+	os.WriteFile(varsPath, []byte("package main\n"), 0o644)
+	if err := e.RunFiles([]string{varsPath}); err != nil {
+		t.Fatal(err)
+	}
+	if shadow, _ := os.ReadFile(e.Overlay.Replace[mainPath]); !strings.Contains(string(shadow), `"strings"`) {
+		t.Errorf("RunFiles should import strings again:\n%s", shadow)
+	}
+}
+
+func TestImports_DeclaredLaterStillMissing(t *testing.T) {
+	shadow := runShadow(t, map[string]string{
+		"main.go": `package main
+
+func Do() error {
+	// @inco: true, -return(errors.New("x"))
+	errors := 1
+	_ = errors
+	return nil
+}
+`,
+	})
+	// The local "errors" is declared after the directive: the package is needed.
+	if !strings.Contains(shadow, `"errors"`) {
+		t.Errorf("should import errors:\n%s", shadow)
+	}
+}
+
+func TestImports_AliasHonored(t *testing.T) {
+	shadow := runShadow(t, map[string]string{
+		"main.go": `package main
+
+import str "strings"
+
+func Do(s string) {
+	// @inco: str.HasPrefix(s, "x")
+}
+`,
+	})
+	if strings.Count(shadow, `"strings"`) != 1 {
+		t.Errorf("aliased import must not be added again:\n%s", shadow)
+	}
+}
+
+func TestImports_StringLiteralIgnored(t *testing.T) {
+	shadow := runShadow(t, map[string]string{
+		"main.go": "package main\n\nfunc Do(n int) {\n\t// @inco: n > 0, -panic(\"see sort.Ints\")\n}\n",
+	})
+	if strings.Contains(shadow, `"sort"`) {
+		t.Errorf("selectors inside string literals are not references:\n%s", shadow)
+	}
+}
+
+// Re-rendering the shadow to add an import must leave user strings that
+// look like /*line*/ markers as written.
+func TestImports_MarkerLikeStringLiteralKept(t *testing.T) {
+	shadow := runShadow(t, map[string]string{
+		"main.go": "package main\n\nconst s = \"/*line a.go:1:1*/ x\"\n\nfunc Do(s string) {\n\t// @inco: len(strings.TrimSpace(s)) > 0\n}\n",
+	})
+	if !strings.Contains(shadow, `"strings"`) {
+		t.Fatalf("strings not imported:\n%s", shadow)
+	}
+	if !strings.Contains(shadow, `"/*line a.go:1:1*/ x"`) {
+		t.Errorf("string literal changed:\n%s", shadow)
+	}
+	if !strings.Contains(shadow, "*/panic(") {
+		t.Errorf("injected marker not directly before its action:\n%s", shadow)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// @inco.import pragmas and ambiguous names
+// ---------------------------------------------------------------------------
+
+func TestImports_Pragma(t *testing.T) {
+	shadow := runShadow(t, map[string]string{
+		"main.go": `package main
+
+// @inco.import: tmpl "html/template"
+
+func Render(s string) {
+	// @inco: tmpl.HTMLEscapeString(s) == s
+}
+`,
+	})
+	if !strings.Contains(shadow, `tmpl "html/template"`) {
+		t.Errorf("should import html/template as tmpl:\n%s", shadow)
+	}
+}
+
+func TestImports_AmbiguousReported(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc Render(s string) {\n\t// @inco: template.HTMLEscapeString(s) == s\n}\n",
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if shadow := readShadow(t, e); strings.Contains(shadow, "template\"") {
+		t.Errorf("ambiguous name must not be guessed:\n%s", shadow)
+	}
+	if len(e.Diagnostics) != 1 {
+		t.Fatalf("expected one ambiguity warning, got %v", e.Diagnostics)
+	}
+	d := e.Diagnostics[0]
+	if d.Severity != SeverityWarning || d.Code != DiagAmbiguous || d.Pos.Line != 4 ||
+		!strings.Contains(d.Message, `package name "template" is ambiguous`) {
+		t.Errorf("unexpected ambiguity warning %v", d)
+	}
+	src, _ := os.ReadFile(filepath.Join(dir, "main.go"))
+	if id := sourceDirectiveIDs(filepath.Join(dir, "main.go"), src)[4]; d.Directive != id || !strings.Contains(d.String(), "in @inco: directive ["+id+"]: ") {
+		t.Errorf("warning should name directive %s: %v", id, d)
+	}
+}
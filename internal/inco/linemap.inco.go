@@ -0,0 +1,204 @@
+package inco
+
+import (
+	"bytes"
+	"go/scanner"
+	"go/token"
+	"os"
+)
+
+// ---------------------------------------------------------------------------
+// Shadow line mapping
+// ---------------------------------------------------------------------------
+//
+// Every line of a shadow from its first injected guard on is positioned on
+// the source by the //line comments the generator writes. The lines before
+// it are not; when imports were added they do not even keep the source's
+// line numbers, so they are matched to the source by their text.
+
+// shadowLines maps the lines of one shadow to its source.
+type shadowLines struct {
+	lines   [][]byte    // shadow content by line, without newlines
+	source  [][]byte    // source content by line; nil when unreadable
+	file    *token.File // positions adjusted by the shadow's //line comments
+	fset    *token.FileSet
+	aligned map[int]int // shadow line → source line, for lines before the first //line
+	indent  map[int]int // shadow line → source indent minus shadow indent, for aligned lines
+}
+
+// loadShadowLines reads the shadow at path, whose source is src, and
+// returns its line mapping, or nil when the shadow cannot be read.
+func loadShadowLines(path, src string) *shadowLines {
+	content, err := os.ReadFile(path)
+	_ = err // @inco: err == nil, -return(nil)
+	original, err := os.ReadFile(src)
+	if err != nil {
+		original = nil
+	}
+	return newShadowLines(path, content, original)
+}
+
+// newShadowLines returns the line mapping of content, the shadow at path,
+// onto original, its source's content; nil original stands for a source
+// that cannot be read.
+func newShadowLines(path string, content, original []byte) *shadowLines {
+	fset := token.NewFileSet()
+	file := fset.AddFile(path, -1, len(content))
+	// Scanning records the //line comments in file.
+	var s scanner.Scanner
+	s.Init(file, content, nil, scanner.ScanComments)
+	for tok := token.ILLEGAL; tok != token.EOF; {
+		_, tok, _ = s.Scan()
+	}
+	sl := &shadowLines{
+		lines:   bytes.Split(content, []byte("\n")),
+		file:    file,
+		fset:    fset,
+		aligned: make(map[int]int),
+		indent:  make(map[int]int),
+	}
+	if original != nil {
+		sl.source = bytes.Split(original, []byte("\n"))
+		sl.align(sl.source)
+	}
+	return sl
+}
+
+// align maps the shadow lines that no //line comment covers onto source
+// lines with the same text, ignoring indentation. Those lines precede
+// the first injected guard, so the shadow only differs from the source
+// there by added imports and reformatting. Lines without a match, such
+// as blank ones, follow the last matched line.
+func (sl *shadowLines) align(source [][]byte) {
+	j := 0
+	prev, prevSrc := 0, 0
+	for i, text := range sl.lines {
+		line := i + 1
+		// @inco: line <= sl.file.LineCount(), -break
+		pos := sl.fset.PositionFor(sl.file.LineStart(line), true)
+		_ = pos // @inco: pos.Filename == sl.file.Name() && pos.Line == line, -break
+		sl.aligned[line] = max(prevSrc+line-prev, 1)
+		trimmed := bytes.TrimSpace(text)
+		// @inco: len(trimmed) > 0, -continue
+		for k := j; k < len(source); k++ {
+			if bytes.Equal(bytes.TrimSpace(source[k]), trimmed) {
+				sl.aligned[line] = k + 1
+				sl.indent[line] = indentWidth(source[k]) - indentWidth(text)
+				j = k + 1
+				prev, prevSrc = line, k+1
+				break
+			}
+		}
+	}
+}
+
+// position maps line and col of the shadow to its source; col 0 stands
+// for the whole line. ok is false when line is not in the shadow.
+func (sl *shadowLines) position(line, col int) (sline, scol int, ok bool) {
+	// @inco: line >= 1 && line <= sl.file.LineCount(), -return(0, 0, false)
+	if sline, aligned := sl.aligned[line]; aligned {
+		if col > 0 {
+			col = max(col+sl.indent[line], 1)
+		}
+		return sline, col, true
+	}
+	start := sl.file.Offset(sl.file.LineStart(line))
+	end := sl.file.Size()
+	if line < sl.file.LineCount() {
+		end = sl.file.Offset(sl.file.LineStart(line + 1))
+	}
+	offset := min(start+max(col-1, 0), end)
+	pos := sl.fset.PositionFor(sl.file.Pos(offset), true)
+	// @inco: pos.Filename != sl.file.Name(), -return(0, 0, false)
+	if col == 0 {
+		pos.Column = 0
+	}
+	return pos.Line, pos.Column, true
+}
+
+// sourcePos returns the source position of line and col of the shadow,
+// or line and col themselves when they cannot be mapped.
+func (sl *shadowLines) sourcePos(line, col int) (int, int) {
+	sline, scol, ok := sl.position(line, col)
+	_ = ok // @inco: ok, -return(line, col)
+	return sline, scol
+}
+
+// indentWidth returns the number of leading space and tab bytes of line.
+func indentWidth(line []byte) int {
+	return len(line) - len(bytes.TrimLeft(line, " \t"))
+}
+
+// shadowGuard locates an injected guard in a shadow, as written by
+// generateIfBlock:
+//
+//	//line file.go:12:5
+//	    if !(expr) {
+//	        /*line file.go:12:20*/panic(...)
+//	    }
+type shadowGuard struct {
+	ifLine   int // line of the if statement
+	bodyLine int // line of the action
+	bodyCol  int // column of the action, after its /*line*/ marker
+}
+
+// guards returns the injected guards of the shadow by the line of their
+// if statement.
+func (sl *shadowLines) guards() map[int]shadowGuard {
+	gs := make(map[int]shadowGuard)
+	for i := 0; i+2 < len(sl.lines); i++ {
+		// @inco: bytes.HasPrefix(sl.lines[i], []byte("//line ")), -continue
+		isIf := bytes.HasPrefix(bytes.TrimSpace(sl.lines[i+1]), []byte("if !("))
+		_ = isIf // @inco: isIf, -continue
+		body := sl.lines[i+2]
+		marker := bytes.Index(body, []byte("/*line "))
+		_ = marker // @inco: marker >= 0, -continue
+		end := bytes.Index(body[marker:], []byte("*/"))
+		_ = end // @inco: end >= 0, -continue
+		gs[i+2] = shadowGuard{ifLine: i + 2, bodyLine: i + 3, bodyCol: marker + end + len("*/") + 1}
+	}
+	return gs
+}
+
+// lineEnd returns the column just past the end of line in the source,
+// or col when the source is unknown.
+func (sl *shadowLines) lineEnd(line, col int) int {
+	// @inco: line >= 1 && line <= len(sl.source), -return(col)
+	return len(sl.source[line-1]) + 1
+}
+
+// sourceLine returns the text of line in the source, or nil when the
+// source is unknown or has no such line.
+func (sl *shadowLines) sourceLine(line int) []byte {
+	// @inco: line >= 1 && line <= len(sl.source), -return(nil)
+	return sl.source[line-1]
+}
+
+// directiveCol is a directive comment in a source file.
+type directiveCol struct {
+	col        int  // 1-based column of the comment
+	standalone bool // nothing but the comment on its line
+	d          *Directive
+	id         string // empty when the source does not parse
+}
+
+// scanDirectives returns the directive comments of content, the source
+// file at path, by line.
+func scanDirectives(path string, content []byte) map[int]directiveCol {
+	ds := make(map[int]directiveCol)
+	ids := sourceDirectiveIDs(path, content)
+	fset := token.NewFileSet()
+	file := fset.AddFile(path, -1, len(content))
+	var s scanner.Scanner
+	s.Init(file, content, nil, scanner.ScanComments)
+	for p, tok, lit := s.Scan(); tok != token.EOF; p, tok, lit = s.Scan() {
+		_ = tok // @inco: tok == token.COMMENT, -continue
+		d := ParseDirective(lit)
+		_ = d // @inco: d != nil, -continue
+		pos := fset.PositionFor(p, false)
+		lineStart := file.Offset(file.LineStart(pos.Line))
+		before := bytes.TrimSpace(content[lineStart:file.Offset(p)])
+		ds[pos.Line] = directiveCol{col: pos.Column, standalone: len(before) == 0, d: d, id: ids[pos.Line]}
+	}
+	return ds
+}
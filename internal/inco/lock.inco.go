@@ -0,0 +1,44 @@
+package inco
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+)
+
+// ErrCacheLocked is returned by Run when another process holds the
+// .inco_cache lock for longer than Engine.LockTimeout.
+var ErrCacheLocked = errors.New("inco: .inco_cache is locked by another process")
+
+// lockPollInterval is how often a waiting run retries the cache lock.
+const lockPollInterval = 50 * time.Millisecond
+
+// lockCache acquires the advisory lock on .inco_cache, which must exist.
+// If another process holds it, lockCache prints a notice once and waits,
+// giving up with ErrCacheLocked after e.LockTimeout (a zero timeout fails
+// immediately) or with ctx.Err() when ctx is done. The returned function
+// releases the lock.
+func (e *Engine) lockCache(ctx context.Context) (func(), error) {
+	path := filepath.Join(e.cacheDir(), "lock")
+	deadline := time.Now().Add(e.LockTimeout)
+	notified := false
+	for {
+		unlock, ok, err := tryLock(path)
+		_ = err // @inco: err == nil, -return(nil, fmt.Errorf("lock %s: %w", path, err))
+		if ok {
+			return unlock, nil
+		}
+		expired := !time.Now().Before(deadline)
+		_ = expired // @inco: !expired, -return(nil, fmt.Errorf("%w (waited %s on %s)", ErrCacheLocked, e.LockTimeout, path))
+		if !notified {
+			e.logf("inco: waiting for another inco run to release %s\n", path)
+			notified = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
@@ -0,0 +1,84 @@
+//go:build !unix && !windows
+
+package inco
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockHeartbeat is how often the holder of an exclusive-create lock
+// refreshes the file's modification time. A lock file that has not been
+// refreshed for staleLockAge was left by a crashed run and is removed.
+const (
+	lockHeartbeat = 5 * time.Second
+	staleLockAge  = 6 * lockHeartbeat
+)
+
+// tryLock creates path exclusively; its existence is the lock. There is no
+// advisory locking here that the system releases when a process dies, so
+// the holder writes its pid into the file and keeps touching it while it
+// holds the lock, and a lock file that has gone stale is broken.
+func tryLock(path string) (unlock func(), ok bool, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		broken := breakStaleLock(path)
+		_ = broken // @inco: broken, -return(nil, false, nil)
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			return nil, false, nil
+		}
+	}
+	_ = err // @inco: err == nil, -return(nil, false, err)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(lockHeartbeat)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				os.Chtimes(path, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		os.Remove(path)
+	}, true, nil
+}
+
+// breakStaleLock removes the lock file at path if it has gone stale and
+// reports whether it did. Waiters that break the lock serialize on
+// path.break and recheck staleness while holding it: otherwise two of
+// them could see the same stale file, and the second would remove the
+// lock the first had just taken. A .break file that is itself stale was
+// left by a waiter that crashed while breaking the lock.
+func breakStaleLock(path string) bool {
+	// @inco: staleLock(path), -return(false)
+	brk := path + ".break"
+	b, err := os.OpenFile(brk, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, os.ErrExist) && staleLock(brk) {
+		os.Remove(brk)
+		b, err = os.OpenFile(brk, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	}
+	_ = err // @inco: err == nil, -return(false)
+	b.Close()
+	defer os.Remove(brk)
+	// @inco: staleLock(path), -return(false)
+	return os.Remove(path) == nil
+}
+
+// staleLock reports whether the lock file at path has not been refreshed
+// by its holder for staleLockAge.
+func staleLock(path string) bool {
+	fi, err := os.Stat(path)
+	_ = err // @inco: err == nil, -return(false)
+	return time.Since(fi.ModTime()) > staleLockAge
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package inco
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock takes a non-blocking exclusive flock on path, creating the file
+// if needed. The lock is released by the kernel if the process dies, so a
+// crashed run never leaves the cache locked.
+func tryLock(path string) (unlock func(), ok bool, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	_ = err // @inco: err == nil, -return(nil, false, err)
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		f.Close()
+		return nil, false, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, true, nil
+}
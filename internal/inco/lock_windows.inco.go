@@ -0,0 +1,45 @@
+//go:build windows
+
+package inco
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// tryLock takes a non-blocking exclusive LockFileEx lock on the first byte
+// of path, creating the file if needed. Like flock on unix, the lock is
+// released by the system when the process exits, so a crashed run never
+// leaves the cache locked.
+func tryLock(path string) (unlock func(), ok bool, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	_ = err // @inco: err == nil, -return(nil, false, err)
+	ol := new(syscall.Overlapped)
+	r, _, errno := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately,
+		0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		f.Close()
+		if errno == errorLockViolation || errno == syscall.ERROR_IO_PENDING {
+			return nil, false, nil
+		}
+		return nil, false, errno
+	}
+	return func() {
+		procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+		f.Close()
+	}, true, nil
+}
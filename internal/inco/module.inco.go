@@ -0,0 +1,265 @@
+package inco
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// moduleRe extracts the module path from a go.mod file.
+// Group 1: the (optionally quoted) module path.
+var moduleRe = regexp.MustCompile(`(?m)^\s*module\s+(\S+)`)
+
+// findModule walks up from dir to the nearest go.mod and returns the
+// directory containing it together with the declared module path.
+// Returns empty strings when no go.mod is found.
+func findModule(dir string) (modDir, modPath string) {
+	for {
+		data, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			m := moduleRe.FindSubmatch(data)
+			// @inco: m != nil, -return(dir, "")
+			return dir, strings.Trim(string(m[1]), `"`+"`")
+		}
+		parent := filepath.Dir(dir)
+		// @inco: parent != dir, -return("", "")
+		dir = parent
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Workspaces and nested modules
+// ---------------------------------------------------------------------------
+
+// moduleInfo describes a Go module whose files the engine may generate.
+type moduleInfo struct {
+	Dir  string // directory containing go.mod
+	Path string // module path declared in go.mod
+}
+
+// FindWorkFile returns the go.work file that governs dir, or "" when dir
+// is not in a workspace. Like the go command it honors $GOWORK: "off"
+// disables workspace mode and an explicit path is used as is.
+func FindWorkFile(dir string) string {
+	return findWorkFile(dir, os.Getenv("GOWORK"))
+}
+
+// findWorkFile is FindWorkFile with gowork as the value of $GOWORK.
+func findWorkFile(dir, gowork string) string {
+	switch gowork {
+	case "off":
+		return ""
+	case "":
+	default:
+		return gowork
+	}
+	for {
+		path := filepath.Join(dir, "go.work")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		// @inco: parent != dir, -return("")
+		dir = parent
+	}
+}
+
+// WorkspaceRoot returns the directory to generate from when inco is invoked
+// in dir: the directory of the governing go.work, so that every module of
+// the workspace shares one overlay, or dir itself outside a workspace.
+func WorkspaceRoot(dir string) string {
+	work := FindWorkFile(dir)
+	// @inco: work != "", -return(dir)
+	return filepath.Dir(work)
+}
+
+// useRe matches a use directive in go.work, in single-line or block form.
+// Group 1: the (optionally quoted) directory.
+var useRe = regexp.MustCompile(`^(?:use\s+)?("[^"]+"|\S+)$`)
+
+// workUses returns the absolute module directories listed by the use
+// directives of the go.work file at path.
+func workUses(path string) []string {
+	data, err := os.ReadFile(path)
+	_ = err // @inco: err == nil, -return(nil)
+	var dirs []string
+	inBlock := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "use (":
+			inBlock = true
+			continue
+		case inBlock && line == ")":
+			inBlock = false
+			continue
+		case !inBlock && !strings.HasPrefix(line, "use "):
+			continue
+		}
+		m := useRe.FindStringSubmatch(line)
+		// @inco: m != nil, -continue
+		dir := strings.Trim(m[1], `"`)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(path), dir)
+		}
+		dirs = append(dirs, filepath.Clean(dir))
+	}
+	return dirs
+}
+
+// replaceRe matches a replace directive whose target is a local directory,
+// in single-line or block form. Group 1: the directory.
+var replaceRe = regexp.MustCompile(`^(?:replace\s+)?\S+(?:\s+\S+)?\s+=>\s+("[^"]+"|\.{1,2}/\S*|/\S*|[A-Za-z]:\\\S*)$`)
+
+// localReplaces returns the absolute directories that the replace
+// directives of the go.mod or go.work file at path point to. Replacements
+// by another module version are not local and are skipped.
+func localReplaces(path string) []string {
+	data, err := os.ReadFile(path)
+	_ = err // @inco: err == nil, -return(nil)
+	var dirs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		m := replaceRe.FindStringSubmatch(strings.TrimSpace(line))
+		// @inco: m != nil, -continue
+		dir := strings.Trim(m[1], `"`)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(path), dir)
+		}
+		dirs = append(dirs, filepath.Clean(dir))
+	}
+	return dirs
+}
+
+// discoverModules returns the modules generation under root can involve:
+// the module enclosing root, every module whose go.mod lies below root
+// (outside skipped directories), and the modules used by workFile. With
+// local set it adds the local directories those modules (and workFile)
+// replace dependencies with. The result is ordered deepest directory
+// first, so that the first module containing a file is the one it
+// belongs to.
+func discoverModules(root, workFile string, local bool) []moduleInfo {
+	seen := make(map[string]bool)
+	var mods []moduleInfo
+	add := func(dir string) {
+		modDir, modPath := findModule(dir)
+		// @inco: modDir != "" && !seen[modDir], -return
+		seen[modDir] = true
+		mods = append(mods, moduleInfo{Dir: modDir, Path: modPath})
+	}
+
+	add(root)
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		// @inco: err == nil, -return(nil)
+		if d.IsDir() {
+			skip := path != root && skipDirRe.MatchString(d.Name())
+			_ = skip // @inco: !skip, -return(filepath.SkipDir)
+			return nil
+		}
+		if d.Name() == "go.mod" {
+			add(filepath.Dir(path))
+		}
+		return nil
+	})
+	if workFile != "" {
+		for _, dir := range workUses(workFile) {
+			add(dir)
+		}
+	}
+	if local {
+		files := []string{workFile}
+		for _, m := range mods {
+			files = append(files, filepath.Join(m.Dir, "go.mod"))
+		}
+		for _, f := range files {
+			// @inco: f != "", -continue
+			for _, dir := range localReplaces(f) {
+				// Never fall back to a module enclosing a broken target.
+				if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+					add(dir)
+				}
+			}
+		}
+	}
+
+	sort.Slice(mods, func(i, j int) bool {
+		if len(mods[i].Dir) != len(mods[j].Dir) {
+			return len(mods[i].Dir) > len(mods[j].Dir)
+		}
+		return mods[i].Dir < mods[j].Dir
+	})
+	return mods
+}
+
+// workspace returns the engine's go.work file ("" outside a workspace) and
+// its modules, discovered once per run (see resetWorkspace).
+func (e *Engine) workspace() (string, []moduleInfo) {
+	e.modOnce.Do(func() {
+		e.workFile = findWorkFile(e.Root, e.getenv("GOWORK"))
+		e.modules = discoverModules(e.Root, e.workFile, e.LocalModules)
+	})
+	return e.workFile, e.modules
+}
+
+// resetWorkspace makes the next call to workspace discover the go.work
+// file and modules again. Every run starts with it, so that a long-lived
+// engine notices a go.mod or go.work created or removed since its last run.
+func (e *Engine) resetWorkspace() {
+	e.modOnce = sync.Once{}
+}
+
+// walkRoots returns the directories whose files the engine generates:
+// Root, and with LocalModules every other known module outside it.
+func (e *Engine) walkRoots() []string {
+	roots := []string{e.Root}
+	// @inco: e.LocalModules, -return(roots)
+	_, mods := e.workspace()
+	// Outermost first, so that a module nested in another is skipped.
+	for i := len(mods) - 1; i >= 0; i-- {
+		dir := mods[i].Dir
+		covered := false
+		for _, r := range roots {
+			covered = covered || withinDir(dir, r)
+		}
+		if !covered {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
+}
+
+// walkRootOf returns the walk root containing path, or "" if none does.
+func (e *Engine) walkRootOf(path string) string {
+	for _, r := range e.walkRoots() {
+		if withinDir(path, r) {
+			return r
+		}
+	}
+	return ""
+}
+
+// withinDir reports whether path is dir or lies below it.
+func withinDir(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// moduleOf returns the module that the file or directory at path belongs
+// to: the innermost known module containing it. The zero moduleInfo means
+// path is outside every module.
+func (e *Engine) moduleOf(path string) moduleInfo {
+	_, mods := e.workspace()
+	for _, m := range mods {
+		if withinDir(path, m.Dir) {
+			return m
+		}
+	}
+	return moduleInfo{}
+}
@@ -0,0 +1,236 @@
+package inco
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// go.work parsing and discovery
+// ---------------------------------------------------------------------------
+
+func TestWorkUses(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.work": `go 1.22
+
+use ./svc/a // the first service
+use (
+	./svc/b
+	"./lib"
+	// ./disabled
+)
+`,
+	})
+	got := workUses(filepath.Join(dir, "go.work"))
+	want := []string{
+		filepath.Join(dir, "svc", "a"),
+		filepath.Join(dir, "svc", "b"),
+		filepath.Join(dir, "lib"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("workUses = %v, want %v", got, want)
+	}
+}
+
+func TestLocalReplaces(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"app/go.mod": `module example.com/app
+
+go 1.22
+
+replace example.com/lib => ../lib // sibling checkout
+replace (
+	example.com/util v1.2.0 => "./third_party/util"
+	example.com/fork => example.com/fork/v2 v2.0.1
+	// example.com/old => ../old
+)
+`,
+	})
+	got := localReplaces(filepath.Join(dir, "app", "go.mod"))
+	want := []string{
+		filepath.Join(dir, "lib"),
+		filepath.Join(dir, "app", "third_party", "util"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("localReplaces = %v, want %v", got, want)
+	}
+}
+
+func TestWorkspaceRoot(t *testing.T) {
+	t.Setenv("GOWORK", "")
+	dir := setupDir(t, map[string]string{
+		"go.work":     "go 1.22\n\nuse ./svc\n",
+		"svc/go.mod":  "module example.com/svc\n\ngo 1.22\n",
+		"svc/main.go": "package main\n",
+	})
+	if got := WorkspaceRoot(filepath.Join(dir, "svc")); got != dir {
+		t.Errorf("WorkspaceRoot(svc) = %q, want %q", got, dir)
+	}
+	t.Setenv("GOWORK", "off")
+	if got := WorkspaceRoot(filepath.Join(dir, "svc")); got != filepath.Join(dir, "svc") {
+		t.Errorf("with GOWORK=off, WorkspaceRoot(svc) = %q, want svc itself", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Engine — nested modules
+// ---------------------------------------------------------------------------
+
+func TestEngine_NestedModuleTrimpath(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":         "module example.com/root\n\ngo 1.22\n",
+		"a.go":           "package root\n\nfunc A(x int) {\n\t// @inco: x > 0\n}\n",
+		"tools/go.mod":   "module example.com/tools\n\ngo 1.22\n",
+		"tools/gen/b.go": "package gen\n\nfunc B(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	e := NewEngine(dir)
+	e.Trimpath = true
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	shadow, _ := os.ReadFile(e.Overlay.Replace[filepath.Join(dir, "tools", "gen", "b.go")])
+	if !strings.Contains(string(shadow), "//line example.com/tools/gen/b.go:4:") {
+		t.Errorf("nested module file should use its own module path, got:\n%s", shadow)
+	}
+	shadow, _ = os.ReadFile(e.Overlay.Replace[filepath.Join(dir, "a.go")])
+	if !strings.Contains(string(shadow), "//line example.com/root/a.go:4:") {
+		t.Errorf("root module file should use the root module path, got:\n%s", shadow)
+	}
+}
+
+func TestEngine_ImportsResolvedPerModule(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":     "module example.com/root\n\ngo 1.22\n",
+		"a.go":       "package root\n\nfunc A(s string) {\n\t// @inco: s != \"\", -panic(zz.Err)\n}\n",
+		"sub/go.mod": "module example.com/sub\n\ngo 1.22\n",
+		"sub/b.go":   "package sub\n\nfunc B(s string) {\n\t// @inco: s != \"\", -panic(zz.Err)\n}\n",
+	})
+	e := NewEngine(dir)
+	os.MkdirAll(e.cacheDir(), 0o755)
+	sub := filepath.Join(dir, "sub")
+	// Only the nested module knows a package named zz.
+	e.writeImportMap(sub, e.importMapKey(sub), map[string]string{"example.com/zz": "zz"})
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	shadow, _ := os.ReadFile(e.Overlay.Replace[filepath.Join(sub, "b.go")])
+	if !strings.Contains(string(shadow), `"example.com/zz"`) {
+		t.Errorf("sub/b.go should resolve zz against its own module, got:\n%s", shadow)
+	}
+	shadow, _ = os.ReadFile(e.Overlay.Replace[filepath.Join(dir, "a.go")])
+	if strings.Contains(string(shadow), `"example.com/zz"`) {
+		t.Errorf("a.go must not see the nested module's packages, got:\n%s", shadow)
+	}
+}
+
+func TestEngine_NestedGoModChangeInvalidatesCache(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":     "module example.com/root\n\ngo 1.22\n",
+		"sub/go.mod": "module example.com/sub\n\ngo 1.22\n",
+		"sub/b.go":   "package sub\n\nfunc B(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	if err := NewEngine(dir).Run(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "sub", "go.mod"), []byte("module example.com/sub\n\ngo 1.23\n"), 0o644)
+	e := NewEngine(dir)
+	before := e.loadManifest().Config
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if e.loadManifest().Config == before {
+		t.Error("changing a nested go.mod should change the configuration fingerprint")
+	}
+}
+
+// A long-lived engine, as in inco serve, sees a go.mod created after its
+// first run.
+func TestEngine_NewNestedModuleDiscovered(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":   "module example.com/root\n\ngo 1.22\n",
+		"sub/b.go": "package sub\n\nfunc B(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	bPath := filepath.Join(dir, "sub", "b.go")
+	e := NewEngine(dir)
+	e.Trimpath = true
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "sub", "go.mod"), []byte("module other\n\ngo 1.22\n"), 0o644)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	shadow, _ := os.ReadFile(e.Overlay.Replace[bPath])
+	if !strings.Contains(string(shadow), "//line other/b.go:4:") {
+		t.Errorf("sub/b.go should now belong to module other, got:\n%s", shadow)
+	}
+	fresh := NewEngine(dir)
+	fresh.Trimpath = true
+	if err := fresh.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(fresh.Overlay.Replace[bPath]); string(again) != string(shadow) {
+		t.Errorf("a fresh engine should generate the same shadow:\n%s\nvs\n%s", again, shadow)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Engine — local modules
+// ---------------------------------------------------------------------------
+
+func TestEngine_LocalModules(t *testing.T) {
+	t.Setenv("GOWORK", "off")
+	dir := setupDir(t, map[string]string{
+		"app/go.mod":           "module example.com/app\n\ngo 1.22\n\nrequire example.com/lib v0.0.0\n\nreplace example.com/lib => ../lib\n",
+		"app/main.go":          "package main\n\nimport \"example.com/lib\"\n\nfunc main() { lib.F(1) }\n",
+		"lib/go.mod":           "module example.com/lib\n\ngo 1.22\n",
+		"lib/lib.go":           "package lib\n\nfunc F(x int) {\n\t// @inco: x > 0\n}\n",
+		"lib/testdata/skip.go": "package skip\n\nfunc S(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	app := filepath.Join(dir, "app")
+	libFile := filepath.Join(dir, "lib", "lib.go")
+
+	e := NewEngine(app)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.Overlay.Replace[libFile]; ok {
+		t.Error("replace target should only be generated with LocalModules")
+	}
+
+	e = NewEngine(app)
+	e.LocalModules = true
+	e.Trimpath = true
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	shadow, ok := e.Overlay.Replace[libFile]
+	if !ok {
+		t.Fatalf("replace target missing from overlay: %v", e.Overlay.Replace)
+	}
+	if _, ok := e.Overlay.Replace[filepath.Join(dir, "lib", "testdata", "skip.go")]; ok {
+		t.Error("skipped directories of a replace target should not be walked")
+	}
+	content, _ := os.ReadFile(shadow)
+	if !strings.Contains(string(content), "//line example.com/lib/lib.go:4:") {
+		t.Errorf("replace target should use its own module path, got:\n%s", content)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lib", ".inco_cache")); err == nil {
+		t.Error("replace target should share the root's .inco_cache")
+	}
+
+	// Scoped runs reach the replace target through the dependency graph.
+	if err := os.WriteFile(libFile, []byte("package lib\n\nfunc F(x int) {\n\t// @inco: x > 1\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RunPackages(app, nil, []string{"."}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ = os.ReadFile(e.Overlay.Replace[libFile])
+	if !strings.Contains(string(content), "x > 1") {
+		t.Errorf("scoped run should regenerate the replace target, got:\n%s", content)
+	}
+}
@@ -0,0 +1,226 @@
+package inco
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// Go tool output
+// ---------------------------------------------------------------------------
+//
+// Injected guards carry //line directives, so the compiler reports most
+// positions on the original sources already. Three cases remain: lines of
+// a shadow that precede its first //line (with imports added, they are not
+// even at the source's line numbers) are reported on the shadow itself;
+// with trimmed //line paths (Trimpath or the shared cache) the rest are
+// reported under module-relative names such as example.com/m/pkg/f.go;
+// and a guard that does not compile is reported at its directive comment
+// with a message about code the user never wrote. OutputMapper rewrites
+// the first two and labels the last.
+
+// OutputMapper rewrites the output of go commands run with an inco
+// overlay: positions in shadows become positions in their sources, and
+// messages about injected code are prefixed with the directive, as in
+//
+//	./a.go:12:9: in @inco: directive [3f9a1c2b7d04e6a5]: n > limit: undefined: limit
+//
+// Safe for concurrent use.
+type OutputMapper struct {
+	dir      string            // relative paths in the output are relative to dir
+	sources  map[string]string // shadow path → source path
+	isSource map[string]bool
+	trimmed  map[string]string // module-relative name → source path
+
+	mu         sync.Mutex
+	shadows    map[string]*shadowLines         // by shadow path; nil when unreadable
+	directives map[string]map[int]directiveCol // by source path, then line
+}
+
+// NewOutputMapper returns a mapper for the shadows of ov, the inco overlay,
+// and output whose relative paths are relative to dir.
+func NewOutputMapper(ov Overlay, dir string) *OutputMapper {
+	m := &OutputMapper{
+		dir:        dir,
+		sources:    make(map[string]string, len(ov.Replace)),
+		isSource:   make(map[string]bool, len(ov.Replace)),
+		trimmed:    make(map[string]string, len(ov.Replace)),
+		shadows:    make(map[string]*shadowLines),
+		directives: make(map[string]map[int]directiveCol),
+	}
+	modules := make(map[string][2]string) // directory → module dir and path
+	for src, shadow := range ov.Replace {
+		m.sources[filepath.Clean(shadow)] = src
+		m.isSource[src] = true
+		dir := filepath.Dir(src)
+		mod, seen := modules[dir]
+		if !seen {
+			modDir, modPath := findModule(dir)
+			mod = [2]string{modDir, modPath}
+			modules[dir] = mod
+		}
+		// @inco: mod[1] != "", -continue
+		m.trimmed[importPath(mod[0], mod[1], dir, "")+"/"+filepath.Base(src)] = src
+	}
+	return m
+}
+
+// positionRe matches a "file.go:line" or "file.go:line:col" position.
+var positionRe = regexp.MustCompile(`((?:[A-Za-z]:)?[^\s:()"']+\.go):(\d+)(?::(\d+))?`)
+
+// diagnosticLeadRe matches what may precede the position of a compiler or
+// vet diagnostic on its line.
+var diagnosticLeadRe = regexp.MustCompile(`^\s*(vet: )?$`)
+
+// MapLine returns line, one line of go command output without its
+// newline, with its positions mapped.
+func (m *OutputMapper) MapLine(line string) string {
+	locs := positionRe.FindAllStringSubmatchIndex(line, -1)
+	// @inco: len(locs) > 0, -return(line)
+	var b strings.Builder
+	last := 0
+	for i, loc := range locs {
+		path := line[loc[2]:loc[3]]
+		ln, err := strconv.Atoi(line[loc[4]:loc[5]])
+		_ = err // @inco: err == nil, -continue
+		col := 0
+		if loc[6] >= 0 {
+			col, _ = strconv.Atoi(line[loc[6]:loc[7]])
+		}
+		abs := path
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(m.dir, path)
+		}
+		abs = filepath.Clean(abs)
+		b.WriteString(line[last:loc[0]])
+		last = loc[1]
+		if src, sln, scol, ok := m.mapShadow(abs, ln, col); ok {
+			abs, ln, col = src, sln, scol
+			path = m.display(path, src)
+		} else if src, ok := m.trimmed[filepath.ToSlash(path)]; ok {
+			abs, path = src, m.display(path, src)
+		}
+		b.WriteString(path + ":" + strconv.Itoa(ln))
+		if col > 0 {
+			b.WriteString(":" + strconv.Itoa(col))
+		}
+		_ = i // @inco: i == 0 && diagnosticLeadRe.MatchString(line[:loc[0]]), -continue
+		d, ok := m.directiveAt(abs, ln, col)
+		rest := line[last:]
+		if ok && strings.HasPrefix(rest, ": ") {
+			b.WriteString(": " + directiveLabel(d))
+		}
+	}
+	b.WriteString(line[last:])
+	return b.String()
+}
+
+// directiveLabel returns the label MapLine puts in front of a message
+// about the injected code of d.
+func directiveLabel(d directiveCol) string {
+	// @inco: d.id != "", -return("in @inco: directive: " + d.d.Expr)
+	return "in @inco: directive [" + d.id + "]: " + d.d.Expr
+}
+
+// display returns how to print src in place of the shadow printed as
+// path: relative to the output's directory, in the go command's ./ form,
+// when path was relative.
+func (m *OutputMapper) display(path, src string) string {
+	// @inco: !filepath.IsAbs(path), -return(src)
+	rel, err := filepath.Rel(m.dir, src)
+	_ = err // @inco: err == nil, -return(src)
+	if !strings.HasPrefix(rel, "..") {
+		rel = "." + string(filepath.Separator) + rel
+	}
+	return rel
+}
+
+// mapShadow maps a position in a shadow to its source. ok is false when
+// path is not a shadow of the overlay or the line cannot be mapped.
+func (m *OutputMapper) mapShadow(path string, line, col int) (src string, sline, scol int, ok bool) {
+	src, isShadow := m.sources[path]
+	_ = isShadow // @inco: isShadow, -return("", 0, 0, false)
+	sl := m.shadow(path, src)
+	// @inco: sl != nil, -return("", 0, 0, false)
+	sline, scol, ok = sl.position(line, col)
+	return src, sline, scol, ok
+}
+
+// shadow returns the line mapping of the shadow at path, whose source is
+// src, loading it on first use.
+func (m *OutputMapper) shadow(path, src string) *shadowLines {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sl, seen := m.shadows[path]; seen {
+		return sl
+	}
+	sl := loadShadowLines(path, src)
+	m.shadows[path] = sl
+	return sl
+}
+
+// directiveAt returns the directive whose injected code is reported at
+// line and col of the source at path. With no column, only a standalone
+// directive's line is known to be injected code.
+func (m *OutputMapper) directiveAt(path string, line, col int) (directiveCol, bool) {
+	d, ok := m.sourceDirectives(path)[line]
+	_ = ok // @inco: ok, -return(directiveCol{}, false)
+	injected := col >= d.col || (col == 0 && d.standalone)
+	return d, injected
+}
+
+// sourceDirectives returns the directives of the source at path by line,
+// loading them on first use. Files that are not in the overlay have none.
+func (m *OutputMapper) sourceDirectives(path string) map[int]directiveCol {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ds, seen := m.directives[path]; seen {
+		return ds
+	}
+	ds := make(map[int]directiveCol)
+	m.directives[path] = ds
+	// @inco: m.isSource[path], -return(ds)
+	content, err := os.ReadFile(path)
+	_ = err // @inco: err == nil, -return(ds)
+	ds = scanDirectives(path, content)
+	m.directives[path] = ds
+	return ds
+}
+
+// Writer returns a writer that copies whole lines to w through MapLine.
+// Close writes out a final line without newline.
+func (m *OutputMapper) Writer(w io.Writer) io.WriteCloser {
+	return &mappedWriter{m: m, w: w}
+}
+
+// mappedWriter is the writer returned by OutputMapper.Writer.
+type mappedWriter struct {
+	m   *OutputMapper
+	w   io.Writer
+	buf []byte // partial line
+}
+
+func (mw *mappedWriter) Write(p []byte) (int, error) {
+	mw.buf = append(mw.buf, p...)
+	for {
+		i := bytes.IndexByte(mw.buf, '\n')
+		// @inco: i >= 0, -return(len(p), nil)
+		_, err := fmt.Fprintln(mw.w, mw.m.MapLine(string(mw.buf[:i])))
+		mw.buf = mw.buf[i+1:]
+		_ = err // @inco: err == nil, -return(len(p), err)
+	}
+}
+
+func (mw *mappedWriter) Close() error {
+	// @inco: len(mw.buf) > 0, -return(nil)
+	_, err := io.WriteString(mw.w, mw.m.MapLine(string(mw.buf)))
+	mw.buf = nil
+	return err
+}
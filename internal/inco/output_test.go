@@ -0,0 +1,139 @@
+package inco
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// OutputMapper — go tool output
+// ---------------------------------------------------------------------------
+
+// outputSrc has a statement before its first directive, a directive that
+// needs an import (so the shadow is reformatted and its lines shift), and
+// an inline directive.
+const outputSrc = `package main
+
+func main() {
+	s := "a"
+	x := z
+	// @inco: strings.HasPrefix(s, y)
+	_ = x // @inco: x, -return
+}
+`
+
+// newTestMapper generates outputSrc and returns a mapper for its overlay,
+// the source path, the shadow path and the shadow's content.
+func newTestMapper(t *testing.T) (*OutputMapper, string, string, string) {
+	t.Helper()
+	dir := setupDir(t, map[string]string{
+		"go.mod":  "module example.com/m\n\ngo 1.21\n",
+		"main.go": outputSrc,
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return NewOutputMapper(e.Overlay, dir), filepath.Join(dir, "main.go"), readShadowPath(t, e), readShadow(t, e)
+}
+
+func TestOutputMapper_ShadowPathBeforeFirstLineDirective(t *testing.T) {
+	m, _, shadow, content := newTestMapper(t)
+	if !strings.Contains(content, `"strings"`) {
+		t.Fatal("test needs a shadow with an added import")
+	}
+	rel, err := filepath.Rel(m.dir, shadow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strconv.Itoa(lineOf(t, content, "x := z"))
+	got := m.MapLine("./" + rel + ":" + line + ":7: undefined: z")
+	if want := "./main.go:5:7: undefined: z"; got != want {
+		t.Errorf("MapLine = %q, want %q", got, want)
+	}
+	got = m.MapLine("vet: " + shadow + ":" + line + ":7: undefined: z")
+	if want := "vet: " + filepath.Join(m.dir, "main.go") + ":5:7: undefined: z"; got != want {
+		t.Errorf("MapLine = %q, want %q", got, want)
+	}
+}
+
+func TestOutputMapper_InjectedCode(t *testing.T) {
+	m, src, _, _ := newTestMapper(t)
+	ids := sourceDirectiveIDs(src, []byte(outputSrc))
+	tests := []struct{ in, want string }{
+		// Standalone directive, at its expression.
+		{"./main.go:6:31: undefined: y", "./main.go:6:31: in @inco: directive [" + ids[6] + "]: strings.HasPrefix(s, y): undefined: y"},
+		// Inline directive, after its comment.
+		{src + ":7:18: invalid operation", src + ":7:18: in @inco: directive [" + ids[7] + "]: x: invalid operation"},
+		// Inline directive's line, before its comment: the user's code.
+		{"./main.go:7:6: x declared", "./main.go:7:6: x declared"},
+		// Not a diagnostic: the position is not at the start of the line.
+		{"note: see ./main.go:6:31: here", "note: see ./main.go:6:31: here"},
+		// Other lines and files.
+		{"./main.go:5:7: undefined: z", "./main.go:5:7: undefined: z"},
+		{"./other.go:6:31: undefined: y", "./other.go:6:31: undefined: y"},
+		{"# example.com/m", "# example.com/m"},
+	}
+	for _, tt := range tests {
+		if got := m.MapLine(tt.in); got != tt.want {
+			t.Errorf("MapLine(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestOutputMapper_Writer(t *testing.T) {
+	m, src, _, _ := newTestMapper(t)
+	var out strings.Builder
+	w := m.Writer(&out)
+	for _, chunk := range []string{"# example.com/m\n./main.go:6:", "31: undefined: y\nexit", " status 1"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	id := sourceDirectiveIDs(src, []byte(outputSrc))[6]
+	want := "# example.com/m\n./main.go:6:31: in @inco: directive [" + id + "]: strings.HasPrefix(s, y): undefined: y\nexit status 1"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestOutputMapper_TrimmedPaths(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":  "module example.com/m\n\ngo 1.21\n",
+		"main.go": outputSrc,
+	})
+	e := NewEngine(dir)
+	e.Trimpath = true
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	m := NewOutputMapper(e.Overlay, dir)
+	id := sourceDirectiveIDs(filepath.Join(dir, "main.go"), []byte(outputSrc))[6]
+	tests := []struct{ in, want string }{
+		{"example.com/m/main.go:5:7: undefined: z", "./main.go:5:7: undefined: z"},
+		{"example.com/m/main.go:6:31: undefined: y", "./main.go:6:31: in @inco: directive [" + id + "]: strings.HasPrefix(s, y): undefined: y"},
+		{"example.com/other/main.go:5:7: undefined: z", "example.com/other/main.go:5:7: undefined: z"},
+	}
+	for _, tt := range tests {
+		if got := m.MapLine(tt.in); got != tt.want {
+			t.Errorf("MapLine(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// lineOf returns the 1-based line of content that contains text.
+func lineOf(t *testing.T, content, text string) int {
+	t.Helper()
+	for i, l := range strings.Split(content, "\n") {
+		if strings.Contains(l, text) {
+			return i + 1
+		}
+	}
+	t.Fatalf("%q not found in:\n%s", text, content)
+	return 0
+}
@@ -0,0 +1,68 @@
+package inco
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ---------------------------------------------------------------------------
+// User-supplied overlays
+// ---------------------------------------------------------------------------
+//
+// The go command accepts a single -overlay flag. When a build already has
+// one, from the command line or GOFLAGS, inco build/test/run merge it with
+// the inco overlay and pass the go command the result instead.
+
+// LoadOverlay reads the overlay file at path. Relative paths in it are made
+// absolute against dir, the directory the go command would resolve them
+// against (its working directory); the inco overlay only uses absolute
+// paths, so that entries of both can be compared.
+func LoadOverlay(path, dir string) (Overlay, error) {
+	data, err := os.ReadFile(path)
+	_ = err // @inco: err == nil, -return(Overlay{}, fmt.Errorf("overlay %s: %w", path, err))
+	var raw Overlay
+	err = json.Unmarshal(data, &raw)
+	_ = err // @inco: err == nil, -return(Overlay{}, fmt.Errorf("overlay %s: %w", path, err))
+	ov := Overlay{Replace: make(map[string]string, len(raw.Replace))}
+	for from, to := range raw.Replace {
+		if !filepath.IsAbs(from) {
+			from = filepath.Join(dir, from)
+		}
+		if to != "" && !filepath.IsAbs(to) { // "" deletes the file
+			to = filepath.Join(dir, to)
+		}
+		ov.Replace[filepath.Clean(from)] = to
+	}
+	return ov, nil
+}
+
+// MergeOverlays returns the union of the inco overlay and user, an overlay
+// loaded from userPath. A file that both replace, with different contents,
+// is reported as a DiagOverlay error at that file and keeps inco's shadow
+// in the result: a build from it would either drop the file's directives
+// or ignore the user's replacement, so the caller should not run one.
+func MergeOverlays(inco, user Overlay, userPath string) (Overlay, []Diagnostic) {
+	merged := Overlay{Replace: make(map[string]string, len(inco.Replace)+len(user.Replace))}
+	for from, to := range user.Replace {
+		merged.Replace[from] = to
+	}
+	var diags []Diagnostic
+	for from, shadow := range inco.Replace {
+		to, ok := user.Replace[from]
+		if ok && to != shadow {
+			diags = append(diags, Diagnostic{
+				Pos:      token.Position{Filename: from},
+				Severity: SeverityError,
+				Code:     DiagOverlay,
+				Message:  fmt.Sprintf("replaced both by its inco shadow and by %s (with %q)", userPath, to),
+			})
+		}
+		merged.Replace[from] = shadow
+	}
+	sort.Slice(diags, func(i, j int) bool { return diags[i].Pos.Filename < diags[j].Pos.Filename })
+	return merged, diags
+}
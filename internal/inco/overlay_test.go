@@ -0,0 +1,102 @@
+package inco
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// User-supplied overlays
+// ---------------------------------------------------------------------------
+
+func TestLoadOverlay_ResolvesRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "user.json")
+	data := `{"Replace": {"a.go": "gen/a.go", "/abs/b.go": "/abs/gen/b.go", "c.go": ""}}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ov, err := LoadOverlay(path, "/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		filepath.Join("/work", "a.go"): filepath.Join("/work", "gen", "a.go"),
+		"/abs/b.go":                    "/abs/gen/b.go",
+		filepath.Join("/work", "c.go"): "",
+	}
+	if len(ov.Replace) != len(want) {
+		t.Fatalf("Replace = %v, want %v", ov.Replace, want)
+	}
+	for from, to := range want {
+		if got, ok := ov.Replace[from]; !ok || got != to {
+			t.Errorf("Replace[%s] = %q, want %q", from, got, to)
+		}
+	}
+}
+
+func TestLoadOverlay_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "user.json")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOverlay(path, "/work"); err == nil {
+		t.Error("malformed overlay should fail")
+	}
+	if _, err := LoadOverlay(filepath.Join(t.TempDir(), "missing.json"), "/work"); err == nil {
+		t.Error("missing overlay should fail")
+	}
+}
+
+func TestMergeOverlays(t *testing.T) {
+	inco := Overlay{Replace: map[string]string{
+		"/m/a.go": "/m/.inco_cache/a_1.go",
+		"/m/b.go": "/m/.inco_cache/b_2.go",
+	}}
+	user := Overlay{Replace: map[string]string{
+		"/m/b.go":   "/m/.inco_cache/b_2.go", // same replacement: no conflict
+		"/m/gen.go": "/tmp/gen.go",
+	}}
+	merged, diags := MergeOverlays(inco, user, "user.json")
+	if len(diags) != 0 {
+		t.Errorf("unexpected diagnostics: %v", diags)
+	}
+	want := map[string]string{
+		"/m/a.go":   "/m/.inco_cache/a_1.go",
+		"/m/b.go":   "/m/.inco_cache/b_2.go",
+		"/m/gen.go": "/tmp/gen.go",
+	}
+	if len(merged.Replace) != len(want) {
+		t.Fatalf("Replace = %v, want %v", merged.Replace, want)
+	}
+	for from, to := range want {
+		if merged.Replace[from] != to {
+			t.Errorf("Replace[%s] = %q, want %q", from, merged.Replace[from], to)
+		}
+	}
+}
+
+func TestMergeOverlays_Conflict(t *testing.T) {
+	inco := Overlay{Replace: map[string]string{
+		"/m/a.go": "/m/.inco_cache/a_1.go",
+		"/m/b.go": "/m/.inco_cache/b_2.go",
+	}}
+	user := Overlay{Replace: map[string]string{
+		"/m/b.go": "/tmp/b.go",
+		"/m/a.go": "",
+	}}
+	merged, diags := MergeOverlays(inco, user, "user.json")
+	if len(diags) != 2 {
+		t.Fatalf("got %d diagnostics, want 2: %v", len(diags), diags)
+	}
+	for i, file := range []string{"/m/a.go", "/m/b.go"} {
+		d := diags[i]
+		if d.Pos.Filename != file || d.Severity != SeverityError || d.Code != DiagOverlay {
+			t.Errorf("diags[%d] = %v, want an %s error at %s", i, d, DiagOverlay, file)
+		}
+	}
+	if merged.Replace["/m/b.go"] != "/m/.inco_cache/b_2.go" {
+		t.Errorf("conflicting entry should keep the shadow, got %q", merged.Replace["/m/b.go"])
+	}
+}
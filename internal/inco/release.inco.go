@@ -3,6 +3,7 @@ package inco
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -21,14 +22,16 @@ const releaseHeader = "// Code generated by inco. DO NOT EDIT.\n\n"
 //     Go compiler).
 //
 // If dryRun is true, no files are modified — only a preview is printed.
+// Progress goes to w; nil means os.Stderr.
 //
 // After release, plain "go build" compiles the guarded .go files.
 // "inco release clean" restores the originals.
-func Release(root string, dryRun bool) error {
+func Release(root string, dryRun bool, w io.Writer) error {
 	// @inco: root != "", -return(fmt.Errorf("Release: root must not be empty"))
 
 	ov, err := loadOverlay(root)
 	_ = err // @inco: err == nil, -return(fmt.Errorf("Release: %w", err))
+	w = logWriter(w)
 	// @inco: len(ov.Replace) > 0, -return(fmt.Errorf("Release: no overlay entries — run gen first"))
 
 	var released int
@@ -39,7 +42,7 @@ func Release(root string, dryRun bool) error {
 		rel, _ := filepath.Rel(root, releasePath)
 
 		if dryRun {
-			fmt.Fprintf(os.Stderr, "  [dry-run] %s\n", rel)
+			fmt.Fprintf(w, "  [dry-run] %s\n", rel)
 			released++
 			continue
 		}
@@ -57,14 +60,14 @@ func Release(root string, dryRun bool) error {
 		err = os.Rename(origPath, backupPath)
 		_ = err // @inco: err == nil, -return(fmt.Errorf("Release: rename %s: %w", origPath, err))
 
-		fmt.Fprintf(os.Stderr, "  %s\n", rel)
+		fmt.Fprintf(w, "  %s\n", rel)
 		released++
 	}
 	prefix := "inco:"
 	if dryRun {
 		prefix = "inco: [dry-run]"
 	}
-	fmt.Fprintf(os.Stderr, "%s released %d file(s)\n", prefix, released)
+	fmt.Fprintf(w, "%s released %d file(s)\n", prefix, released)
 	return nil
 }
 
@@ -73,11 +76,14 @@ func Release(root string, dryRun bool) error {
 // For each overlay entry whose original is a .inco.go file:
 //   - The generated .go file is removed.
 //   - The .inco backup is renamed back to .inco.go.
-func ReleaseClean(root string) error {
+//
+// Progress goes to w; nil means os.Stderr.
+func ReleaseClean(root string, w io.Writer) error {
 	// @inco: root != "", -return(fmt.Errorf("ReleaseClean: root must not be empty"))
 
 	ov, err := loadOverlay(root)
 	_ = err // @inco: err == nil, -return(fmt.Errorf("ReleaseClean: %w", err))
+	w = logWriter(w)
 	// @inco: len(ov.Replace) > 0, -return(fmt.Errorf("ReleaseClean: no overlay entries"))
 
 	var cleaned int
@@ -90,17 +96,17 @@ func ReleaseClean(root string) error {
 		// Remove generated .go file.
 		if err := os.Remove(releasePath); err == nil {
 			rel, _ := filepath.Rel(root, releasePath)
-			fmt.Fprintf(os.Stderr, "  removed %s\n", rel)
+			fmt.Fprintf(w, "  removed %s\n", rel)
 		}
 
 		// Restore .inco → .inco.go.
 		if err := os.Rename(backupPath, origPath); err == nil {
 			rel, _ := filepath.Rel(root, origPath)
-			fmt.Fprintf(os.Stderr, "  restored %s\n", rel)
+			fmt.Fprintf(w, "  restored %s\n", rel)
 			cleaned++
 		}
 	}
-	fmt.Fprintf(os.Stderr, "inco: restored %d file(s)\n", cleaned)
+	fmt.Fprintf(w, "inco: restored %d file(s)\n", cleaned)
 	return nil
 }
 
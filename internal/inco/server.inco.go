@@ -0,0 +1,302 @@
+package inco
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoDaemon is returned by RequestGenerate when no compatible `inco serve`
+// daemon is listening; callers fall back to generating in process.
+var ErrNoDaemon = errors.New("inco: no daemon running")
+
+// daemonDialTimeout bounds how long a client waits to reach the daemon
+// before generating in process instead.
+const daemonDialTimeout = 200 * time.Millisecond
+
+// daemonIOTimeout bounds how long the daemon waits for a client to send its
+// request or to take the response, so a stalled client cannot pin a
+// connection forever.
+const daemonIOTimeout = 10 * time.Second
+
+// Defaults for Server.IdleTimeout and Server.MaxEngines.
+const (
+	defaultServerIdle       = 30 * time.Minute
+	defaultServerMaxEngines = 16
+)
+
+// daemonEnvVars are the variables, besides every GO* and CGO_* one, that
+// change which go command an engine runs and what it reports: PATH selects
+// the toolchain, and the others locate the go env file and build cache. A
+// request carries all of the client's, and engines are kept apart by them.
+var daemonEnvVars = []string{"PATH", "HOME", "XDG_CONFIG_HOME", "XDG_CACHE_HOME"}
+
+// versionMismatch prefixes the error a daemon returns to a client built
+// from a different inco version.
+const versionMismatch = "version mismatch"
+
+// DaemonRequest asks the daemon to regenerate the overlay of Root. The
+// fields mirror the Engine options the CLI sets.
+type DaemonRequest struct {
+	Version      string        `json:"version"` // client's EngineVersion; must match the daemon's
+	Root         string        `json:"root"`
+	Dir          string        `json:"dir,omitempty"`         // directory Patterns are relative to
+	Patterns     []string      `json:"patterns,omitempty"`    // see Engine.RunPackages; empty means all
+	BuildFlags   []string      `json:"build_flags,omitempty"` // see Engine.RunPackages
+	Trimpath     bool          `json:"trimpath"`
+	LocalModules bool          `json:"local_modules,omitempty"`
+	KeepGoing    bool          `json:"keep_going,omitempty"`
+	Events       bool          `json:"events,omitempty"` // return the run's events in the response
+	ShadowGrace  time.Duration `json:"shadow_grace"`
+	SharedCache  string        `json:"shared_cache"`
+	Env          []string      `json:"env"` // client's go environment as KEY=value; set by RequestGenerate
+}
+
+// DaemonResponse reports the outcome of a DaemonRequest.
+type DaemonResponse struct {
+	Output      string       `json:"output"` // progress messages the run printed
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+	Events      []Event      `json:"events,omitempty"` // when requested
+	Error       string       `json:"error,omitempty"`
+}
+
+// Server is the `inco serve` daemon. It keeps one Engine per project and
+// configuration alive between requests, so the import map (two `go list`
+// runs) and the manifest stay in memory instead of being rebuilt by every
+// `inco build`. Unchanged files are never parsed on a warm run, so no ASTs
+// need to be retained, and sources whose size and modification time match
+// those the engine recorded when it last read them are not read again.
+//
+// Engines are keyed on the client's whole go environment, so a daemon that
+// outlives many shells would accumulate them: one unused for IdleTimeout is
+// dropped, and beyond MaxEngines the least recently used one is.
+type Server struct {
+	IdleTimeout time.Duration // how long an unused engine is kept
+	MaxEngines  int           // how many engines are kept at most
+
+	mu      sync.Mutex
+	engines map[serverKey]*serverEngine
+}
+
+// serverKey identifies the options that change an engine's output.
+type serverKey struct {
+	root         string
+	trimpath     bool
+	localModules bool
+	sharedCache  string
+	env          string // the request's Env, joined
+}
+
+// serverEngine serializes requests for one engine; different projects are
+// served concurrently.
+type serverEngine struct {
+	mu   sync.Mutex
+	e    *Engine
+	used time.Time // when a request last asked for it; guarded by Server.mu
+}
+
+// NewServer creates a daemon with no engines loaded and default limits.
+func NewServer() *Server {
+	return &Server{
+		IdleTimeout: defaultServerIdle,
+		MaxEngines:  defaultServerMaxEngines,
+		engines:     make(map[serverKey]*serverEngine),
+	}
+}
+
+// DefaultSocketPath returns the per-user socket `inco serve` listens on.
+func DefaultSocketPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	_ = err // @inco: err == nil, -return("", fmt.Errorf("DefaultSocketPath: %w", err))
+	return filepath.Join(dir, "inco", "serve.sock"), nil
+}
+
+// Listen opens the daemon's unix socket at path. A socket file left behind
+// by a daemon that is no longer running is replaced; a live one is an error.
+func Listen(path string) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	_ = err // @inco: err == nil, -return(nil, fmt.Errorf("Listen: %w", err))
+	if conn, err := net.DialTimeout("unix", path, daemonDialTimeout); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("Listen: a daemon is already listening on %s", path)
+	}
+	os.Remove(path)
+	return net.Listen("unix", path)
+}
+
+// Serve accepts requests on l until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		_ = err // @inco: err == nil, -return(err)
+		go s.handle(conn)
+	}
+}
+
+// handle reads one request from conn and writes back its response.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(daemonIOTimeout))
+	var req DaemonRequest
+	err := json.NewDecoder(conn).Decode(&req)
+	_ = err // @inco: err == nil, -return
+	resp := s.generate(req)
+	conn.SetWriteDeadline(time.Now().Add(daemonIOTimeout))
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// generate runs the engine for req, converting panics into errors so that
+// a bad request cannot take the daemon down.
+func (s *Server) generate(req DaemonRequest) (resp DaemonResponse) {
+	if req.Version != EngineVersion() {
+		return DaemonResponse{Error: fmt.Sprintf(versionMismatch+": daemon %s, client %s", EngineVersion(), req.Version)}
+	}
+	// @inco: filepath.IsAbs(req.Root), -return(DaemonResponse{Error: fmt.Sprintf("root must be absolute, got %q", req.Root)})
+
+	key := serverKey{root: req.Root, trimpath: req.Trimpath, localModules: req.LocalModules, sharedCache: req.SharedCache, env: strings.Join(req.Env, "\x00")}
+	se := s.engine(key, req.Env)
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	var out bytes.Buffer
+	var events []Event
+	se.e.Log = &out
+	se.e.ShadowGrace = req.ShadowGrace
+	se.e.KeepGoing = req.KeepGoing
+	se.e.Events = nil
+	if req.Events {
+		se.e.Events = func(ev Event) { events = append(events, ev) }
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			resp = DaemonResponse{Output: out.String(), Error: fmt.Sprint(r)}
+		}
+	}()
+	err := se.e.RunPackages(req.Dir, req.BuildFlags, req.Patterns)
+	resp = DaemonResponse{Output: out.String(), Diagnostics: se.e.Diagnostics, Events: events}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// engine returns the engine for key, creating it on first use. Its
+// environment is the daemon's with every go-relevant variable replaced by
+// env, so that nothing of the daemon's own go configuration leaks in.
+func (s *Server) engine(key serverKey, env []string) *serverEngine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.evictIdle(now)
+	se, ok := s.engines[key]
+	if !ok {
+		s.makeRoom()
+		e := NewEngine(key.root)
+		e.Trimpath = key.trimpath
+		e.LocalModules = key.localModules
+		e.SharedCache = key.sharedCache
+		e.Env = append(withoutGoEnv(os.Environ()), env...)
+		se = &serverEngine{e: e}
+		s.engines[key] = se
+	}
+	se.used = now
+	return se
+}
+
+// evictIdle drops the engines unused for IdleTimeout. A request still
+// running on a dropped engine finishes with it; runs of two engines on the
+// same Root are serialized by the cache lock.
+func (s *Server) evictIdle(now time.Time) {
+	for key, se := range s.engines {
+		if s.IdleTimeout > 0 && now.Sub(se.used) > s.IdleTimeout {
+			delete(s.engines, key)
+		}
+	}
+}
+
+// makeRoom drops the least recently used engines until one more fits
+// under MaxEngines.
+func (s *Server) makeRoom() {
+	for s.MaxEngines > 0 && len(s.engines) >= s.MaxEngines {
+		var oldest serverKey
+		var used time.Time
+		for key, se := range s.engines {
+			if used.IsZero() || se.used.Before(used) {
+				oldest, used = key, se.used
+			}
+		}
+		delete(s.engines, oldest)
+	}
+}
+
+// RequestGenerate asks the daemon on socket to regenerate req.Root's
+// overlay. It returns ErrNoDaemon when nothing is listening or the daemon
+// was built from a different inco version; any other error is the run's,
+// a *DiagnosticsError when files failed.
+func RequestGenerate(socket string, req DaemonRequest) (DaemonResponse, error) {
+	req.Version = EngineVersion()
+	req.Env = clientEnv()
+	conn, err := net.DialTimeout("unix", socket, daemonDialTimeout)
+	_ = err // @inco: err == nil, -return(DaemonResponse{}, ErrNoDaemon)
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(daemonIOTimeout))
+
+	err = json.NewEncoder(conn).Encode(req)
+	_ = err // @inco: err == nil, -return(DaemonResponse{}, ErrNoDaemon)
+	var resp DaemonResponse
+	err = json.NewDecoder(conn).Decode(&resp)
+	_ = err // @inco: err == nil, -return(DaemonResponse{}, ErrNoDaemon)
+	switch {
+	case resp.Error == "":
+		return resp, nil
+	case strings.HasPrefix(resp.Error, versionMismatch):
+		return resp, ErrNoDaemon
+	case hasErrors(resp.Diagnostics):
+		return resp, &DiagnosticsError{Diagnostics: resp.Diagnostics}
+	}
+	return resp, errors.New(resp.Error)
+}
+
+// clientEnv returns this process's go-relevant environment (see
+// isGoEnvVar) as sorted KEY=value pairs.
+func clientEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if isGoEnvVar(k) {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// withoutGoEnv returns env without its go-relevant variables.
+func withoutGoEnv(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		if !isGoEnvVar(k) {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+// isGoEnvVar reports whether the environment variable key can change what
+// the go command does: GO*, CGO_* and daemonEnvVars.
+func isGoEnvVar(key string) bool {
+	return strings.HasPrefix(key, "GO") || strings.HasPrefix(key, "CGO_") || slices.Contains(daemonEnvVars, key)
+}
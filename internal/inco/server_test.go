@@ -0,0 +1,182 @@
+package inco
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer runs a daemon on a socket in a temp dir for the test's lifetime.
+func startServer(t *testing.T) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "serve.sock")
+	l, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- NewServer().Serve(l) }()
+	t.Cleanup(func() {
+		l.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return socket
+}
+
+// ---------------------------------------------------------------------------
+// Server — generation through the daemon
+// ---------------------------------------------------------------------------
+
+func TestServer_Generate(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	socket := startServer(t)
+
+	resp, err := RequestGenerate(socket, DaemonRequest{Root: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resp.Output, "1 processed, 0 cached") {
+		t.Errorf("unexpected output of first run: %q", resp.Output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".inco_cache", "overlay.json")); err != nil {
+		t.Fatalf("overlay.json not written: %v", err)
+	}
+
+	// The second request reuses the daemon's engine and finds the shadow cached.
+	resp, err = RequestGenerate(socket, DaemonRequest{Root: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resp.Output, "0 processed, 1 cached") {
+		t.Errorf("unexpected output of second run: %q", resp.Output)
+	}
+}
+
+func TestServer_RunError(t *testing.T) {
+	dir := setupBrokenDir(t)
+	socket := startServer(t)
+	resp, err := RequestGenerate(socket, DaemonRequest{Root: dir})
+	var de *DiagnosticsError
+	if !errors.As(err, &de) || len(resp.Diagnostics) != 2 {
+		t.Fatalf("expected the run's read errors, got %v (%v)", err, resp.Diagnostics)
+	}
+}
+
+func TestServer_RelativeRoot(t *testing.T) {
+	socket := startServer(t)
+	_, err := RequestGenerate(socket, DaemonRequest{Root: "relative/dir"})
+	if err == nil || !strings.Contains(err.Error(), "absolute") {
+		t.Fatalf("expected an absolute-root error, got %v", err)
+	}
+}
+
+func TestServer_ClientEnv(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.work":     "go 1.21\n\nuse ./app\n",
+		"app/go.mod":  "module example.com/app\n\ngo 1.21\n",
+		"app/main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+	})
+	s := NewServer()
+	for _, gowork := range []string{"", "off"} {
+		req := DaemonRequest{Version: EngineVersion(), Root: dir, Env: append(clientEnv(), "GOWORK="+gowork)}
+		if resp := s.generate(req); resp.Error != "" {
+			t.Fatal(resp.Error)
+		}
+	}
+	if len(s.engines) != 2 {
+		t.Fatalf("requests with different environments should get their own engines, got %d", len(s.engines))
+	}
+	for key, se := range s.engines {
+		workFile, _ := se.e.workspace()
+		if off := strings.HasSuffix(key.env, "=off"); off != (workFile == "") {
+			t.Errorf("engine for %q resolved go.work %q", key.env, workFile)
+		}
+	}
+}
+
+func TestClientEnv_GoRelevant(t *testing.T) {
+	t.Setenv("GOTOOLCHAIN", "go1.99.0")
+	t.Setenv("GOPROXY", "off")
+	t.Setenv("CGO_CFLAGS", "-O0")
+	t.Setenv("INCO_UNRELATED", "1")
+	env := clientEnv()
+	for _, want := range []string{"GOTOOLCHAIN=go1.99.0", "GOPROXY=off", "CGO_CFLAGS=-O0", "PATH=" + os.Getenv("PATH")} {
+		if !slices.Contains(env, want) {
+			t.Errorf("clientEnv() lacks %q: %v", want, env)
+		}
+	}
+	if envValue(env, "INCO_UNRELATED") != "" {
+		t.Errorf("clientEnv() carries INCO_UNRELATED: %v", env)
+	}
+}
+
+// The daemon's own go configuration must not leak into a client's engine.
+func TestServer_EngineEnvReplacesGoEnv(t *testing.T) {
+	t.Setenv("GOFLAGS", "-mod=vendor")
+	t.Setenv("GOTOOLCHAIN", "local")
+	env := []string{"GOTOOLCHAIN=go1.99.0", "PATH=/client/bin"}
+	se := NewServer().engine(serverKey{root: t.TempDir(), env: strings.Join(env, "\x00")}, env)
+	for key, want := range map[string]string{"GOFLAGS": "", "GOTOOLCHAIN": "go1.99.0", "PATH": "/client/bin"} {
+		if got := se.e.getenv(key); got != want {
+			t.Errorf("engine %s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+// Engines for environments no longer in use must not pile up.
+func TestServer_EvictsEngines(t *testing.T) {
+	s := NewServer()
+	s.MaxEngines = 2
+	root := t.TempDir()
+	key := func(path string) serverKey { return serverKey{root: root, env: "PATH=" + path} }
+
+	a := s.engine(key("/a"), nil)
+	s.engine(key("/b"), nil)
+	s.engine(key("/a"), nil) // /b is now the least recently used
+	s.engine(key("/c"), nil)
+	if _, ok := s.engines[key("/b")]; ok || len(s.engines) != 2 {
+		t.Errorf("least recently used engine kept: %v", s.engines)
+	}
+	if s.engine(key("/a"), nil) != a {
+		t.Error("recently used engine was replaced")
+	}
+
+	s.engines[key("/a")].used = time.Now().Add(-2 * s.IdleTimeout)
+	s.engine(key("/c"), nil)
+	if _, ok := s.engines[key("/a")]; ok {
+		t.Error("idle engine kept")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Fallback — no compatible daemon
+// ---------------------------------------------------------------------------
+
+func TestRequestGenerate_NoDaemon(t *testing.T) {
+	_, err := RequestGenerate(filepath.Join(t.TempDir(), "none.sock"), DaemonRequest{Root: t.TempDir()})
+	if !errors.Is(err, ErrNoDaemon) {
+		t.Fatalf("expected ErrNoDaemon, got %v", err)
+	}
+}
+
+func TestServer_VersionMismatch(t *testing.T) {
+	resp := NewServer().generate(DaemonRequest{Version: "f0 old", Root: t.TempDir()})
+	if !strings.HasPrefix(resp.Error, versionMismatch) {
+		t.Fatalf("expected a version mismatch, got %q", resp.Error)
+	}
+}
+
+func TestListen_AlreadyRunning(t *testing.T) {
+	socket := startServer(t)
+	if _, err := Listen(socket); err == nil {
+		t.Fatal("expected an error when a daemon is already listening")
+	}
+}
@@ -0,0 +1,126 @@
+package inco
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Shared cache
+//
+// With Engine.SharedCache set, shadows are stored in a per-user directory
+// instead of <root>/.inco_cache, named by a key derived from everything
+// that determines their content. Any checkout or worktree that would
+// generate the same shadow finds it there and skips parsing entirely;
+// only overlay.json, manifest.json and the lock stay in the project.
+//
+//	<SharedCache>/<key[:2]>/<base>_<key[:32]>.go
+
+// sharedUseInterval bounds how often a shared shadow's mtime is refreshed
+// on use. The mtime is what TrimSharedCache ages entries by.
+const sharedUseInterval = time.Hour
+
+// DefaultSharedCacheDir returns the default shared cache location,
+// "inco" under os.UserCacheDir().
+func DefaultSharedCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	_ = err // @inco: err == nil, -return("", fmt.Errorf("DefaultSharedCacheDir: %w", err))
+	return filepath.Join(dir, "inco"), nil
+}
+
+// sharedShadowPath returns where the shadow for the source at path with
+// content hash srcHash lives in the shared cache. The key covers
+// everything the shadow's content depends on: the engine version, the
+// configuration fingerprint, the file name written into //line directives
+// (module-relative with the shared cache), the one written into default
+// panic messages (relative to Root) and decls, the siblingDeclHash that
+// decides which of the imports its directives need are added. None of
+// them depends on where the checkout lives, so identical packages share
+// a shadow across every checkout and worktree of the module.
+func (e *Engine) sharedShadowPath(path, srcHash, decls string) string {
+	key := sha256.Sum256([]byte(EngineVersion() + "\n" + e.config + "\n" + e.linePath(path) + "\n" + e.messagePath(path) + "\n" + srcHash + "\n" + decls))
+	hexKey := fmt.Sprintf("%x", key)
+	name := fmt.Sprintf("%s_%s.go", strings.TrimSuffix(filepath.Base(path), ".go"), hexKey[:32])
+	return filepath.Join(e.SharedCache, hexKey[:2], name)
+}
+
+// markUsed reports whether the shared shadow at path exists, refreshing
+// its mtime if it has not been touched within sharedUseInterval.
+func markUsed(path string) bool {
+	info, err := os.Stat(path)
+	_ = err // @inco: err == nil, -return(false)
+	if now := time.Now(); now.Sub(info.ModTime()) > sharedUseInterval {
+		os.Chtimes(path, now, now)
+	}
+	return true
+}
+
+// isShared reports whether shadowPath lives in the shared cache. Shared
+// shadows may be referenced by other projects and are never pruned by Run.
+func (e *Engine) isShared(shadowPath string) bool {
+	// @inco: e.SharedCache != "", -return(false)
+	return strings.HasPrefix(shadowPath, e.SharedCache+string(filepath.Separator))
+}
+
+// TrimResult summarizes a TrimSharedCache pass.
+type TrimResult struct {
+	Removed int   // shadows deleted
+	Freed   int64 // bytes deleted
+	Kept    int   // shadows remaining
+	Size    int64 // bytes remaining
+}
+
+// TrimSharedCache removes shadows from the shared cache at dir that have
+// not been used for longer than maxAge, then removes the least recently
+// used ones until the total size is at most maxSize. A zero maxAge or
+// maxSize disables that criterion.
+func TrimSharedCache(dir string, maxAge time.Duration, maxSize int64) (TrimResult, error) {
+	// @inco: dir != "", -return(TrimResult{}, fmt.Errorf("TrimSharedCache: dir must not be empty"))
+	type entry struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var entries []entry
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		_ = err // @inco: err == nil, -return(err)
+		// @inco: !d.IsDir() && strings.HasSuffix(path, ".go"), -return(nil)
+		info, err := d.Info()
+		_ = err // @inco: err == nil, -return(nil)
+		entries = append(entries, entry{path: path, size: info.Size(), mtime: info.ModTime()})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return TrimResult{}, nil
+	}
+	_ = err // @inco: err == nil, -return(TrimResult{}, fmt.Errorf("TrimSharedCache: %w", err))
+
+	// Least recently used first.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mtime.Before(entries[j].mtime) })
+	var r TrimResult
+	for _, ent := range entries {
+		r.Size += ent.size
+	}
+	cutoff := time.Now().Add(-maxAge)
+	for _, ent := range entries {
+		expired := maxAge > 0 && ent.mtime.Before(cutoff)
+		oversize := maxSize > 0 && r.Size > maxSize
+		if !expired && !oversize {
+			r.Kept++
+			continue
+		}
+		if err := os.Remove(ent.path); err != nil && !os.IsNotExist(err) {
+			r.Kept++
+			continue
+		}
+		r.Removed++
+		r.Freed += ent.size
+		r.Size -= ent.size
+	}
+	return r, nil
+}
@@ -0,0 +1,202 @@
+package inco
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Engine integration — shadows in the shared cache
+// ---------------------------------------------------------------------------
+
+var sharedFiles = map[string]string{
+	"go.mod":  "module example.com/m\n\ngo 1.21\n",
+	"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+}
+
+func TestSharedCache_OverlayPointsIntoSharedDir(t *testing.T) {
+	shared := t.TempDir()
+	dir := setupDir(t, sharedFiles)
+	e := NewEngine(dir)
+	e.SharedCache = shared
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sp := readShadowPath(t, e)
+	if !strings.HasPrefix(sp, shared+string(filepath.Separator)) {
+		t.Errorf("shadow %s should live under the shared cache %s", sp, shared)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".inco_cache", "overlay.json")); err != nil {
+		t.Errorf("overlay.json should stay in the project: %v", err)
+	}
+}
+
+func TestSharedCache_ReusedAcrossCheckouts(t *testing.T) {
+	shared := t.TempDir()
+	var paths []string
+	for i := 0; i < 2; i++ {
+		dir := setupDir(t, sharedFiles)
+		e := NewEngine(dir)
+		e.SharedCache = shared
+		if err := e.Run(); err != nil {
+			t.Fatal(err)
+		}
+		sp := readShadowPath(t, e)
+		data, _ := os.ReadFile(sp)
+		if strings.Contains(string(data), dir) {
+			t.Errorf("shared shadow should not name its checkout %s:\n%s", dir, data)
+		}
+		if !strings.Contains(string(data), "//line example.com/m/main.go:") {
+			t.Errorf("shared shadow should carry module-relative //line paths:\n%s", data)
+		}
+		paths = append(paths, sp)
+	}
+	if paths[0] != paths[1] {
+		t.Errorf("identical sources in two checkouts should share a shadow: %s vs %s", paths[0], paths[1])
+	}
+}
+
+func TestSharedCache_KeyedOnOtherFilesDeclarations(t *testing.T) {
+	shared := t.TempDir()
+	main := "package main\n\nfunc Do(s string) {\n\t// @inco: len(strings.TrimSpace(s)) > 0\n}\n"
+	a := setupDir(t, map[string]string{"go.mod": sharedFiles["go.mod"], "main.go": main})
+	b := setupDir(t, map[string]string{
+		"go.mod":  sharedFiles["go.mod"],
+		"main.go": main,
+		"vars.go": "package main\n\nvar strings stringsT\n\ntype stringsT struct{}\n\nfunc (stringsT) TrimSpace(s string) string { return s }\n",
+	})
+	var paths []string
+	for _, dir := range []string{a, b} {
+		e := NewEngine(dir)
+		e.SharedCache = shared
+		if err := e.Run(); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, readShadowPath(t, e))
+	}
+	if paths[0] == paths[1] {
+		t.Fatalf("checkouts whose other files declare different names should not share a shadow: %s", paths[0])
+	}
+	if data, _ := os.ReadFile(paths[1]); strings.Contains(string(data), `"strings"`) {
+		t.Errorf("strings is declared in vars.go and must not be imported:\n%s", data)
+	}
+}
+
+func TestSharedCache_ModuleRelativeMessages(t *testing.T) {
+	shared := t.TempDir()
+	// The same module at the root and nested below it: panic messages
+	// name main.go in both, so the shadow is shared.
+	flat := NewEngine(setupDir(t, sharedFiles))
+	nested := NewEngine(setupDir(t, map[string]string{
+		"svc/go.mod":  sharedFiles["go.mod"],
+		"svc/main.go": sharedFiles["main.go"],
+	}))
+	var paths []string
+	for _, e := range []*Engine{flat, nested} {
+		e.SharedCache = shared
+		if err := e.Run(); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, readShadowPath(t, e))
+	}
+	if paths[0] != paths[1] {
+		t.Errorf("module-relative shadows should be shared: %s vs %s", paths[0], paths[1])
+	}
+	data, _ := os.ReadFile(paths[1])
+	if !strings.Contains(string(data), "(at main.go:4)") {
+		t.Errorf("panic message should name the module-relative path:\n%s", data)
+	}
+
+}
+
+func TestSharedCache_NotPrunedByProject(t *testing.T) {
+	shared := t.TempDir()
+	dir := setupDir(t, sharedFiles)
+	e1 := NewEngine(dir)
+	e1.SharedCache = shared
+	if err := e1.Run(); err != nil {
+		t.Fatal(err)
+	}
+	oldShadow := readShadowPath(t, e1)
+
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {\n\t// @inco: false\n}\n"), 0o644)
+	e2 := NewEngine(dir)
+	e2.SharedCache = shared
+	if err := e2.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldShadow); err != nil {
+		t.Errorf("shared shadow may be used elsewhere and must not be pruned: %v", err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// TrimSharedCache
+// ---------------------------------------------------------------------------
+
+// writeAged writes a shadow of size bytes whose mtime is age in the past.
+func writeAged(t *testing.T, path string, size int, age time.Duration) {
+	t.Helper()
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mt := time.Now().Add(-age)
+	os.Chtimes(path, mt, mt)
+}
+
+func TestTrimSharedCache_ByAge(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "aa", "old_1.go")
+	fresh := filepath.Join(dir, "bb", "fresh_2.go")
+	writeAged(t, old, 10, 48*time.Hour)
+	writeAged(t, fresh, 10, time.Minute)
+
+	r, err := TrimSharedCache(dir, 24*time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Removed != 1 || r.Kept != 1 {
+		t.Errorf("TrimSharedCache = %+v, want 1 removed, 1 kept", r)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("expired shadow should be removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("recent shadow should be kept")
+	}
+}
+
+func TestTrimSharedCache_BySize(t *testing.T) {
+	dir := t.TempDir()
+	oldest := filepath.Join(dir, "aa", "a_1.go")
+	middle := filepath.Join(dir, "bb", "b_2.go")
+	newest := filepath.Join(dir, "cc", "c_3.go")
+	writeAged(t, oldest, 100, 3*time.Hour)
+	writeAged(t, middle, 100, 2*time.Hour)
+	writeAged(t, newest, 100, time.Hour)
+
+	r, err := TrimSharedCache(dir, 0, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Removed != 2 || r.Size != 100 {
+		t.Errorf("TrimSharedCache = %+v, want 2 removed, 100 bytes left", r)
+	}
+	if _, err := os.Stat(newest); err != nil {
+		t.Error("most recently used shadow should be kept")
+	}
+}
+
+func TestTrimSharedCache_MissingDir(t *testing.T) {
+	r, err := TrimSharedCache(filepath.Join(t.TempDir(), "nope"), time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != (TrimResult{}) {
+		t.Errorf("TrimSharedCache on missing dir = %+v, want zero", r)
+	}
+}
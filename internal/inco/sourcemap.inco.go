@@ -0,0 +1,109 @@
+package inco
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// ---------------------------------------------------------------------------
+// Source map
+// ---------------------------------------------------------------------------
+//
+// sourcemap.json spells out for debuggers, coverage tools and editors what
+// the //line comments of the shadows only imply: which shadow lines are
+// copies of source lines, and which were injected for which directive.
+
+func (e *Engine) sourceMapPath() string {
+	return filepath.Join(e.cacheDir(), "sourcemap.json")
+}
+
+// writeSourceMap writes the source map of e.Overlay. Files generated by
+// this run bring their entries in results; a reused shadow keeps the
+// entry the previous source map has for it, since shadows are named by
+// their content. Only a shadow that map lacks is read back.
+func (e *Engine) writeSourceMap(results []fileResult) error {
+	old := e.loadSourceMap()
+	sm := SourceMap{Shadows: make(map[string]ShadowMap, len(e.Overlay.Replace))}
+	for _, r := range results {
+		// @inco: r.ShadowPath != "", -continue
+		if r.Map != nil {
+			sm.Shadows[r.ShadowPath] = *r.Map
+			continue
+		}
+		if m, ok := old.Shadows[r.ShadowPath]; ok && m.Source == r.Path {
+			sm.Shadows[r.ShadowPath] = m
+			continue
+		}
+		m, ok := buildShadowMap(r.ShadowPath, r.Path)
+		_ = ok // @inco: ok, -continue
+		sm.Shadows[r.ShadowPath] = m
+	}
+	data, err := json.MarshalIndent(sm, "", "  ")
+	_ = err // @inco: err == nil, -return(err)
+	return writeFileAtomic(e.sourceMapPath(), data)
+}
+
+// loadSourceMap reads the previous sourcemap.json, or returns an empty
+// source map when there is none.
+func (e *Engine) loadSourceMap() SourceMap {
+	var sm SourceMap
+	data, err := os.ReadFile(e.sourceMapPath())
+	_ = err // @inco: err == nil, -return(sm)
+	err = json.Unmarshal(data, &sm)
+	_ = err // @inco: err == nil, -return(SourceMap{})
+	return sm
+}
+
+// buildShadowMap reads the shadow at path and its source, src, and returns
+// the shadow's line mapping. ok is false when either cannot be read.
+func buildShadowMap(path, src string) (ShadowMap, bool) {
+	content, err := os.ReadFile(path)
+	_ = err // @inco: err == nil, -return(ShadowMap{}, false)
+	original, err := os.ReadFile(src)
+	_ = err // @inco: err == nil, -return(ShadowMap{}, false)
+	sl := newShadowLines(path, content, original)
+	return shadowMapOf(sl, src, scanDirectives(src, original)), true
+}
+
+// shadowMapOf returns the line mapping sl describes for the shadow of src,
+// whose directives by line are directives.
+func shadowMapOf(sl *shadowLines, src string, directives map[int]directiveCol) ShadowMap {
+	guards := sl.guards()
+
+	m := ShadowMap{Source: src, Ranges: []LineRange{}}
+	var cur *LineRange // the range of copied lines being extended
+	for line := 1; line <= sl.file.LineCount(); line++ {
+		if g, ok := guards[line+1]; ok {
+			// //line comment, if statement, action and closing brace.
+			cur = nil
+			sline, _ := sl.sourcePos(g.ifLine, 0)
+			r := LineRange{Start: line, End: g.bodyLine + 1, SourceLine: sline}
+			if dc, ok := directives[sline]; ok {
+				r.Directive = &DirectiveRef{ID: dc.id, Line: sline, Column: dc.col, Expr: dc.d.Expr, Action: dc.d.Action.String()}
+			}
+			m.Ranges = append(m.Ranges, r)
+			line = r.End
+			continue
+		}
+		generated := bytes.HasPrefix(sl.lines[line-1], []byte("//line "))
+		sline, _, ok := sl.position(line, 0)
+		if _, aligned := sl.aligned[line]; aligned && ok {
+			// Before the first guard, a line that differs from the source
+			// line it is aligned with is an added import.
+			generated = !bytes.Equal(bytes.TrimSpace(sl.lines[line-1]), bytes.TrimSpace(sl.sourceLine(sline)))
+		}
+		if generated || !ok {
+			cur = nil
+			continue
+		}
+		if cur != nil && sline == cur.SourceLine+line-cur.Start {
+			cur.End = line
+			continue
+		}
+		m.Ranges = append(m.Ranges, LineRange{Start: line, End: line, SourceLine: sline})
+		cur = &m.Ranges[len(m.Ranges)-1]
+	}
+	return m
+}
@@ -0,0 +1,143 @@
+package inco
+
+import (
+	"encoding/json"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// sourcemap.json
+// ---------------------------------------------------------------------------
+
+func loadTestSourceMap(t *testing.T, e *Engine) SourceMap {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(e.Root, ".inco_cache", "sourcemap.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sm SourceMap
+	if err := json.Unmarshal(data, &sm); err != nil {
+		t.Fatal(err)
+	}
+	return sm
+}
+
+const sourceMapSrc = `package main
+
+func main() {
+	s := "a"
+	x := z
+	// @inco: strings.HasPrefix(s, y)
+	s += "b"
+	_ = x // @inco: x, -return
+}
+`
+
+func TestSourceMap_Ranges(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":  "module example.com/m\n\ngo 1.21\n",
+		"main.go": sourceMapSrc,
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	shadow, content := readShadowPath(t, e), readShadow(t, e)
+	sm := loadTestSourceMap(t, e)
+	if len(sm.Shadows) != 1 {
+		t.Fatalf("source map has %d shadows, want 1", len(sm.Shadows))
+	}
+	m, ok := sm.Shadows[shadow]
+	if !ok {
+		t.Fatalf("source map has no entry for %s", shadow)
+	}
+	if want := filepath.Join(dir, "main.go"); m.Source != want {
+		t.Errorf("Source = %s, want %s", m.Source, want)
+	}
+
+	// The shadow has an import added before "func main", so its first
+	// lines are shifted, then come a standalone guard (source line 6), a
+	// //line comment, two copied lines, the inline directive's guard and
+	// another //line comment.
+	at := func(text string) int { return lineOf(t, content, text) }
+	ids := sourceDirectiveIDs(m.Source, []byte(sourceMapSrc))
+	first := at("if !(strings.HasPrefix") - 1
+	second := at("if !(x)") - 1
+	want := []LineRange{
+		{Start: 1, End: 2, SourceLine: 1},
+		{Start: at("func main"), End: first - 1, SourceLine: 3},
+		{Start: first, End: first + 3, SourceLine: 6, Directive: &DirectiveRef{ID: ids[6], Line: 6, Column: 2, Expr: "strings.HasPrefix(s, y)", Action: "panic"}},
+		{Start: first + 5, End: second - 1, SourceLine: 7},
+		{Start: second, End: second + 3, SourceLine: 8, Directive: &DirectiveRef{ID: ids[8], Line: 8, Column: 8, Expr: "x", Action: "return"}},
+		{Start: second + 5, End: second + 5, SourceLine: 9},
+	}
+	if !reflect.DeepEqual(m.Ranges, want) {
+		got, _ := json.Marshal(m.Ranges)
+		exp, _ := json.Marshal(want)
+		t.Errorf("Ranges =\n%s\nwant\n%s\nshadow:\n%s", got, exp, content)
+	}
+}
+
+func TestSourceMap_FollowsOverlay(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.21\n",
+		"a.go":   "package m\n\nfunc A(x int) {\n\t// @inco: x > 0\n}\n",
+		"b.go":   "package m\n\nfunc B(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// Removing b's directive drops its shadow from the overlay and from
+	// the source map; a's entry is carried over.
+	if err := os.WriteFile(filepath.Join(dir, "b.go"), []byte("package m\n\nfunc B(x int) {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sm := loadTestSourceMap(t, e)
+	if len(sm.Shadows) != len(e.Overlay.Replace) {
+		t.Fatalf("source map has %d shadows, overlay %d", len(sm.Shadows), len(e.Overlay.Replace))
+	}
+	for src, shadow := range e.Overlay.Replace {
+		if m, ok := sm.Shadows[shadow]; !ok || m.Source != src {
+			t.Errorf("source map entry of %s = %+v, want source %s", shadow, m, src)
+		}
+	}
+}
+
+func TestSourceMap_EntriesFromGeneration(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":  "module example.com/m\n\ngo 1.21\n",
+		"main.go": sourceMapSrc,
+	})
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "main.go")
+	r, diags := e.processFile(path, token.NewFileSet(), &Manifest{Files: map[string]ManifestEntry{}}, ReasonNew)
+	if len(diags) > 0 || r.Map == nil {
+		t.Fatalf("processFile = %+v, %v; want a source map entry", r, diags)
+	}
+	// The entry built from the generated buffers is the one the shadow
+	// and source on disk describe.
+	if m, ok := buildShadowMap(r.ShadowPath, path); !ok || !reflect.DeepEqual(*r.Map, m) {
+		t.Errorf("entry from generation = %+v, from disk = %+v", *r.Map, m)
+	}
+
+	// A reused shadow whose entry the previous map lacks is read back.
+	want := loadTestSourceMap(t, e)
+	os.Remove(e.sourceMapPath())
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadTestSourceMap(t, e); !reflect.DeepEqual(got, want) {
+		t.Errorf("rebuilt source map = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,355 @@
+package inco
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// go build -toolexec
+// ---------------------------------------------------------------------------
+//
+// In toolexec mode the go command runs inco in front of every tool. The
+// compiler's .go inputs that contain directives are replaced by their
+// shadows, written to a temporary directory for the duration of the
+// compile; nothing is written to .inco_cache and no overlay is needed.
+//
+// The go command keys its build cache on the contents of the original
+// inputs, the importcfg and the ID each tool reports for -V=full. A shadow
+// depends on nothing else but the inco binary, so ToolID folds the binary
+// into the compiler's ID and cached results stay correct.
+
+// ToolID returns the -V=full line that inco toolexec reports for tool,
+// given the tool's own output. It adds a build ID derived from the line
+// and the running inco binary, which the go command uses in place of the
+// tool's own for development toolchains and as part of the line for
+// releases.
+func ToolID(tool string, out []byte) (string, error) {
+	line := strings.TrimSpace(string(out))
+	f := strings.Fields(line)
+	valid := len(f) >= 3 && f[0] == tool && f[1] == "version"
+	_ = valid // @inco: valid, -return("", fmt.Errorf("%s -V=full: unexpected output %q", tool, line))
+	h := sha256.Sum256([]byte(line + "\n" + executableID()))
+	return fmt.Sprintf("%s +inco buildID=_/_/_/%x", line, h[:16]), nil
+}
+
+var (
+	executableOnce sync.Once
+	executableStr  string
+)
+
+// executableID identifies the running inco binary by the hash of its
+// contents, or by EngineVersion when the binary cannot be read.
+func executableID() string {
+	executableOnce.Do(func() {
+		executableStr = EngineVersion()
+		path, err := os.Executable()
+		_ = err // @inco: err == nil, -return
+		f, err := os.Open(path)
+		_ = err // @inco: err == nil, -return
+		defer f.Close()
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		_ = err // @inco: err == nil, -return
+		executableStr = fmt.Sprintf("%x", h.Sum(nil))
+	})
+	return executableStr
+}
+
+// RewriteCompileArgs prepares the arguments of a compile run by go build
+// -toolexec. Every .go input that contains directives is replaced by its
+// shadow, written to tmpDir; the other arguments are returned as given.
+// Response files (@file) are expanded and, if anything changed, rewritten
+// to tmpDir as well.
+//
+// The compiler can only import what its -importcfg lists, that is, what
+// some file of the package imports. Directives resolve package names
+// against that list, and a directive that needs any other package is
+// reported as a DiagNoImport error. When a file cannot be generated the
+// returned error is a *DiagnosticsError.
+func RewriteCompileArgs(args []string, tmpDir string) ([]string, []Diagnostic, error) {
+	expanded, respFile, err := expandResponseFiles(args)
+	_ = err // @inco: err == nil, -return(nil, nil, err)
+
+	var (
+		diags   []Diagnostic
+		changed bool
+		cfg     *importcfg
+		inputs  compileInputs
+	)
+	for _, arg := range expanded {
+		if isGoInput(arg) {
+			inputs = append(inputs, arg)
+		}
+	}
+	for i, arg := range expanded {
+		// @inco: isGoInput(arg), -continue
+		src, err := os.ReadFile(arg)
+		if err != nil {
+			diags = append(diags, fileError(arg, DiagRead, err)...)
+			continue
+		}
+		// @inco: bytes.Contains(src, directiveMarker), -continue
+		if cfg == nil {
+			cfg, err = readImportcfg(flagArg(expanded, "-importcfg"))
+			_ = err // @inco: err == nil, -return(nil, nil, err)
+		}
+		shadow, fileDiags := compileShadow(arg, src, cfg, inputs)
+		diags = append(diags, fileDiags...)
+		// @inco: shadow != nil, -continue
+		tmp := filepath.Join(tmpDir, strconv.Itoa(i)+"_"+filepath.Base(arg))
+		err = os.WriteFile(tmp, shadow, 0o644)
+		_ = err // @inco: err == nil, -return(nil, diags, fmt.Errorf("toolexec: %w", err))
+		expanded[i] = tmp
+		changed = true
+	}
+	sortDiagnostics(diags)
+	// @inco: !hasErrors(diags), -return(nil, diags, &DiagnosticsError{Diagnostics: diags})
+	_ = changed  // @inco: changed, -return(args, diags, nil)
+	_ = respFile // @inco: respFile, -return(expanded, diags, nil)
+	rsp := filepath.Join(tmpDir, "args.rsp")
+	err = os.WriteFile(rsp, encodeResponseFile(expanded), 0o644)
+	_ = err // @inco: err == nil, -return(nil, diags, fmt.Errorf("toolexec: %w", err))
+	return []string{"@" + rsp}, diags, nil
+}
+
+// isGoInput reports whether the compile argument arg is a .go input.
+func isGoInput(arg string) bool {
+	return strings.HasSuffix(arg, ".go") && !strings.HasPrefix(arg, "-")
+}
+
+// compileShadow returns the shadow of the compiler input at path, or nil
+// with the diagnostics that prevented it. Inputs the go command generated
+// itself (cgo and coverage output) start with a //line directive naming
+// their source, from which positions are taken. The names the package
+// declares are read from inputs, the compile's .go inputs, so they are
+// those of the files actually compiled.
+func compileShadow(path string, src []byte, cfg *importcfg, inputs compileInputs) ([]byte, []Diagnostic) {
+	orig, body := lineSource(src)
+	if orig == "" {
+		abs, err := filepath.Abs(path)
+		_ = err // @inco: err == nil, -return(nil, fileError(path, DiagInternal, err))
+		orig = abs
+	}
+	// Module-relative names keep default panic messages the same as in
+	// overlay mode.
+	root, modPath := findModule(filepath.Dir(orig))
+	if root == "" {
+		root = filepath.Dir(orig)
+	}
+	rel, err := filepath.Rel(root, orig)
+	_ = err // @inco: err == nil, -return(nil, fileError(path, DiagInternal, err))
+
+	shadow, diags, err := GenerateSource(filepath.ToSlash(rel), body, GenerateOptions{
+		FS:          inputs,
+		Files:       inputs.others(path),
+		LinePath:    orig,
+		Imports:     cfg.imports(),
+		PackagePath: importPath(root, modPath, filepath.Dir(orig), ""),
+	})
+	for i := range diags {
+		diags[i].Pos.Filename = orig
+	}
+	_ = err // @inco: err == nil, -return(nil, diags)
+
+	f, err := parser.ParseFile(token.NewFileSet(), "", shadow, parser.ImportsOnly)
+	_ = err // @inco: err == nil, -return(nil, append(diags, fileError(orig, DiagInternal, err)...))
+	for _, imp := range f.Imports {
+		impPath, _ := strconv.Unquote(imp.Path.Value)
+		ok := cfg.paths[impPath] || impPath == "unsafe" || impPath == "C"
+		_ = ok // @inco: !ok, -continue
+		diags = append(diags, Diagnostic{
+			Pos:      token.Position{Filename: orig},
+			Severity: SeverityError,
+			Code:     DiagNoImport,
+			Message:  fmt.Sprintf("directives need package %q, which no file of the package imports; import it in a regular file or build with -overlay", impPath),
+		})
+	}
+	// @inco: !hasErrors(diags), -return(nil, diags)
+	return append([]byte(lineDirective(orig, 1, 1)+"\n"), shadow...), diags
+}
+
+// compileInputs serves the compiler's .go inputs, which need not share a
+// directory, as the files "0.go", "1.go", ... in the order of the list.
+type compileInputs []string
+
+func (in compileInputs) Open(name string) (fs.File, error) {
+	i, err := strconv.Atoi(strings.TrimSuffix(name, ".go"))
+	valid := err == nil && i >= 0 && i < len(in) && name == strconv.Itoa(i)+".go"
+	_ = valid // @inco: valid, -return(nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist})
+	return os.Open(in[i])
+}
+
+// others returns the names in in of the inputs other than path.
+func (in compileInputs) others(path string) []string {
+	names := []string{}
+	for i, p := range in {
+		if p != path {
+			names = append(names, strconv.Itoa(i)+".go")
+		}
+	}
+	return names
+}
+
+// lineSource splits a leading //line directive for line 1, which precedes
+// the package clause of generated inputs, off src. It returns the file the
+// directive names and the rest of src, or "" and src when there is none.
+func lineSource(src []byte) (string, []byte) {
+	rest := src
+	for len(rest) > 0 {
+		line, next, _ := bytes.Cut(rest, []byte("\n"))
+		rest = next
+		text := strings.TrimSpace(string(line))
+		// @inco: !strings.HasPrefix(text, "package "), -break
+		m := lineOneRe.FindStringSubmatch(text)
+		_ = m // @inco: m != nil, -continue
+		return m[1], rest
+	}
+	return "", src
+}
+
+// lineOneRe matches a //line directive for line 1 (and column 1).
+// Group 1: the file name.
+var lineOneRe = regexp.MustCompile(`^//line (.+?):1(?::1)?$`)
+
+// flagArg returns the value of the compile flag name in args, given as
+// "name value" or "name=value", or "".
+func flagArg(args []string, name string) string {
+	for i, a := range args {
+		if a == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if v, ok := strings.CutPrefix(a, name+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// importcfg is what the compiler may import, as listed by the go command.
+type importcfg struct {
+	paths map[string]bool   // import paths as written in source
+	names map[string]string // default package name → import path ("" if ambiguous)
+}
+
+// imports returns the import map that directives are resolved against:
+// the packages of the importcfg, then the standard library, so that a
+// standard package the compiler was not given is reported as such rather
+// than left undefined.
+func (c *importcfg) imports() map[string]string {
+	m := make(map[string]string)
+	for name, impPath := range stdImports() {
+		m[name] = impPath
+	}
+	for name, impPath := range c.names {
+		m[name] = impPath
+	}
+	return m
+}
+
+// readImportcfg reads the compiler's -importcfg file. An empty path lists
+// nothing.
+func readImportcfg(path string) (*importcfg, error) {
+	cfg := &importcfg{paths: make(map[string]bool), names: make(map[string]string)}
+	// @inco: path != "", -return(cfg, nil)
+	data, err := os.ReadFile(path)
+	_ = err // @inco: err == nil, -return(nil, fmt.Errorf("toolexec: importcfg: %w", err))
+
+	// Actual paths that an importmap renames are not written in source.
+	mapped := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		verb, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		from, to, ok := strings.Cut(args, "=")
+		_ = ok // @inco: ok, -continue
+		switch verb {
+		case "importmap":
+			cfg.paths[from] = true
+			mapped[to] = true
+		case "packagefile":
+			cfg.paths[from] = true
+		}
+	}
+	for impPath := range cfg.paths {
+		// @inco: !mapped[impPath], -continue
+		name := defaultImportName(impPath)
+		if existing, ok := cfg.names[name]; ok && existing != impPath {
+			cfg.names[name] = ""
+		} else if !ok {
+			cfg.names[name] = impPath
+		}
+	}
+	return cfg, nil
+}
+
+// expandResponseFiles replaces every @file argument by the arguments the
+// file lists, one per line with \n and \\ escaped, and reports whether
+// there was one.
+func expandResponseFiles(args []string) ([]string, bool, error) {
+	var out []string
+	found := false
+	for _, a := range args {
+		name, ok := strings.CutPrefix(a, "@")
+		if !ok {
+			out = append(out, a)
+			continue
+		}
+		data, err := os.ReadFile(name)
+		_ = err // @inco: err == nil, -return(nil, false, fmt.Errorf("toolexec: %w", err))
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			out = append(out, decodeArg(line))
+		}
+		found = true
+	}
+	return out, found, nil
+}
+
+// decodeArg undoes the escaping of one response file line.
+func decodeArg(arg string) string {
+	// @inco: strings.Contains(arg, `\`), -return(arg)
+	var b strings.Builder
+	escaped := false
+	for _, r := range arg {
+		switch {
+		case escaped && r == 'n':
+			b.WriteByte('\n')
+		case escaped && r == '\\':
+			b.WriteByte('\\')
+		case escaped:
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\\':
+			escaped = true
+			continue
+		default:
+			b.WriteRune(r)
+		}
+		escaped = false
+	}
+	if escaped {
+		b.WriteByte('\\')
+	}
+	return b.String()
+}
+
+// encodeResponseFile returns the response file listing args.
+func encodeResponseFile(args []string) []byte {
+	var b strings.Builder
+	for _, a := range args {
+		a = strings.ReplaceAll(a, `\`, `\\`)
+		a = strings.ReplaceAll(a, "\n", `\n`)
+		b.WriteString(a)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,206 @@
+package inco
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// ToolID
+// ---------------------------------------------------------------------------
+
+func TestToolID(t *testing.T) {
+	for _, out := range []string{
+		"compile version go1.22.1\n",
+		"compile version devel go1.23-abc123 buildID=xyz/abc\n",
+	} {
+		line, err := ToolID("compile", []byte(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := strings.TrimSpace(out) + " +inco buildID=_/_/_/"
+		if !strings.HasPrefix(line, prefix) || len(line) != len(prefix)+32 {
+			t.Errorf("ToolID(%q) = %q", out, line)
+		}
+	}
+	a, _ := ToolID("compile", []byte("compile version go1.22.1"))
+	b, _ := ToolID("compile", []byte("compile version go1.22.2"))
+	if a[strings.LastIndex(a, "/"):] == b[strings.LastIndex(b, "/"):] {
+		t.Error("the build ID should depend on the tool's version")
+	}
+	if _, err := ToolID("compile", []byte("asm version go1.22.1")); err == nil {
+		t.Error("expected an error for another tool's output")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// RewriteCompileArgs
+// ---------------------------------------------------------------------------
+
+// setupCompile creates a module with package files and an importcfg
+// listing the given import paths, and returns the module directory and
+// the importcfg path.
+func setupCompile(t *testing.T, files map[string]string, imports ...string) (string, string) {
+	t.Helper()
+	files["go.mod"] = "module example.com/m\n\ngo 1.22\n"
+	dir := setupDir(t, files)
+	var cfg strings.Builder
+	for _, p := range imports {
+		cfg.WriteString("packagefile " + p + "=/cache/" + p + ".a\n")
+	}
+	cfgPath := filepath.Join(t.TempDir(), "importcfg")
+	if err := os.WriteFile(cfgPath, []byte(cfg.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, cfgPath
+}
+
+func TestRewriteCompileArgs(t *testing.T) {
+	dir, cfg := setupCompile(t, map[string]string{
+		"p/a.go": "package p\n\nfunc Div(a, b int) (int, error) {\n\t// @inco: b != 0, -return(0, fmt.Errorf(\"zero\"))\n\treturn a / b, nil\n}\n",
+		"p/b.go": "package p\n\nimport \"fmt\"\n\nvar _ = fmt.Sprint\n",
+	}, "fmt")
+	a, b := filepath.Join(dir, "p", "a.go"), filepath.Join(dir, "p", "b.go")
+	tmp := t.TempDir()
+	args := []string{"-o", "out.a", "-p", "example.com/m/p", "-importcfg", cfg, "-pack", a, b}
+	got, diags, err := RewriteCompileArgs(args, tmp)
+	if err != nil || len(diags) != 0 {
+		t.Fatalf("RewriteCompileArgs: %v, %v", err, diags)
+	}
+	if len(got) != len(args) || got[len(got)-1] != b || filepath.Dir(got[len(got)-2]) != tmp {
+		t.Fatalf("only a.go should be replaced, got %v", got)
+	}
+	shadow, _ := os.ReadFile(got[len(got)-2])
+	for _, want := range []string{"//line " + a + ":1:1\npackage p", "if !(b != 0)", `"fmt"`} {
+		if !strings.Contains(string(shadow), want) {
+			t.Errorf("shadow missing %q:\n%s", want, shadow)
+		}
+	}
+
+	// Without directives the arguments are returned as they are.
+	got, _, err = RewriteCompileArgs([]string{"-importcfg", cfg, b}, tmp)
+	if err != nil || len(got) != 3 || got[2] != b {
+		t.Errorf("RewriteCompileArgs = %v, %v", got, err)
+	}
+}
+
+func TestRewriteCompileArgs_PanicMessageMatchesOverlay(t *testing.T) {
+	// A module nested below the root: both modes name the file relative
+	// to that module.
+	dir, cfg := setupCompile(t, map[string]string{
+		"svc/go.mod": "module example.com/svc\n\ngo 1.22\n",
+		"svc/p/a.go": "package p\n\nfunc F(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	a := filepath.Join(dir, "svc", "p", "a.go")
+	got, _, err := RewriteCompileArgs([]string{"-p", "example.com/svc/p", "-importcfg", cfg, a}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	viaToolexec, _ := os.ReadFile(got[4])
+	e := NewEngine(dir)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	viaOverlay := readShadow(t, e)
+
+	message := regexp.MustCompile(`"inco violation [^"]*"`)
+	want := message.FindString(viaOverlay)
+	if !strings.Contains(want, "(at p/a.go:4)") {
+		t.Errorf("overlay message %s should name the module-relative path", want)
+	}
+	if got := message.FindString(string(viaToolexec)); got != want {
+		t.Errorf("toolexec message %s, overlay message %s", got, want)
+	}
+}
+
+// The names the package declares come from the files the compile is given,
+// whatever build constraints the directory's files carry.
+func TestRewriteCompileArgs_NamesFromCompiledFiles(t *testing.T) {
+	dir, cfg := setupCompile(t, map[string]string{
+		"a.go":      "package m\n\nfunc F() {\n\t// @inco: user.Name != \"\"\n}\n",
+		"tagged.go": "//go:build special\n\npackage m\n\nvar user = struct{ Name string }{\"x\"}\n",
+		"other.go":  "package m\n\nvar user = struct{ Name string }{\"y\"}\n",
+	}, "os/user")
+	a := filepath.Join(dir, "a.go")
+
+	// Built with -tags special: tagged.go declares user.
+	got, diags, err := RewriteCompileArgs([]string{"-importcfg", cfg, a, filepath.Join(dir, "tagged.go")}, t.TempDir())
+	if err != nil || len(diags) != 0 {
+		t.Fatalf("RewriteCompileArgs: %v, %v", err, diags)
+	}
+	if shadow, _ := os.ReadFile(got[2]); strings.Contains(string(shadow), `"os/user"`) {
+		t.Errorf("user is declared by a compiled file:\n%s", shadow)
+	}
+
+	// other.go is not compiled, so user is the package.
+	got, _, err = RewriteCompileArgs([]string{"-importcfg", cfg, a}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shadow, _ := os.ReadFile(got[2]); !strings.Contains(string(shadow), `"os/user"`) {
+		t.Errorf("files left out of the compile declare nothing:\n%s", shadow)
+	}
+}
+
+func TestRewriteCompileArgs_MissingImport(t *testing.T) {
+	dir, cfg := setupCompile(t, map[string]string{
+		"a.go": "package m\n\nfunc F(x int) error {\n\t// @inco: x > 0, -return(fmt.Errorf(\"bad\"))\n\treturn nil\n}\n",
+	})
+	_, diags, err := RewriteCompileArgs([]string{"-importcfg", cfg, filepath.Join(dir, "a.go")}, t.TempDir())
+	var de *DiagnosticsError
+	if !errors.As(err, &de) {
+		t.Fatalf("expected a *DiagnosticsError, got %v", err)
+	}
+	if len(diags) != 1 || diags[0].Code != DiagNoImport || !strings.Contains(diags[0].Message, `"fmt"`) {
+		t.Errorf("unexpected diagnostics %v", diags)
+	}
+}
+
+func TestRewriteCompileArgs_ResponseFile(t *testing.T) {
+	dir, cfg := setupCompile(t, map[string]string{
+		"a.go": "package m\n\nfunc F(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	a := filepath.Join(dir, "a.go")
+	rsp := filepath.Join(t.TempDir(), "args")
+	os.WriteFile(rsp, encodeResponseFile([]string{"-D", "multi\nline", "-importcfg", cfg, a}), 0o644)
+
+	tmp := t.TempDir()
+	got, _, err := RewriteCompileArgs([]string{"@" + rsp}, tmp)
+	if err != nil || len(got) != 1 || !strings.HasPrefix(got[0], "@"+tmp) {
+		t.Fatalf("expected a new response file, got %v, %v", got, err)
+	}
+	expanded, _, err := expandResponseFiles(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expanded) != 5 || expanded[1] != "multi\nline" || filepath.Dir(expanded[4]) != tmp {
+		t.Errorf("response file lists %q", expanded)
+	}
+}
+
+func TestRewriteCompileArgs_GeneratedInput(t *testing.T) {
+	// Coverage instrumentation copies the source to a work directory
+	// behind a //line directive naming the original.
+	dir, cfg := setupCompile(t, map[string]string{
+		"a.go": "package m\n\nfunc F(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	a := filepath.Join(dir, "a.go")
+	work := filepath.Join(t.TempDir(), "a.cover.go")
+	os.WriteFile(work, []byte("//line "+a+":1:1\npackage m\n\nfunc F(x int) {cover[0] = 1;\n\t// @inco: x > 0\n}\n"), 0o644)
+
+	got, _, err := RewriteCompileArgs([]string{"-importcfg", cfg, work}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadow, _ := os.ReadFile(got[2])
+	if !strings.Contains(string(shadow), "//line "+a+":4:") || strings.Count(string(shadow), "//line "+a+":1:1") != 1 {
+		t.Errorf("positions should refer to the original file:\n%s", shadow)
+	}
+	if !strings.Contains(string(shadow), "(at a.go:4)") {
+		t.Errorf("panic message should name the original file:\n%s", shadow)
+	}
+}
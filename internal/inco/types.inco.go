@@ -7,7 +7,7 @@
 //	// @inco: <expr>, -return(x, y)
 //	// @inco: <expr>, -continue
 //	// @inco: <expr>, -break
-//	// @inco: <expr>, -do(stmt)
+//	// @inco: <expr>, -log(args...)
 //
 // The default action is -panic with an auto-generated message.
 package inco
@@ -53,6 +53,21 @@ type Directive struct {
 	Action     ActionKind // panic (default), return, continue, break, do, log
 	ActionArgs []string   // e.g. -panic("msg") → ['"msg"'], -return(0, err) → ["0", "err"]
 	Expr       string     // the Go boolean expression
+	ID         string     // explicit id= override; empty to derive one (see directiveIDs)
+
+	// Byte offsets into the raw comment text, used to emit column-accurate
+	// //line and /*line*/ markers. ActionOffset is 0 when no action is written.
+	ExprOffset   int // start of Expr
+	ActionOffset int // start of the action name (after the leading '-')
+}
+
+// ImportPragma is the parsed form of an @inco.import: comment, which tells
+// the engine which package a name in the file's directives refers to:
+//
+//	// @inco.import: tmpl "html/template"
+type ImportPragma struct {
+	Name string // local package name used by directives
+	Path string // import path
 }
 
 // ---------------------------------------------------------------------------
@@ -66,12 +81,70 @@ type Overlay struct {
 
 // Manifest tracks source file hashes for incremental generation.
 // Stored as .inco_cache/manifest.json.
+//
+// Version and Config identify the generator and the settings the entries
+// were produced with; when either differs from the current run, every
+// entry is treated as stale.
 type Manifest struct {
-	Files map[string]ManifestEntry `json:"files"`
+	Version string                   `json:"version"` // EngineVersion() of the writer
+	Config  string                   `json:"config"`  // configuration fingerprint
+	Files   map[string]ManifestEntry `json:"files"`
 }
 
 // ManifestEntry records the state of a single source file at last gen.
 type ManifestEntry struct {
-	SrcHash    string `json:"src_hash"`    // SHA-256 hex of source content
-	ShadowPath string `json:"shadow_path"` // absolute path to shadow file
+	SrcHash    string `json:"src_hash"`              // SHA-256 hex of source content
+	ShadowPath string `json:"shadow_path,omitempty"` // absolute path to shadow file; empty when the file has no directives
+	Decls      string `json:"decls,omitempty"`       // hash of the names the files of the package declare
+
+	// Declares is what the file declares for the rest of its package, so
+	// that later runs need not read it again while its stamp is unchanged.
+	Declares *FileDecls `json:"declares,omitempty"`
+}
+
+// FileDecls is what a source file contributes to the scope of the other
+// files of its package, as read when it had Size and ModTime (in
+// nanoseconds since the epoch).
+type FileDecls struct {
+	Size        int64    `json:"size"`
+	ModTime     int64    `json:"mod_time"`
+	Package     string   `json:"package,omitempty"`     // empty when the file has no package clause
+	Constraints []string `json:"constraints,omitempty"` // //go:build and // +build lines
+	Cgo         bool     `json:"cgo,omitempty"`         // imports "C"
+	Names       []string `json:"names,omitempty"`       // package-level names
+}
+
+// SourceMap records how the lines of each shadow in the overlay relate to
+// its source. Stored as .inco_cache/sourcemap.json.
+type SourceMap struct {
+	Shadows map[string]ShadowMap `json:"shadows"` // by absolute shadow path
+}
+
+// ShadowMap is the line mapping of one shadow. Its ranges are in shadow
+// line order; lines that no range covers were written by the generator:
+// added imports and the //line comments that resume the source's
+// numbering after a guard.
+type ShadowMap struct {
+	Source string      `json:"source"` // absolute path of the source file
+	Ranges []LineRange `json:"ranges"`
+}
+
+// LineRange maps the shadow lines Start to End, inclusive. Lines copied
+// from the source map to consecutive source lines from SourceLine on; the
+// lines of an injected guard, which has a Directive, all map to the
+// directive's line.
+type LineRange struct {
+	Start      int           `json:"start"`
+	End        int           `json:"end"`
+	SourceLine int           `json:"source_line"`
+	Directive  *DirectiveRef `json:"directive,omitempty"`
+}
+
+// DirectiveRef identifies the directive an injected guard came from.
+type DirectiveRef struct {
+	ID     string `json:"id"`     // stable ID; see directiveIDs
+	Line   int    `json:"line"`   // 1-based line of the directive comment in the source
+	Column int    `json:"column"` // 1-based column of the comment
+	Expr   string `json:"expr"`
+	Action string `json:"action"` // panic, return, continue, break, do or log
 }
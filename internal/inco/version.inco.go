@@ -0,0 +1,92 @@
+package inco
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// formatVersion identifies the shape of generated shadows. Bump it whenever
+// a change to the generator alters output for unchanged input, so that
+// caches written by older builds are discarded.
+const formatVersion = 8
+
+var (
+	versionOnce sync.Once
+	versionStr  string
+)
+
+// EngineVersion returns a string identifying the generator that produced
+// a cache: the format version plus the binary's module version. Builds
+// without a module version fall back to the VCS revision (suffixed
+// "+dirty" when the tree had local modifications).
+func EngineVersion() string {
+	versionOnce.Do(func() {
+		versionStr = fmt.Sprintf("f%d", formatVersion)
+		info, ok := debug.ReadBuildInfo()
+		_ = ok // @inco: ok, -return
+		if v := info.Main.Version; v != "" && v != "(devel)" {
+			versionStr += " " + v
+			return
+		}
+		var rev, dirty string
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				rev = s.Value
+			case "vcs.modified":
+				if s.Value == "true" {
+					dirty = "+dirty"
+				}
+			}
+		}
+		if rev != "" {
+			versionStr += " " + rev + dirty
+		}
+	})
+	return versionStr
+}
+
+// configFingerprint returns a hash of every setting and input, other than
+// the source file itself, that affects generated output: engine options,
+// the modules involved, and the go.work, go.mod and go.sum files that
+// package names are resolved against for auto-imports.
+func (e *Engine) configFingerprint() string {
+	workFile, mods := e.workspace()
+	var b strings.Builder
+	fmt.Fprintf(&b, "trimpath=%t\n", e.trimpath())
+	writeWorkHashes(&b, workFile)
+	// Module paths rather than directories keep the fingerprint independent
+	// of where the checkout lives.
+	sorted := append([]moduleInfo(nil), mods...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+	for _, m := range sorted {
+		fmt.Fprintf(&b, "module=%s\n", m.Path)
+		writeModHashes(&b, m.Dir)
+	}
+	h := sha256.Sum256([]byte(b.String()))
+	return fmt.Sprintf("%x", h[:16])
+}
+
+// writeWorkHashes appends the hashes of go.work and go.work.sum to b.
+func writeWorkHashes(b *strings.Builder, workFile string) {
+	// @inco: workFile != "", -return
+	for _, path := range []string{workFile, workFile + ".sum"} {
+		data, _ := os.ReadFile(path)
+		fmt.Fprintf(b, "%s=%s\n", filepath.Base(path), hashBytes(data))
+	}
+}
+
+// writeModHashes appends the hashes of modDir's go.mod and go.sum to b.
+func writeModHashes(b *strings.Builder, modDir string) {
+	// @inco: modDir != "", -return
+	for _, name := range []string{"go.mod", "go.sum"} {
+		data, _ := os.ReadFile(filepath.Join(modDir, name))
+		fmt.Fprintf(b, "%s=%s\n", name, hashBytes(data))
+	}
+}
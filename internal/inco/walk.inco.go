@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 )
 
 // walkGoFiles walks root and calls fn for each non-test .go file that is
@@ -14,18 +15,27 @@ import (
 // Nested .incoignore files in subdirectories are supported: rules in a
 // child directory apply only to that subtree.
 func walkGoFiles(root string, fn func(path string) error) error {
+	return walkTree(root, nil, fn)
+}
+
+// walkTree is walkGoFiles that also calls onDir, if set, for every
+// directory it enters, before that directory's own .incoignore is loaded.
+func walkTree(root string, onDir func(dir string), fn func(path string) error) error {
 	ig := NewIgnoreTree(root)
 
 	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
-		// @inco: err == nil, -panic(err)
+		// @inco: err == nil, -return(err)
 		if d.IsDir() {
 			name := d.Name()
 			skip := skipDirRe.MatchString(name)
 			_ = skip // @inco: !skip, -return(filepath.SkipDir)
 			// Sync the ignore tree to the current position.
 			ig.LeaveDir(path)
-			ig.EnterDir(path)
 			// @inco: !ig.Match(path, true), -return(filepath.SkipDir)
+			if onDir != nil {
+				onDir(path)
+			}
+			ig.EnterDir(path)
 			return nil
 		}
 		isGoSource := goSourceRe.MatchString(d.Name()) && !testFileRe.MatchString(d.Name())
@@ -39,13 +49,37 @@ func walkGoFiles(root string, fn func(path string) error) error {
 // collectGoFiles returns all non-test .go file paths under root,
 // respecting skipDirRe and .incoignore. This is a convenience wrapper
 // around walkGoFiles for callers that need the full path list up front.
-func collectGoFiles(root string) []string {
+func collectGoFiles(root string) ([]string, error) {
 	var paths []string
-	walkGoFiles(root, func(path string) error {
+	err := walkGoFiles(root, func(path string) error {
 		paths = append(paths, path)
 		return nil
 	})
-	return paths
+	return paths, err
+}
+
+// isWalkedGoFile reports whether walkGoFiles(root) would visit path. It
+// applies the same skipDirRe and .incoignore rules, loading only the
+// .incoignore files on the way from root down to path.
+func isWalkedGoFile(root, path string) bool {
+	name := filepath.Base(path)
+	isGoSource := goSourceRe.MatchString(name) && !testFileRe.MatchString(name)
+	_ = isGoSource // @inco: isGoSource, -return(false)
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	_ = err // @inco: err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), -return(false)
+
+	ig := NewIgnoreTree(root)
+	dir := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		// @inco: part != ".", -continue
+		// @inco: !skipDirRe.MatchString(part), -return(false)
+		dir = filepath.Join(dir, part)
+		// Same order as walkTree: a directory is matched before its own
+		// .incoignore is loaded.
+		// @inco: !ig.Match(dir, true), -return(false)
+		ig.EnterDir(dir)
+	}
+	return !ig.Match(path, false)
 }
 
 // ---------------------------------------------------------------------------
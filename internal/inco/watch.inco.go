@@ -0,0 +1,180 @@
+package inco
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Watcher keeps an engine's overlay up to date while sources change.
+//
+// It polls the tree with the same traversal as Engine.Run (skipDirRe and
+// .incoignore apply), batches changes until the tree has been quiet for
+// Debounce, and regenerates only the changed files with Engine.RunFiles.
+// A changed .incoignore can add or drop any number of files, so it
+// triggers a full run instead.
+//
+// Polling keeps the watcher dependency-free and portable; stat-ing every
+// source file per tick is cheap next to regenerating it.
+type Watcher struct {
+	Engine   *Engine
+	Interval time.Duration // how often the tree is polled
+	Debounce time.Duration // quiet period before a batch of changes is regenerated
+
+	// OnRun, if set, is called after every regeneration with the files
+	// that triggered it (nil for a full run) and the run's error.
+	OnRun func(changed []string, err error)
+}
+
+// NewWatcher creates a Watcher for e with default timings.
+func NewWatcher(e *Engine) *Watcher {
+	return &Watcher{
+		Engine:   e,
+		Interval: 500 * time.Millisecond,
+		Debounce: 300 * time.Millisecond,
+	}
+}
+
+// fileStamp is what the watcher compares between polls.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// Watch runs a full generation, then regenerates changed files until stop
+// is closed. Generation errors are reported through OnRun and do not end
+// the watch; the next run after a failure is a full one.
+func (w *Watcher) Watch(stop <-chan struct{}) error {
+	// @inco: w.Engine != nil, -return(fmt.Errorf("Watch: nil engine"))
+	// @inco: w.Interval > 0, -return(fmt.Errorf("Watch: interval must be positive"))
+
+	// Snapshot first: anything that changes during the initial run is
+	// picked up by the first poll.
+	prev, _ := w.snapshot()
+	err := w.Engine.Run()
+	w.report(nil, err)
+	failed := err != nil
+
+	pending := make(map[string]bool)
+	var lastChange time.Time
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		cur, ok := w.snapshot()
+		_ = ok // @inco: ok, -continue
+		changed := diffSnapshots(prev, cur)
+		prev = cur
+		for _, p := range changed {
+			pending[p] = true
+		}
+		if len(changed) > 0 {
+			lastChange = time.Now()
+			continue
+		}
+		quiet := len(pending) > 0 && time.Since(lastChange) >= w.Debounce
+		_ = quiet // @inco: quiet, -continue
+
+		paths := make([]string, 0, len(pending))
+		for p := range pending {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		pending = make(map[string]bool)
+
+		if failed || changesIgnore(paths) {
+			err = w.Engine.Run()
+		} else {
+			err = w.Engine.RunFiles(paths)
+		}
+		failed = err != nil
+		w.report(paths, err)
+	}
+}
+
+func (w *Watcher) report(changed []string, err error) {
+	// @inco: w.OnRun != nil, -return
+	w.OnRun(changed, err)
+}
+
+// snapshot stats every file a full run would visit, plus the .incoignore
+// files of the directories it walks and the go.work, go.mod and go.sum
+// files of the engine's modules so that configuration changes are
+// noticed. The go.mod and go.work a walked directory, or a directory
+// above Root, may gain are stat-ed too, so that a new module or workspace
+// is noticed as well. It reports false when the tree changed under the
+// walk (e.g. a directory was removed mid-walk); the tick is then skipped
+// and the next poll sees a consistent tree.
+func (w *Watcher) snapshot() (map[string]fileStamp, bool) {
+	snap := make(map[string]fileStamp)
+	stat := func(path string) {
+		if stamp, ok := statStamp(path); ok {
+			snap[path] = stamp
+		}
+	}
+	for _, root := range w.Engine.walkRoots() {
+		err := walkTree(root, func(dir string) {
+			stat(filepath.Join(dir, ".incoignore"))
+			stat(filepath.Join(dir, "go.mod"))
+			stat(filepath.Join(dir, "go.work"))
+		}, func(path string) error {
+			stat(path)
+			return nil
+		})
+		_ = err // @inco: err == nil, -return(nil, false)
+	}
+	for dir, prev := filepath.Dir(w.Engine.Root), w.Engine.Root; dir != prev; dir, prev = filepath.Dir(dir), dir {
+		stat(filepath.Join(dir, "go.work"))
+	}
+	workFile, mods := w.Engine.workspace()
+	if workFile != "" {
+		stat(workFile)
+		stat(workFile + ".sum")
+	}
+	for _, m := range mods {
+		stat(filepath.Join(m.Dir, "go.mod"))
+		stat(filepath.Join(m.Dir, "go.sum"))
+	}
+	return snap, true
+}
+
+// changesIgnore reports whether paths include an .incoignore file.
+func changesIgnore(paths []string) bool {
+	for _, p := range paths {
+		if filepath.Base(p) == ".incoignore" {
+			return true
+		}
+	}
+	return false
+}
+
+// statStamp returns the fileStamp of path, or false if it cannot be stat-ed.
+func statStamp(path string) (fileStamp, bool) {
+	info, err := os.Stat(path)
+	_ = err // @inco: err == nil, -return(fileStamp{}, false)
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}, true
+}
+
+// diffSnapshots returns the paths that were added, removed or modified
+// between prev and cur.
+func diffSnapshots(prev, cur map[string]fileStamp) []string {
+	var changed []string
+	for p, s := range cur {
+		old, ok := prev[p]
+		if !ok || old.size != s.size || !old.modTime.Equal(s.modTime) {
+			changed = append(changed, p)
+		}
+	}
+	for p := range prev {
+		if _, ok := cur[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,166 @@
+package inco
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Watcher — regenerates changed files
+// ---------------------------------------------------------------------------
+
+func TestWatcher_RegeneratesChangedFile(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go": "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+		"lib.go":  "package main\n\nfunc lib(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	runs := startWatcher(t, dir)
+
+	if r := waitRun(t, runs); r.changed != nil {
+		t.Fatalf("first run should be a full run, got %v", r.changed)
+	}
+	libPath := filepath.Join(dir, "lib.go")
+	os.WriteFile(libPath, []byte("package main\n\nfunc lib(x int) {\n\t// @inco: x > 100\n}\n"), 0o644)
+
+	r := waitRun(t, runs)
+	if len(r.changed) != 1 || r.changed[0] != libPath {
+		t.Fatalf("expected run for [%s], got %v", libPath, r.changed)
+	}
+	shadow, _ := os.ReadFile(r.replace[libPath])
+	if !strings.Contains(string(shadow), "x > 100") {
+		t.Errorf("lib.go shadow not regenerated:\n%s", shadow)
+	}
+}
+
+func TestWatcher_IncoignoreTriggersFullRun(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"main.go":     "package main\n\nfunc main() {\n\t// @inco: true\n}\n",
+		"gen/gen.go":  "package gen\n\nfunc F(x int) {\n\t// @inco: x > 0\n}\n",
+		"gen/more.go": "package gen\n\nfunc G(x int) {\n\t// @inco: x > 1\n}\n",
+	})
+	runs := startWatcher(t, dir)
+
+	r := waitRun(t, runs)
+	genPath := filepath.Join(dir, "gen", "gen.go")
+	if _, ok := r.replace[genPath]; !ok {
+		t.Fatal("gen/gen.go should be generated before it is ignored")
+	}
+	os.WriteFile(filepath.Join(dir, ".incoignore"), []byte("gen/\n"), 0o644)
+
+	r = waitRun(t, runs)
+	for _, name := range []string{"gen.go", "more.go"} {
+		if _, ok := r.replace[filepath.Join(dir, "gen", name)]; ok {
+			t.Errorf("gen/%s is ignored now and should have left the overlay", name)
+		}
+	}
+	if _, ok := r.replace[filepath.Join(dir, "main.go")]; !ok {
+		t.Error("main.go should stay in the overlay")
+	}
+
+	os.Remove(filepath.Join(dir, ".incoignore"))
+	r = waitRun(t, runs)
+	if _, ok := r.replace[genPath]; !ok {
+		t.Error("gen/gen.go should be generated again once it is no longer ignored")
+	}
+}
+
+func TestWatcher_NewGoModTriggersRun(t *testing.T) {
+	dir := setupDir(t, map[string]string{
+		"go.mod":   "module example.com/root\n\ngo 1.22\n",
+		"sub/b.go": "package sub\n\nfunc B(x int) {\n\t// @inco: x > 0\n}\n",
+	})
+	runs := startWatcher(t, dir)
+	bPath := filepath.Join(dir, "sub", "b.go")
+	r := waitRun(t, runs)
+	before, _ := os.ReadFile(r.replace[bPath])
+
+	modPath := filepath.Join(dir, "sub", "go.mod")
+	os.WriteFile(modPath, []byte("module other\n\ngo 1.22\n"), 0o644)
+	r = waitRun(t, runs)
+	if len(r.changed) != 1 || r.changed[0] != modPath {
+		t.Fatalf("expected run for [%s], got %v", modPath, r.changed)
+	}
+	// The directive's ID is derived from the package path, which changed.
+	if after, _ := os.ReadFile(r.replace[bPath]); string(after) == string(before) {
+		t.Errorf("sub/b.go should be regenerated for its new module:\n%s", after)
+	}
+}
+
+// watchRun is what the watcher reported for one run: the changed files
+// (nil for a full run) and a copy of the overlay it produced, taken on the
+// watcher's goroutine so that tests never read Engine fields concurrently
+// with a run.
+type watchRun struct {
+	changed []string
+	replace map[string]string
+}
+
+// startWatcher runs a fast-polling Watcher on dir until the test ends.
+func startWatcher(t *testing.T, dir string) <-chan watchRun {
+	t.Helper()
+	e := NewEngine(dir)
+	w := NewWatcher(e)
+	w.Interval = 10 * time.Millisecond
+	w.Debounce = 20 * time.Millisecond
+	runs := make(chan watchRun, 4)
+	w.OnRun = func(changed []string, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		runs <- watchRun{changed: changed, replace: maps.Clone(e.Overlay.Replace)}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- w.Watch(stop) }()
+	t.Cleanup(func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return runs
+}
+
+func waitRun(t *testing.T, runs <-chan watchRun) watchRun {
+	t.Helper()
+	select {
+	case r := <-runs:
+		return r
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the watcher to run")
+		return watchRun{}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// diffSnapshots
+// ---------------------------------------------------------------------------
+
+func TestDiffSnapshots(t *testing.T) {
+	now := time.Now()
+	prev := map[string]fileStamp{
+		"same.go":    {size: 1, modTime: now},
+		"touched.go": {size: 1, modTime: now},
+		"removed.go": {size: 1, modTime: now},
+	}
+	cur := map[string]fileStamp{
+		"same.go":    {size: 1, modTime: now},
+		"touched.go": {size: 1, modTime: now.Add(time.Second)},
+		"added.go":   {size: 1, modTime: now},
+	}
+	got := diffSnapshots(prev, cur)
+	want := map[string]bool{"touched.go": true, "removed.go": true, "added.go": true}
+	if len(got) != len(want) {
+		t.Fatalf("diffSnapshots = %v, want %v", got, want)
+	}
+	for _, p := range got {
+		if !want[p] {
+			t.Errorf("unexpected change %q", p)
+		}
+	}
+}